@@ -0,0 +1,346 @@
+package mbbolt
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var benchVal = []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+func BenchmarkWrite(b *testing.B) {
+	noSync := DefaultOptions.Clone()
+	noSync.NoSync = true
+
+	for _, bc := range []struct {
+		name  string
+		opts  *Options
+		batch bool
+		rand  bool
+	}{
+		{"Seq", nil, false, false},
+		{"Rand", nil, false, true},
+		{"SeqBatch", nil, true, false},
+		{"RandBatch", nil, true, true},
+		{"SeqNoSync", noSync, false, false},
+		{"RandNoSync", noSync, false, true},
+		{"SeqBatchNoSync", noSync, true, false},
+		{"RandBatchNoSync", noSync, true, true},
+		{"WriteHeavy", RecommendedOptions(WorkloadWriteHeavy), true, true},
+		{"BulkLoad", RecommendedOptions(WorkloadBulkLoad), false, false},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "bench.db"), bc.opts)
+			dieIf(b, err)
+			defer db.Close()
+			if db.UseBatch(bc.batch); bc.batch {
+				// batching only pays off with many concurrent writers
+				b.SetParallelism(64)
+			}
+			benchWrite(b, db, bc.rand)
+		})
+	}
+}
+
+func BenchmarkWriteTx(b *testing.B) {
+	for _, w := range []struct {
+		name string
+		w    Workload
+	}{
+		{"Default", WorkloadDefault},
+		{"BulkLoad", WorkloadBulkLoad},
+	} {
+		w := w
+		b.Run(w.name, func(b *testing.B) {
+			db, err := Open(filepath.Join(b.TempDir(), "bench.db"), RecommendedOptions(w.w))
+			dieIf(b, err)
+			defer db.Close()
+			b.SetBytes(int64(len(benchVal)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			dieIf(b, db.Update(func(tx *Tx) error {
+				for i := 0; i < b.N; i++ {
+					if err := tx.PutBytes("bench", benchKey(uint64(i)), benchVal); err != nil {
+						return err
+					}
+				}
+				return nil
+			}))
+		})
+	}
+}
+
+func benchWrite(b *testing.B, db *DB, random bool) {
+	var seq, seed atomic.Int64
+	b.SetBytes(int64(len(benchVal)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// PutBytes only batches if it's called concurrently, so always run in parallel
+	// to compare the batched / unbatched paths fairly.
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(seed.Add(1)))
+		for pb.Next() {
+			var k uint64
+			if random {
+				k = rnd.Uint64()
+			} else {
+				k = uint64(seq.Add(1))
+			}
+			if err := db.PutBytes("bench", benchKey(k), benchVal); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func benchKey(k uint64) string {
+	return fmt.Sprintf("%020d", k)
+}
+
+func TestRecommendedOptions(t *testing.T) {
+	if opts := RecommendedOptions(WorkloadDefault); !reflect.DeepEqual(opts, DefaultOptions) {
+		t.Fatal("WorkloadDefault should match DefaultOptions")
+	}
+	if opts := RecommendedOptions(WorkloadBulkLoad); !opts.NoSync || DefaultOptions.NoSync {
+		t.Fatal("WorkloadBulkLoad should disable sync without touching DefaultOptions")
+	}
+}
+
+func BenchmarkGetBytes(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "bench.db"), nil)
+	dieIf(b, err)
+	defer db.Close()
+	dieIf(b, db.PutBytes("bench", "key", benchVal))
+
+	b.Run("Clone", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.GetBytes("bench", "key"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Into", func(b *testing.B) {
+		var buf []byte
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if buf, err = db.GetBytesInto("bench", "key", buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkBinaryKeys(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "bench.db"), nil)
+	dieIf(b, err)
+	defer db.Close()
+
+	keys := make([][]byte, 1024)
+	for i := range keys {
+		keys[i] = []byte(benchKey(uint64(i)))
+	}
+
+	dieIf(b, db.Update(func(tx *Tx) error {
+		for _, k := range keys {
+			if err := tx.PutBytesB("bench", k, benchVal); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	b.Run("String", func(b *testing.B) {
+		b.ReportAllocs()
+		db.View(func(tx *Tx) error {
+			for i := 0; i < b.N; i++ {
+				tx.GetBytes("bench", string(keys[i%len(keys)]), false)
+			}
+			return nil
+		})
+	})
+
+	b.Run("Bytes", func(b *testing.B) {
+		b.ReportAllocs()
+		db.View(func(tx *Tx) error {
+			for i := 0; i < b.N; i++ {
+				tx.GetBytesB("bench", keys[i%len(keys)], false)
+			}
+			return nil
+		})
+	})
+}
+
+func BenchmarkBloomMiss(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "bench.db"), nil)
+	dieIf(b, err)
+	defer db.Close()
+
+	const N = 100000
+	dieIf(b, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if err := tx.PutBytes("bench", benchKey(uint64(i)), benchVal); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = benchKey(uint64(N + i))
+	}
+	miss := func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if db.Exists("bench", keys[i%len(keys)]) {
+				b.Fatal("unexpected hit")
+			}
+		}
+	}
+
+	b.Run("NoBloom", miss)
+	dieIf(b, db.EnableBloom("bench", N))
+	b.Run("Bloom", miss)
+}
+
+func BenchmarkReadPool(b *testing.B) {
+	db, err := Open(filepath.Join(b.TempDir(), "bench.db"), nil)
+	dieIf(b, err)
+	defer db.Close()
+	dieIf(b, db.PutBytes("bench", "key", benchVal))
+
+	get := func(tx *Tx) error {
+		tx.GetBytes("bench", "key", false)
+		return nil
+	}
+
+	b.Run("View", func(b *testing.B) {
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				db.View(get)
+			}
+		})
+	})
+
+	b.Run("Pool", func(b *testing.B) {
+		p := db.NewReadPool(10 * time.Millisecond)
+		defer p.Close()
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				p.View(get)
+			}
+		})
+	})
+}
+
+func BenchmarkSegDBBuckets(b *testing.B) {
+	seg := NewSegDB(b.TempDir(), ".db", nil, 64)
+	defer seg.Close()
+	for _, db := range seg.dbs {
+		dieIf(b, db.Update(func(tx *Tx) error {
+			for i := 0; i < 32; i++ {
+				if _, err := tx.CreateBucketIfNotExists(fmt.Sprintf("bucket%02d", i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if n := len(seg.Buckets()); n != 32 {
+			b.Fatalf("expected 32 buckets, got %d", n)
+		}
+	}
+}
+
+// putSortedData returns n sorted records for BatchPutSorted and the same records shuffled.
+func putSortedData(n int) (sorted, shuffled []KV[[]byte]) {
+	sorted = make([]KV[[]byte], n)
+	for i := range sorted {
+		sorted[i] = KV[[]byte]{benchKey(uint64(i)), benchVal}
+	}
+	shuffled = append([]KV[[]byte](nil), sorted...)
+	rand.New(rand.NewSource(42)).Shuffle(n, func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return
+}
+
+func putUnsorted(db *DB, bucket string, kvs []KV[[]byte]) error {
+	return db.Update(func(tx *Tx) error {
+		for _, kv := range kvs {
+			if err := tx.PutBytes(bucket, kv.Key, kv.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func TestBatchPutSorted(t *testing.T) {
+	const N = 20000
+	sorted, shuffled := putSortedData(N)
+
+	size := func(put func(db *DB) error) int64 {
+		db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+		dieIf(t, err)
+		defer db.Close()
+		dieIf(t, put(db))
+		for _, kv := range sorted[:100] {
+			if v, err := db.GetBytes("b", kv.Key); err != nil || string(v) != string(kv.Value) {
+				t.Fatalf("%s: %q %v", kv.Key, v, err)
+			}
+		}
+		r, err := db.FragmentationReport()
+		dieIf(t, err)
+		return r.Size
+	}
+
+	ss := size(func(db *DB) error { return db.BatchPutSorted("b", sorted) })
+	us := size(func(db *DB) error { return putUnsorted(db, "b", shuffled) })
+	if ss >= us {
+		t.Fatalf("expected the sorted insert to use less space: %d >= %d", ss, us)
+	}
+}
+
+// BenchmarkBatchPutSorted compares BatchPutSorted with putting the same records in random order in a single Update,
+// bytes/op is the size of the db after the insert.
+func BenchmarkBatchPutSorted(b *testing.B) {
+	const N = 10000
+	sorted, shuffled := putSortedData(N)
+	for _, bc := range []struct {
+		name string
+		put  func(db *DB, bucket string) error
+	}{
+		{"Sorted", func(db *DB, bucket string) error { return db.BatchPutSorted(bucket, sorted) }},
+		{"Unsorted", func(db *DB, bucket string) error { return putUnsorted(db, bucket, shuffled) }},
+	} {
+		bc := bc
+		b.Run(bc.name, func(b *testing.B) {
+			opts := DefaultOptions.Clone()
+			opts.NoSync = true
+			db, err := Open(filepath.Join(b.TempDir(), "bench.db"), opts)
+			dieIf(b, err)
+			defer db.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				dieIf(b, bc.put(db, fmt.Sprintf("b%d", i)))
+			}
+			b.StopTimer()
+			r, err := db.FragmentationReport()
+			dieIf(b, err)
+			b.ReportMetric(float64(r.Size)/float64(b.N), "bytes/op")
+		})
+	}
+}
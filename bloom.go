@@ -0,0 +1,177 @@
+package mbbolt
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/alpineiq/genh"
+)
+
+const (
+	bloomBitsPerKey = 10 // ~1% false positives with bloomHashes
+	bloomHashes     = 7
+)
+
+// bloomFilter is a fixed size bloom filter, keys are never removed so deleted keys become false positives.
+type bloomFilter struct {
+	mux  sync.RWMutex
+	bits []uint64
+	keys int // the estimate it was sized for
+
+	// bucket is set once the bucket is known to exist, until then (and after DeleteBucket) misses aren't trusted,
+	// so a missing bucket fails the same way with or without a filter.
+	bucket genh.AtomicBool
+}
+
+func newBloomFilter(estimatedKeys int) *bloomFilter {
+	if estimatedKeys < 1 {
+		estimatedKeys = 1
+	}
+	return &bloomFilter{bits: make([]uint64, (estimatedKeys*bloomBitsPerKey+63)/64), keys: estimatedKeys}
+}
+
+// hashes returns the two halves of the key's hash, the k positions are h1 + i*h2.
+func (bf *bloomFilter) hashes(key []byte) (h1, h2 uint32) {
+	h := fnv.New64a()
+	h.Write(key)
+	s := h.Sum64()
+	return uint32(s), uint32(s>>32) | 1
+}
+
+func (bf *bloomFilter) add(key []byte) {
+	h1, h2 := bf.hashes(key)
+	n := uint32(len(bf.bits) * 64)
+	bf.mux.Lock()
+	for i := uint32(0); i < bloomHashes; i++ {
+		p := (h1 + i*h2) % n
+		bf.bits[p/64] |= 1 << (p % 64)
+	}
+	bf.mux.Unlock()
+}
+
+func (bf *bloomFilter) mayContain(key []byte) bool {
+	h1, h2 := bf.hashes(key)
+	n := uint32(len(bf.bits) * 64)
+	bf.mux.RLock()
+	defer bf.mux.RUnlock()
+	for i := uint32(0); i < bloomHashes; i++ {
+		p := (h1 + i*h2) % n
+		if bf.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// EnableBloom builds an in-memory bloom filter of the keys in bucket, sized for estimatedKeys,
+// that's kept up to date on puts and lets Exists / Get / GetBytes skip the lookup of keys that definitely don't exist.
+// Deleted keys stay in the filter, so a lot of deletes (or growing far past estimatedKeys) makes it less useful,
+// calling EnableBloom again rebuilds it. On a follower (see OpenFollower) it's rebuilt every time the file is reopened.
+// Only writes made through Tx / DB are added to it, keys put directly through the embedded bbolt *Bucket
+// (or a bucket deleted through the embedded bbolt tx) aren't seen by the filter and can cause false negatives.
+func (db *DB) EnableBloom(bucket string, estimatedKeys int) error {
+	build := func(tx *Tx) error {
+		bf := newBloomFilter(estimatedKeys)
+		if err := addBucketKeys(tx.BBoltTx, bucket, bf); err != nil {
+			return err
+		}
+		db.blooms.Set(bucket, bf)
+		return nil
+	}
+	if db.opts.ReadOnly { // e.g. a follower, nothing can be written to it
+		return db.View(build)
+	}
+	// build it in a write tx so no put can slip between the scan and the filter being used
+	return db.Update(build)
+}
+
+// addBucketKeys adds every key of bucket to the filters.
+func addBucketKeys(tx *BBoltTx, bucket string, bfs ...*bloomFilter) error {
+	b := tx.Bucket(unsafeBytes(bucket))
+	if b == nil {
+		return nil
+	}
+	if err := b.ForEach(func(k, _ []byte) error {
+		for _, bf := range bfs {
+			bf.add(k)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, bf := range bfs {
+		bf.bucket.Store(true)
+	}
+	return nil
+}
+
+// reloadBlooms rebuilds the bloom filters from bdb when a follower swaps it in, swap must store it.
+// The current filters get its keys too, so reads racing the swap don't miss keys that are only in one of the files.
+func (db *DB) reloadBlooms(bdb *BBoltDB, swap func()) error {
+	cur := db.blooms.Clone()
+	fresh := make(map[string]*bloomFilter, len(cur))
+	if err := bdb.View(func(tx *BBoltTx) error {
+		for bucket, bf := range cur {
+			fresh[bucket] = newBloomFilter(bf.keys)
+			if err := addBucketKeys(tx, bucket, bf, fresh[bucket]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	swap()
+	db.blooms.Update(func(m map[string]*bloomFilter) {
+		for bucket, bf := range fresh {
+			if m[bucket] == cur[bucket] { // not enabled again or disabled in the meantime
+				m[bucket] = bf
+			}
+		}
+	})
+	return nil
+}
+
+// DisableBloom drops the bloom filter of bucket, see EnableBloom.
+func (db *DB) DisableBloom(bucket string) {
+	db.blooms.Delete(bucket)
+}
+
+func (db *DB) bloomAdd(bucket string, key []byte) {
+	if bf := db.blooms.Get(bucket); bf != nil {
+		bf.add(key)
+		bf.bucket.Store(true)
+	}
+}
+
+// bloomDropBucket stops trusting the filter of bucket once tx, which deletes it, commits.
+// If the bucket is created again in the meantime the next put trusts it again.
+func (tx *Tx) bloomDropBucket(bucket string) {
+	if bf := tx.db.blooms.Get(bucket); bf != nil {
+		tx.OnCommit(func() { bf.bucket.Store(false) })
+	}
+}
+
+// bloomMiss returns true if bucket has a bloom filter, exists and key definitely isn't in it.
+func (db *DB) bloomMiss(bucket string, key []byte) bool {
+	bf := db.blooms.Get(bucket)
+	return bf != nil && bf.bucket.Load() && !bf.mayContain(key)
+}
+
+// Exists returns true if key is in bucket, without reading its value.
+func (tx *Tx) Exists(bucket, key string) bool {
+	b := tx.Bucket(bucket)
+	return b != nil && b.Get(unsafeBytes(key)) != nil
+}
+
+// Exists is Tx.Exists in its own transaction, it doesn't open one at all if the bloom filter of bucket rules out key.
+func (db *DB) Exists(bucket, key string) (ok bool) {
+	if db.bloomMiss(bucket, unsafeBytes(key)) {
+		return false
+	}
+	db.View(func(tx *Tx) error {
+		ok = tx.Exists(bucket, key)
+		return nil
+	})
+	return
+}
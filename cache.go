@@ -1,15 +1,22 @@
 package mbbolt
 
 import (
+	"container/list"
 	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/alpineiq/genh"
 	"github.com/alpineiq/oerrs"
 )
 
-const ErrDeleteKey = oerrs.String("delete")
+const (
+	ErrDeleteKey   = oerrs.String("delete")
+	ErrCacheClosed = oerrs.String("cache closed")
+
+	errCacheFull = oerrs.String("cache full")
+)
 
 func CacheOf[T any](db *DB, bucket string, loadAll bool) *Cache[T] {
 	if err := db.Update(func(tx *Tx) error {
@@ -29,47 +36,113 @@ func CacheOf[T any](db *DB, bucket string, loadAll bool) *Cache[T] {
 	return c
 }
 
+// CacheOfLRU is CacheOf but keeps at most maxEntries values in memory, evicting the least recently used ones,
+// evicted keys are loaded from the db again on their next Get (and count as a miss).
+// ForEach reads the bucket from the db instead of loading all of it in memory.
+func CacheOfLRU[T any](db *DB, bucket string, maxEntries int) *Cache[T] {
+	if maxEntries < 1 {
+		log.Panicf("CacheOfLRU: maxEntries (%d) < 1", maxEntries)
+	}
+	c := CacheOf[T](db, bucket, false)
+	c.lru = newLRU[T](maxEntries)
+	return c
+}
+
 type Cache[T any] struct {
 	hits   atomic.Int64
 	misses atomic.Int64
 
-	m      genh.LMap[string, T]
+	m      genh.LMap[string, cacheEntry[T]]
+	lru    *lru[T] // used instead of m if the cache is bounded
 	db     TypedDB[T]
 	bucket string
+	ttl    atomic.Int64
 
 	NoBatch bool
 
-	loadOnce sync.Once
+	// ForEach loads the whole bucket the first time it's called, and again after InvalidateAll
+	loadMux sync.Mutex
+	loaded  bool
+
+	// writes hold a read lock so Flush / Close can wait for them
+	wmux   sync.RWMutex
+	closed bool
 }
 
+// Sync loads the bucket in memory, only up to its max entries for a CacheOfLRU.
 func (c *Cache[T]) Sync() {
 	if err := c.db.ForEach(c.bucket, func(key string, v T) error {
-		c.m.Set(key, v)
+		if c.lru != nil {
+			if c.lru.set(key, newCacheEntry(v)) >= c.lru.max {
+				return errCacheFull
+			}
+			return nil
+		}
+		c.m.Set(key, newCacheEntry(v))
 		return nil
-	}); err != nil {
+	}); err != nil && err != errCacheFull {
 		log.Printf("mbbolt: %s (%s): %v", c.db.Path(), c.bucket, err)
 	}
 }
 
 // Use clone if T is a pointer or contains slices/maps/pointers that will be modified.
 func (c *Cache[T]) Get(key string) (v T, err error) {
+	if c.lru != nil {
+		return c.getLRU(key)
+	}
 	found := true
-	v = c.m.MustGet(key, func() T {
+	e := c.m.MustGet(key, func() (e cacheEntry[T]) {
 		found = false
-		if v, err = c.db.Get(c.bucket, key); err == nil {
-			c.m.Set(key, v)
+		if e.v, err = c.db.Get(c.bucket, key); err == nil {
+			e.at = time.Now().UnixNano()
+			c.m.Set(key, e)
 		}
-		return v
+		return
 	})
+	if found && c.expired(e) {
+		found = false
+		if e.v, err = c.db.Get(c.bucket, key); err == nil {
+			c.m.Set(key, newCacheEntry(e.v))
+		}
+	}
 	if !found {
 		c.misses.Add(1)
 	} else {
 		c.hits.Add(1)
 	}
-	v = genh.Clone(v, false)
+	v = genh.Clone(e.v, false)
 	return
 }
 
+func (c *Cache[T]) getLRU(key string) (v T, err error) {
+	e, ok := c.lru.get(key)
+	if ok && !c.expired(e) {
+		c.hits.Add(1)
+		return genh.Clone(e.v, false), nil
+	}
+	c.misses.Add(1)
+	if v, err = c.db.Get(c.bucket, key); err != nil {
+		return
+	}
+	if ok { // stale
+		c.lru.set(key, newCacheEntry(v))
+	} else { // like LMap.MustGet, a value set by a concurrent write while loading wins
+		v = c.lru.add(key, newCacheEntry(v)).v
+	}
+	return genh.Clone(v, false), nil
+}
+
+// SetTTL makes Get reload entries that were loaded or written more than d ago from the db (counting it as a miss),
+// 0 (the default) keeps them until they're deleted or evicted. ForEach doesn't check it.
+func (c *Cache[T]) SetTTL(d time.Duration) {
+	c.ttl.Store(int64(d))
+}
+
+func (c *Cache[T]) expired(e cacheEntry[T]) bool {
+	ttl := c.ttl.Load()
+	return ttl > 0 && time.Now().UnixNano()-e.at > ttl
+}
+
 func (c *Cache[T]) Put(key string, v T) (err error) {
 	return c.Update(func(tx *Tx) (_ string, _ T, err error) {
 		err = tx.PutValue(c.bucket, key, v)
@@ -85,15 +158,29 @@ func (c *Cache[T]) Delete(key string) (err error) {
 }
 
 func (c *Cache[T]) ForEach(fn func(k string, v T) error) (err error) {
-	c.loadOnce.Do(c.Sync)
-	c.m.ForEach(func(k string, v T) bool {
-		err = fn(k, v)
+	if c.lru != nil {
+		return c.db.ForEach(c.bucket, fn)
+	}
+	c.loadMux.Lock()
+	if !c.loaded {
+		c.Sync()
+		c.loaded = true
+	}
+	c.loadMux.Unlock()
+	c.m.ForEach(func(k string, e cacheEntry[T]) bool {
+		err = fn(k, e.v)
 		return err == nil
 	})
 	return
 }
 
 func (c *Cache[T]) Update(fn func(tx *Tx) (key string, v T, err error)) (err error) {
+	c.wmux.RLock()
+	defer c.wmux.RUnlock()
+	if c.closed {
+		return ErrCacheClosed
+	}
+
 	var (
 		key string
 		v   T
@@ -101,11 +188,11 @@ func (c *Cache[T]) Update(fn func(tx *Tx) (key string, v T, err error)) (err err
 	ufn := func(tx *Tx) error {
 		if key, v, err = fn(tx); err == nil {
 			if err = tx.PutValue(c.bucket, key, v); err == nil {
-				c.m.Set(key, genh.Clone(v, false))
+				c.set(key, genh.Clone(v, false))
 			}
 		}
 		if err == ErrDeleteKey {
-			c.m.Delete(key)
+			c.delete(key)
 			err = nil
 		}
 		return err
@@ -116,6 +203,153 @@ func (c *Cache[T]) Update(fn func(tx *Tx) (key string, v T, err error)) (err err
 	return c.db.Batch(ufn)
 }
 
+// Flush waits for any in-flight writes and makes sure their batch is committed.
+func (c *Cache[T]) Flush() error {
+	c.wmux.Lock()
+	c.wmux.Unlock()
+	return c.db.BatchBarrier()
+}
+
+// Close flushes the pending writes, any writes after Close return ErrCacheClosed.
+// It doesn't close the underlying db.
+func (c *Cache[T]) Close() error {
+	c.wmux.Lock()
+	closed := c.closed
+	c.closed = true
+	c.wmux.Unlock()
+	if closed {
+		return nil
+	}
+	return c.db.BatchBarrier()
+}
+
+// Invalidate drops key from memory so the next Get reads it from the db again,
+// e.g. after another process wrote to the file. It doesn't touch the bucket.
+func (c *Cache[T]) Invalidate(key string) {
+	c.delete(key)
+}
+
+// InvalidateAll is Invalidate for every key, it's much cheaper than creating a new cache.
+func (c *Cache[T]) InvalidateAll() {
+	c.loadMux.Lock()
+	defer c.loadMux.Unlock()
+	if c.lru != nil {
+		c.lru.clear()
+	} else {
+		c.m.Clear()
+	}
+	c.loaded = false
+}
+
 func (c *Cache[T]) Stats() (hits, misses int64) {
 	return c.hits.Load(), c.misses.Load()
 }
+
+func (c *Cache[T]) set(key string, v T) {
+	if c.lru != nil {
+		c.lru.set(key, newCacheEntry(v))
+		return
+	}
+	c.m.Set(key, newCacheEntry(v))
+}
+
+func (c *Cache[T]) delete(key string) {
+	if c.lru != nil {
+		c.lru.delete(key)
+		return
+	}
+	c.m.Delete(key)
+}
+
+// cacheEntry is a cached value and when it was stored, in unix nanoseconds.
+type cacheEntry[T any] struct {
+	v  T
+	at int64
+}
+
+func newCacheEntry[T any](v T) cacheEntry[T] {
+	return cacheEntry[T]{v, time.Now().UnixNano()}
+}
+
+// lru is a map that keeps at most max entries, evicting the least recently used ones.
+type lru[T any] struct {
+	mux sync.Mutex
+	max int
+	ll  list.List // of *lruEntry[T], most recently used first
+	m   map[string]*list.Element
+}
+
+type lruEntry[T any] struct {
+	key string
+	cacheEntry[T]
+}
+
+func newLRU[T any](max int) *lru[T] {
+	return &lru[T]{max: max, m: make(map[string]*list.Element, max)}
+}
+
+func (l *lru[T]) get(key string) (v cacheEntry[T], ok bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if e := l.m[key]; e != nil {
+		l.ll.MoveToFront(e)
+		return e.Value.(*lruEntry[T]).cacheEntry, true
+	}
+	return
+}
+
+// set stores v and returns the number of entries.
+func (l *lru[T]) set(key string, v cacheEntry[T]) int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if e := l.m[key]; e != nil {
+		e.Value.(*lruEntry[T]).cacheEntry = v
+		l.ll.MoveToFront(e)
+	} else {
+		l.insert(key, v)
+	}
+	return l.ll.Len()
+}
+
+// add stores v unless key is already there, and returns the stored value.
+func (l *lru[T]) add(key string, v cacheEntry[T]) cacheEntry[T] {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if e := l.m[key]; e != nil {
+		l.ll.MoveToFront(e)
+		return e.Value.(*lruEntry[T]).cacheEntry
+	}
+	l.insert(key, v)
+	return v
+}
+
+// insert adds a new entry and evicts the oldest one if it's over max, l.mux must be held.
+func (l *lru[T]) insert(key string, v cacheEntry[T]) {
+	l.m[key] = l.ll.PushFront(&lruEntry[T]{key, v})
+	if l.ll.Len() > l.max {
+		old := l.ll.Remove(l.ll.Back()).(*lruEntry[T])
+		delete(l.m, old.key)
+	}
+}
+
+func (l *lru[T]) delete(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if e := l.m[key]; e != nil {
+		l.ll.Remove(e)
+		delete(l.m, key)
+	}
+}
+
+func (l *lru[T]) clear() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.ll.Init()
+	l.m = make(map[string]*list.Element, l.max)
+}
+
+func (l *lru[T]) len() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.ll.Len()
+}
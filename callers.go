@@ -0,0 +1,87 @@
+package mbbolt
+
+import (
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CallerStat is the write transaction latency of a single calling function, see DB.CallerStats.
+type CallerStat struct {
+	Count    int64         `json:"count"`
+	TotalDur time.Duration `json:"totalDur"`
+	MaxDur   time.Duration `json:"maxDur"`
+}
+
+type callerStats struct {
+	sync.Mutex
+	names map[[8]uintptr]string
+	m     map[string]*CallerStat
+}
+
+// pkgPrefix is the prefix of the functions in this package, they're skipped when looking for the caller.
+var pkgPrefix = reflect.TypeOf((*DB)(nil)).Elem().PkgPath() + "."
+
+// callerPCs returns the stack starting skip frames above the function calling it,
+// it's an array so it can be used as a map key.
+func callerPCs(skip int) (pcs [8]uintptr, n int) {
+	n = runtime.Callers(skip+2, pcs[:])
+	return
+}
+
+// trackCaller is deferred by Update and Batch with their start time when Options.TrackCallers is set.
+func (db *DB) trackCaller(start time.Time) {
+	took := time.Since(start)
+	pcs, n := callerPCs(2)
+
+	cs := &db.callers
+	cs.Lock()
+	defer cs.Unlock()
+	name, ok := cs.names[pcs]
+	if !ok {
+		name = callerName(pcs[:n])
+		if cs.names == nil {
+			cs.names, cs.m = map[[8]uintptr]string{}, map[string]*CallerStat{}
+		}
+		cs.names[pcs] = name
+	}
+	st := cs.m[name]
+	if st == nil {
+		st = &CallerStat{}
+		cs.m[name] = st
+	}
+	st.Count++
+	st.TotalDur += took
+	if took > st.MaxDur {
+		st.MaxDur = took
+	}
+}
+
+// callerName returns the first function in pcs that's outside this package (tests count as outside).
+func callerName(pcs []uintptr) string {
+	frames := runtime.CallersFrames(pcs)
+	for {
+		fr, more := frames.Next()
+		if fr.Function != "" && (!strings.HasPrefix(fr.Function, pkgPrefix) || strings.HasSuffix(fr.File, "_test.go")) {
+			return fr.Function
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+// CallerStats returns the number and latency of Update / Batch calls grouped by the function that called them,
+// it's empty unless Options.TrackCallers is set.
+func (db *DB) CallerStats() map[string]CallerStat {
+	cs := &db.callers
+	cs.Lock()
+	defer cs.Unlock()
+	out := make(map[string]CallerStat, len(cs.m))
+	for k, v := range cs.m {
+		out[k] = *v
+	}
+	return out
+}
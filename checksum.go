@@ -0,0 +1,63 @@
+package mbbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// checksumMagic prefixes checksummed values, the leading 0 can't start a valid json value
+// and a msgpack value starting with it is a single byte, so it doesn't clash with unchecksummed data.
+var checksumMagic = [4]byte{0, 'c', 's', 1}
+
+const checksumHeaderLen = len(checksumMagic) + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ChecksumError is returned when a value's stored checksum doesn't match its data.
+type ChecksumError struct {
+	Bucket   string
+	Key      string
+	Expected uint32
+	Actual   uint32
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("mbbolt: checksum mismatch for %s::%q (expected %08x, got %08x)", e.Bucket, e.Key, e.Expected, e.Actual)
+}
+
+func addChecksum(v []byte) []byte {
+	out := make([]byte, checksumHeaderLen+len(v))
+	copy(out, checksumMagic[:])
+	binary.LittleEndian.PutUint32(out[len(checksumMagic):], crc32.Checksum(v, crcTable))
+	copy(out[checksumHeaderLen:], v)
+	return out
+}
+
+// verifyChecksum strips and validates the checksum header, values without it are returned as-is.
+func verifyChecksum(bucket string, key, v []byte) ([]byte, error) {
+	if len(v) < checksumHeaderLen || !bytes.Equal(v[:len(checksumMagic)], checksumMagic[:]) {
+		return v, nil
+	}
+	exp := binary.LittleEndian.Uint32(v[len(checksumMagic):])
+	v = v[checksumHeaderLen:]
+	if act := crc32.Checksum(v, crcTable); act != exp {
+		return nil, &ChecksumError{Bucket: bucket, Key: string(key), Expected: exp, Actual: act}
+	}
+	return v, nil
+}
+
+func (db *DB) encodeValue(v []byte) []byte {
+	if !db.checksums || v == nil {
+		return v
+	}
+	return addChecksum(v)
+}
+
+func (db *DB) decodeValue(bucket string, key, v []byte) ([]byte, error) {
+	if !db.checksums || v == nil {
+		return v, nil
+	}
+	return verifyChecksum(bucket, key, v)
+}
@@ -0,0 +1,146 @@
+package mbbolt
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/alpineiq/oerrs"
+	"go.etcd.io/bbolt"
+)
+
+const ErrTxActive = oerrs.String("transactions are active")
+
+// Compact copies every bucket and key of the db into a fresh file at dst, without the free pages, and returns its size.
+// Values are copied as is (the marshaler isn't involved) and bucket sequences are kept.
+// The source is read in a single read transaction so it works on a read-only db, while writes to dst are committed
+// every repairTxMaxSize bytes. opts defaults to the db's own options (freelist, mmap, page size, etc.),
+// it's always opened for writing, and dst must not exist.
+func (db *DB) Compact(dst string, opts *Options) (int64, error) {
+	h, err := db.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer db.release(h)
+	return db.compactTo(h.BBoltDB, dst, opts)
+}
+
+// CompactInPlace compacts the db into a temp file next to it and renames it over the current one.
+// It only runs if no transaction is open, otherwise it returns ErrTxActive right away,
+// and every transaction started while it's running waits for it to finish.
+func (db *DB) CompactInPlace() (err error) {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if !db.compactMux.TryLock() {
+		return ErrTxActive
+	}
+	defer db.compactMux.Unlock()
+	if db.closed.Load() {
+		return bbolt.ErrDatabaseNotOpen
+	}
+
+	old, fp := db.h.Load(), db.path
+	tmp := fp + ".compact"
+	os.Remove(tmp)
+	if _, err = db.compactTo(old.BBoltDB, tmp, nil); err != nil {
+		return
+	}
+	if err = old.Close(); err != nil {
+		os.Remove(tmp)
+		return
+	}
+
+	// if the rename fails the old file is reopened
+	err = os.Rename(tmp, fp)
+	bdb, oerr := db.opts.openBolt(fp)
+	if oerr != nil {
+		return oerrs.Errorf("compact %s: reopen: %w", fp, oerr)
+	}
+	bdb.MaxBatchDelay, bdb.MaxBatchSize = old.MaxBatchDelay, old.MaxBatchSize
+	db.batchTxID.Store(0) // tx ids start over in the new file
+	db.h.Store(newBoltHandle(bdb))
+	return
+}
+
+// compactTo is Compact from src without the locking, dst is removed on error.
+func (db *DB) compactTo(src *BBoltDB, dst string, opts *Options) (n int64, err error) {
+	if opts == nil {
+		opts = db.opts
+	}
+	opts = opts.Clone()
+	opts.ReadOnly = false
+
+	if _, err = os.Stat(dst); err == nil {
+		return 0, oerrs.Errorf("compact %s: %w", dst, os.ErrExist)
+	}
+	out, err := bbolt.Open(dst, 0o600, opts.BoltOpts())
+	if err != nil {
+		return
+	}
+	if err = bbolt.Compact(out, src, repairTxMaxSize); err == nil {
+		// NoSync may be set, the file is about to replace the db or be used as a backup
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return 0, oerrs.Errorf("compact %s: %w", db.path, err)
+	}
+
+	st, err := os.Stat(dst)
+	if err != nil {
+		return
+	}
+	return st.Size(), nil
+}
+
+// EnableAutoCompact checks the FragmentationReport of the db every checkInterval and runs CompactInPlace
+// once its Ratio is >= threshold, checks that find open transactions are skipped until the next interval.
+// onDone is called with the reports before and after every compaction, if it's nil the result is logged.
+// The returned func stops the checks, they also stop once the db is closed.
+func (db *DB) EnableAutoCompact(threshold float64, checkInterval time.Duration, onDone func(before, after FragReport, err error)) (stop func()) {
+	if onDone == nil {
+		onDone = func(before, after FragReport, err error) {
+			if err != nil {
+				log.Printf("mbbolt: auto compact %s: %v", db.path, err)
+				return
+			}
+			log.Printf("mbbolt: auto compacted %s: %d -> %d bytes", db.path, before.Size, after.Size)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(checkInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if db.closed.Load() {
+				return
+			}
+			before, err := db.FragmentationReport()
+			if err != nil || before.Ratio < threshold {
+				continue
+			}
+			if err = db.CompactInPlace(); err == ErrTxActive {
+				continue
+			}
+			var after FragReport
+			if err == nil {
+				after, err = db.FragmentationReport()
+			}
+			onDone(before, after, err)
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -0,0 +1,140 @@
+package mbbolt
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAutoCompact(t *testing.T) {
+	const N = 10000
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if err := tx.PutBytes("b", benchKey(uint64(i)), benchVal); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if i%10 == 0 {
+				continue
+			}
+			if err := tx.Delete("b", benchKey(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	r, err := db.FragmentationReport()
+	dieIf(t, err)
+	if r.Ratio < 0.5 {
+		t.Fatalf("expected a fragmented db: %+v", r)
+	}
+
+	// an open tx blocks compaction
+	tx, err := db.Begin(false)
+	dieIf(t, err)
+	if err := db.CompactInPlace(); err != ErrTxActive {
+		t.Fatalf("expected ErrTxActive, got %v", err)
+	}
+	dieIf(t, tx.Rollback())
+
+	type result struct {
+		before, after FragReport
+		err           error
+	}
+	ch := make(chan result, 1)
+	stop := db.EnableAutoCompact(0.5, time.Millisecond*10, func(before, after FragReport, err error) {
+		select {
+		case ch <- result{before, after, err}:
+		default:
+		}
+	})
+	defer stop()
+
+	select {
+	case res := <-ch:
+		dieIf(t, res.err)
+		t.Logf("before: %d (%.2f), after: %d (%.2f)", res.before.Size, res.before.Ratio, res.after.Size, res.after.Ratio)
+		if res.after.Size >= res.before.Size || res.after.Ratio >= 0.5 {
+			t.Fatalf("db wasn't compacted: %+v -> %+v", res.before, res.after)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the auto compaction")
+	}
+	stop()
+
+	n := 0
+	dieIf(t, db.ForEachBytes("b", func(k, v []byte) error {
+		n++
+		return nil
+	}))
+	if n != N/10 {
+		t.Fatalf("expected %d keys, got %d", N/10, n)
+	}
+	dieIf(t, db.PutBytes("b", "new", benchVal))
+}
+
+func TestCompactTo(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	db, err := Open(src, nil)
+	dieIf(t, err)
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.PutBytes("b", benchKey(uint64(i)), benchVal); err != nil {
+				return err
+			}
+			if i%2 == 1 {
+				if err := tx.Delete("b", benchKey(uint64(i))); err != nil {
+					return err
+				}
+			}
+		}
+		return tx.SetNextIndex("b", 42)
+	}))
+	dieIf(t, db.Close())
+
+	ro := DefaultOptions.Clone()
+	ro.ReadOnly = true
+	db, err = Open(src, ro)
+	dieIf(t, err)
+	defer db.Close()
+
+	dst := filepath.Join(dir, "dst.db")
+	n, err := db.Compact(dst, nil)
+	dieIf(t, err)
+	if st, err := os.Stat(dst); err != nil || st.Size() != n {
+		t.Fatalf("expected %d bytes, got %v %v", n, st, err)
+	}
+	if _, err := db.Compact(dst, nil); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected os.ErrExist, got %v", err)
+	}
+
+	cdb, err := Open(dst, nil)
+	dieIf(t, err)
+	defer cdb.Close()
+	if idx := cdb.CurrentIndex("b"); idx != 42 {
+		t.Fatalf("expected sequence 42, got %d", idx)
+	}
+	cnt := 0
+	dieIf(t, cdb.ForEachBytes("b", func(k, v []byte) error {
+		if string(v) != string(benchVal) {
+			t.Fatalf("%s: unexpected value %q", k, v)
+		}
+		cnt++
+		return nil
+	}))
+	if cnt != 500 {
+		t.Fatalf("expected 500 keys, got %d", cnt)
+	}
+}
@@ -1,12 +1,18 @@
 package mbbolt
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"os"
 	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -18,26 +24,95 @@ var (
 	DefaultMarshalFn   = json.Marshal
 	DefaultUnmarshalFn = json.Unmarshal
 	ErrBucketNotFound  = bbolt.ErrBucketNotFound
+
+	// DefaultFallbackUnmarshalFns is used by TypedDB.GetAuto if Options.FallbackUnmarshalFns isn't set.
+	DefaultFallbackUnmarshalFns = []UnmarshalFn{json.Unmarshal, genh.UnmarshalMsgpack}
 )
 
+const ErrKeyNotFound = oerrs.String("key not found")
+
+const ErrViewTimeout = oerrs.String("timed out waiting for a read transaction")
+
+const ErrReadOnly = oerrs.String("db is read-only")
+
 type DB struct {
-	b           *BBoltDB
-	marshalFn   MarshalFn
-	unmarshalFn UnmarshalFn
+	h     atomic.Pointer[boltHandle] // see acquire
+	path  string
+	opts  *Options
+	codec atomic.Pointer[marshaler] // swapped as a pair so readers never see mismatched fns
+
+	fallbackUnmarshalFns []UnmarshalFn
 
 	onClose func()
 	slow    *slowUpdate
 
-	useBatch genh.AtomicBool
+	checksums   bool
+	autoBuckets bool
+	rawStrings  bool
+
+	recoverPanics bool
+	trackCallers  bool
+
+	maxKeySize   int
+	maxValueSize int
+
+	orderBuckets map[string]bool
+
+	useBatch  genh.AtomicBool
+	closed    genh.AtomicBool
+	readOnly  genh.AtomicBool
+	following genh.AtomicBool // set by OpenFollower once it starts polling
+
+	// compactMux is read locked by every transaction, CompactInPlace only runs if it can grab the write lock right away,
+	// and Close blocks on it until they're done, see rlock
+	compactMux sync.RWMutex
+
+	replOnce sync.Once
+	replOn   genh.AtomicBool
+	repl     chan []Mutation
+
+	// replMux guards replQueue and replFlushing, see queuePublish
+	replMux      sync.Mutex
+	replQueue    []*replTicket
+	replFlushing bool
+
+	watchers genh.LMap[int64, func([]Mutation)]
+	watchID  genh.AtomicInt64
+
+	callers    callerStats
+	valueSizes *valueSizes
+
+	blooms genh.LMap[string, *bloomFilter]
+
+	openReads  genh.AtomicInt64
+	openWrites genh.AtomicInt64
+
+	batchCalls   genh.AtomicInt64
+	batchFlushes genh.AtomicInt64
+	batchTxID    genh.AtomicInt64 // the id of the last committed batch tx, see getBatchTxFn
 }
 
 func (db *DB) SetMarshaler(marshalFn MarshalFn, unmarshalFn UnmarshalFn) {
 	if marshalFn == nil || unmarshalFn == nil {
 		log.Panic(" marshalFn == nil || unmarshalFn == nil")
 	}
-	db.marshalFn, db.unmarshalFn = marshalFn, unmarshalFn
+	db.codec.Store(&marshaler{marshalFn, unmarshalFn})
 }
 
+// Marshalers returns the marshal / unmarshal funcs currently used by the db, see SetMarshaler.
+func (db *DB) Marshalers() (MarshalFn, UnmarshalFn) {
+	m := db.codec.Load()
+	return m.marshal, m.unmarshal
+}
+
+type marshaler struct {
+	marshal   MarshalFn
+	unmarshal UnmarshalFn
+}
+
+func (db *DB) marshalFn(v any) ([]byte, error)      { return db.codec.Load().marshal(v) }
+func (db *DB) unmarshalFn(data []byte, v any) error { return db.codec.Load().unmarshal(data, v) }
+
 func (db *DB) OnSlowUpdate(minDuration time.Duration, fn OnSlowUpdateFn) {
 	if db.slow != nil {
 		log.Panic("multiple calls")
@@ -51,27 +126,176 @@ func (db *DB) OnSlowUpdate(minDuration time.Duration, fn OnSlowUpdateFn) {
 	}
 }
 
+// GetBytes returns a copy of the value of key, or ErrKeyNotFound if the bucket or the key doesn't exist,
+// a key with an empty value returns an empty non-nil slice.
 func (db *DB) GetBytes(bucket, key string) (out []byte, err error) {
+	return db.GetBytesB(bucket, unsafeBytes(key))
+}
+
+// GetBytesB is GetBytes with a binary key.
+func (db *DB) GetBytesB(bucket string, key []byte) (out []byte, err error) {
+	if db.bloomMiss(bucket, key) {
+		return nil, ErrKeyNotFound
+	}
+	err = db.View(func(tx *Tx) (err error) {
+		if out, err = tx.getBytes(bucket, key, true); out == nil && err == nil {
+			err = ErrKeyNotFound
+		}
+		return
+	})
+	return
+}
+
+// BucketKey is a key in a bucket, see GetAcrossBuckets.
+type BucketKey = struct{ Bucket, Key string }
+
+// GetAcrossBuckets returns copies of the values of reqs in order, nil for the missing ones,
+// unlike separate GetBytes calls they're all read in a single transaction so they come from the same snapshot.
+func (db *DB) GetAcrossBuckets(reqs []BucketKey) (out [][]byte, err error) {
 	err = db.View(func(tx *Tx) error {
-		out = tx.GetBytes(bucket, key, true)
+		out = make([][]byte, len(reqs))
+		for i, r := range reqs {
+			if out[i], err = tx.getBytes(r.Bucket, unsafeBytes(r.Key), true); err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	return
 }
 
+// GetBytesInto copies the value into dst[:0], growing it if needed, and returns the result,
+// it allows reusing the same buffer in tight loops to avoid allocating on every read.
+// Like GetBytes, it returns ErrKeyNotFound if the key doesn't exist.
+func (db *DB) GetBytesInto(bucket, key string, dst []byte) (out []byte, err error) {
+	k := unsafeBytes(key)
+	if db.bloomMiss(bucket, k) {
+		return dst[:0], ErrKeyNotFound
+	}
+	err = db.View(func(tx *Tx) error {
+		v, err := tx.getBytes(bucket, k, false)
+		if v == nil && err == nil {
+			err = ErrKeyNotFound
+		}
+		out = append(dst[:0], v...)
+		return err
+	})
+	return
+}
+
 func (db *DB) ForEachBytes(bucket string, fn func(k, v []byte) error) (err error) {
 	return db.View(func(tx *Tx) error {
 		return tx.ForEachBytes(bucket, fn)
 	})
 }
 
+// ForEachBytesTransform runs Tx.ForEachBytesTransform in a read transaction.
+func (db *DB) ForEachBytesTransform(bucket string, transform func(v []byte) ([]byte, error), fn func(k, v []byte) error) error {
+	return db.View(func(tx *Tx) error {
+		return tx.ForEachBytesTransform(bucket, transform, fn)
+	})
+}
+
+func (db *DB) ForEachBytesReverse(bucket string, fn func(k, v []byte) error) (err error) {
+	return db.View(func(tx *Tx) error {
+		return tx.ForEachBytesReverse(bucket, fn)
+	})
+}
+
+// KeysChan streams the keys of bucket from a read transaction that's held until they're all sent or ctx is done,
+// both channels are closed when it's over and errs receives the error of the scan if there was one (including ctx.Err()).
+func (db *DB) KeysChan(ctx context.Context, bucket string) (<-chan string, <-chan error) {
+	keys, errs := make(chan string), make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer close(keys)
+		if err := db.View(func(tx *Tx) error {
+			b, err := tx.readBucket(bucket)
+			if b == nil {
+				return err
+			}
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				select {
+				case keys <- string(k):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		}); err != nil {
+			errs <- err
+		}
+	}()
+	return keys, errs
+}
+
+// ChunkedView iterates bucket in read transactions of up to chunkSize keys, the keys and values of each chunk
+// are copied and passed to fn after its transaction is closed, so a slow fn doesn't pin the db.
+// Unlike ForEachBytes, it isn't a consistent snapshot, writes between chunks may or may not be seen.
+func (db *DB) ChunkedView(bucket string, chunkSize int, fn func(k, v []byte) error) error {
+	return db.ChunkedViewFrom(bucket, nil, chunkSize, fn)
+}
+
+// ChunkedViewFrom is ChunkedView starting at the first key >= start.
+func (db *DB) ChunkedViewFrom(bucket string, start []byte, chunkSize int, fn func(k, v []byte) error) error {
+	if chunkSize <= 0 {
+		chunkSize = DefaultBulkLoadChunkSize
+	}
+	var after []byte
+	chunk := make([][2][]byte, 0, chunkSize)
+	for {
+		chunk = chunk[:0]
+		if err := db.View(func(tx *Tx) error {
+			b, err := tx.readBucket(bucket)
+			if b == nil {
+				return err
+			}
+			c := b.Cursor()
+			k, v := c.Seek(start)
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(chunk) < chunkSize; k, v = c.Next() {
+				if v, err = tx.db.decodeValue(bucket, k, v); err != nil {
+					return err
+				}
+				chunk = append(chunk, [2][]byte{append([]byte(nil), k...), append([]byte(nil), v...)})
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, kv := range chunk {
+			if err := fn(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+		if len(chunk) < chunkSize {
+			return nil
+		}
+		after = chunk[len(chunk)-1][0]
+	}
+}
+
 func (db *DB) PutBytes(bucket, key string, val []byte) error {
+	return db.PutBytesB(bucket, unsafeBytes(key), val)
+}
+
+// PutBytesB is PutBytes with a binary key.
+func (db *DB) PutBytesB(bucket string, key, val []byte) error {
+	if err := db.checkSize(bucket, key, val); err != nil {
+		return err
+	}
 	fn := func(tx *Tx) error {
 		b, err := tx.CreateBucketIfNotExists(bucket)
 		if err != nil {
 			return err
 		}
-		return b.Put(unsafeBytes(key), val)
+		return tx.put(b, bucket, key, val)
 	}
 
 	if !db.useBatch.Load() {
@@ -80,26 +304,78 @@ func (db *DB) PutBytes(bucket, key string, val []byte) error {
 	return db.Batch(fn)
 }
 
+// GetSet atomically replaces the value of key and returns the previous one, see Tx.GetSet.
+func (db *DB) GetSet(bucket, key string, newVal []byte) (old []byte, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		old, err = tx.GetSet(bucket, key, newVal)
+		return
+	})
+	return
+}
+
 func (db *DB) Get(bucket, key string, out any) (err error) {
 	return db.GetAny(bucket, key, out, db.unmarshalFn)
 }
 
+// ForEachUpdate runs Tx.ForEachUpdate in its own transaction.
+func (db *DB) ForEachUpdate(bucket string, fn func(k, v []byte, setValue func(k, nv []byte)) error) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.ForEachUpdate(bucket, fn)
+	})
+}
+
 func (db *DB) Put(bucket, key string, val any) error {
 	return db.PutAny(bucket, key, val, db.marshalFn)
 }
 
 func (db *DB) Delete(bucket, key string) error {
+	return db.DeleteB(bucket, unsafeBytes(key))
+}
+
+// DeleteB is Delete with a binary key.
+func (db *DB) DeleteB(bucket string, key []byte) error {
 	return db.Update(func(tx *Tx) error {
-		return tx.Delete(bucket, key)
+		return tx.DeleteB(bucket, key)
 	})
 }
 
+// GetAny returns ErrKeyNotFound for a missing key, if bucket has a bloom filter (see EnableBloom)
+// it's used to skip the read tx for keys it rules out.
 func (db *DB) GetAny(bucket, key string, out any, unmarshalFn UnmarshalFn) error {
+	if db.bloomMiss(bucket, unsafeBytes(key)) {
+		return ErrKeyNotFound
+	}
 	return db.View(func(tx *Tx) error {
 		return tx.GetAny(bucket, key, out, unmarshalFn)
 	})
 }
 
+// CountKeys runs Tx.CountKeys in a read transaction.
+func (db *DB) CountKeys(bucket string) (n int, err error) {
+	err = db.View(func(tx *Tx) (err error) {
+		n, err = tx.CountKeys(bucket)
+		return
+	})
+	return
+}
+
+func (db *DB) CountPrefix(bucket string, prefix []byte) (n int, err error) {
+	err = db.View(func(tx *Tx) error {
+		n, err = tx.CountPrefix(bucket, prefix)
+		return err
+	})
+	return
+}
+
+// DeleteWhere runs Tx.DeleteWhere in a single write transaction.
+func (db *DB) DeleteWhere(bucket string, pred func(k, v []byte) bool) (n int, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		n, err = tx.DeleteWhere(bucket, pred)
+		return
+	})
+	return
+}
+
 func (db *DB) Buckets() (out []string) {
 	db.View(func(tx *Tx) error {
 		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
@@ -111,23 +387,77 @@ func (db *DB) Buckets() (out []string) {
 	return
 }
 
+// WalkBucketsParallel calls fn for every top level bucket from up to workers goroutines (GOMAXPROCS if workers <= 0),
+// fn should do its own reads (View, ForEachBytes, etc), read transactions don't block each other so they run concurrently.
+// The first error stops dispatching the remaining buckets and is returned once the running calls are done.
+func (db *DB) WalkBucketsParallel(workers int, fn func(bucket string) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		ch      = make(chan string)
+		stop    = make(chan struct{})
+		errOnce sync.Once
+		err     error
+		wg      sync.WaitGroup
+	)
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for bkt := range ch {
+				select {
+				case <-stop: // the dispatcher can still win the race against stop once
+					continue
+				default:
+				}
+				if ferr := fn(bkt); ferr != nil {
+					errOnce.Do(func() {
+						err = ferr
+						close(stop)
+					})
+				}
+			}
+		}()
+	}
+
+dispatch:
+	for _, bkt := range db.Buckets() {
+		select {
+		case ch <- bkt:
+		case <-stop:
+			break dispatch
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return err
+}
+
 func (db *DB) PutAny(bucket, key string, val any, marshalFn MarshalFn) error {
-	// duplicated code from tx.PutAny to keep the marshaling outside of the locks
+	b, err := db.marshalAny(val, marshalFn)
+	if err != nil {
+		return err
+	}
+	return db.PutBytes(bucket, key, b)
+}
+
+// marshalAny is the marshaling part of tx.PutAny, so it can happen outside of the locks.
+func (db *DB) marshalAny(val any, marshalFn MarshalFn) ([]byte, error) {
+	if s, ok := val.(string); ok && db.rawStrings {
+		return unsafeBytes(s), nil
+	}
 
 	switch val := val.(type) {
 	case []byte:
-		return db.PutBytes(bucket, key, val)
-	// case string:
-	// 	return db.PutBytes(bucket, key, unsafeBytes(val))
+		return val, nil
 	default:
 		if marshalFn == nil {
 			marshalFn = DefaultMarshalFn
 		}
-		b, err := marshalFn(val)
-		if err != nil {
-			return err
-		}
-		return db.PutBytes(bucket, key, b)
+		return marshalFn(val)
 	}
 }
 
@@ -141,6 +471,24 @@ func (db *DB) SetNextIndex(bucket string, seq uint64) error {
 	})
 }
 
+// SetNextIndexIfHigher runs Tx.SetNextIndexIfHigher in its own transaction.
+func (db *DB) SetNextIndexIfHigher(bucket string, seq uint64) (set bool, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		set, err = tx.SetNextIndexIfHigher(bucket, seq)
+		return
+	})
+	return
+}
+
+// SetNextIndexIfLower runs Tx.SetNextIndexIfLower in its own transaction.
+func (db *DB) SetNextIndexIfLower(bucket string, seq uint64) (set bool, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		set, err = tx.SetNextIndexIfLower(bucket, seq)
+		return
+	})
+	return
+}
+
 func (db *DB) NextIndex(bucket string) (idx uint64, err error) {
 	err = db.Update(func(tx *Tx) error {
 		var b *Bucket
@@ -164,30 +512,193 @@ func (db *DB) CurrentIndex(bucket string) (idx uint64) {
 }
 
 func (db *DB) View(fn func(*Tx) error) error {
-	return db.b.View(db.getTxFn(fn))
+	h, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer db.release(h)
+	return h.View(db.getTxFn(fn, nil))
+}
+
+// ViewTimeout is like View but returns ErrViewTimeout if the read transaction can't be started within d,
+// if the tx starts after that it's rolled back in the background.
+func (db *DB) ViewTimeout(d time.Duration, fn func(*Tx) error) (err error) {
+	type txErr struct {
+		tx  *Tx
+		err error
+	}
+	var claimed genh.AtomicBool
+	ch := make(chan txErr, 1)
+	go func() {
+		tx, err := db.Begin(false)
+		if !claimed.CompareAndSwap(false, true) {
+			if tx != nil {
+				tx.Rollback()
+			}
+			return
+		}
+		ch <- txErr{tx, err}
+	}()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	var r txErr
+	select {
+	case r = <-ch:
+	case <-t.C:
+		if claimed.CompareAndSwap(false, true) {
+			return oerrs.Errorf("%w (%v)", ErrViewTimeout, d)
+		}
+		// the tx started right as we timed out
+		r = <-ch
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	defer r.tx.Rollback()
+	if db.recoverPanics {
+		defer recoverTxPanic(&err)
+	}
+	return fn(r.tx)
 }
 
 func (db *DB) Update(fn func(*Tx) error) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.trackCallers {
+		defer db.trackCaller(time.Now())
+	}
+	h, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer db.release(h)
 	if db.slow != nil {
-		return db.updateSlow(fn, db.slow, false)
+		return db.updateSlow(h, fn, db.slow, false)
 	}
 
-	return db.b.Update(db.getTxFn(fn))
+	return db.update(h, fn, false)
+}
+
+// UpdateDurable is Update followed by an fsync of the db file, even if NoSync is set,
+// it allows mixing fast NoSync writes with the occasional critical one.
+func (db *DB) UpdateDurable(fn func(*Tx) error) error {
+	if err := db.Update(fn); err != nil {
+		return err
+	}
+	h, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer db.release(h)
+	return h.Sync()
 }
 
 func (db *DB) Batch(fn func(*Tx) error) error {
+	if db.readOnly.Load() {
+		return ErrReadOnly
+	}
+	if db.trackCallers {
+		defer db.trackCaller(time.Now())
+	}
+	h, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer db.release(h)
 	if db.slow != nil {
-		return db.updateSlow(fn, db.slow, true)
+		return db.updateSlow(h, fn, db.slow, true)
+	}
+	return db.update(h, fn, true)
+}
+
+// BatchIsolated is like Batch, but if fn fails before writing anything, its error is only returned to the caller
+// and the batch is committed without it, instead of being rolled back and retried without fn (which then runs again
+// on its own). If fn fails after writing anything through Tx (puts, deletes, sequences, expiries, creating or deleting
+// buckets), it behaves like Batch since its writes have to be rolled back.
+// Writes done directly through the embedded bbolt tx, or on a *Bucket returned by Tx, aren't tracked.
+func (db *DB) BatchIsolated(fn func(*Tx) error) error {
+	var ferr error
+	if err := db.Batch(func(tx *Tx) error {
+		if ferr = fn(tx); ferr != nil && tx.writes == 0 {
+			return nil
+		}
+		return ferr
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// SetReadOnly makes every write (Update, Batch, Begin(true) and everything built on them) fail with ErrReadOnly
+// until it's called again with false, reads aren't affected.
+// It doesn't wait for writes that already started, and unlike Options.ReadOnly the file stays open for writing.
+func (db *DB) SetReadOnly(v bool) {
+	db.readOnly.Store(v)
+}
+
+// IsReadOnly returns the value set by SetReadOnly.
+func (db *DB) IsReadOnly() bool {
+	return db.readOnly.Load()
+}
+
+// BatchBarrier returns once every Batch call started before it has been committed.
+func (db *DB) BatchBarrier() error {
+	h, err := db.acquire()
+	if err != nil {
+		return err
+	}
+	defer db.release(h)
+	return h.Batch(func(*BBoltTx) error { return nil })
+}
+
+// BatchStats returns the number of Batch calls that were committed, the number of transactions they were committed in,
+// and the average number of calls per transaction, failed calls and rolled back attempts aren't counted.
+func (db *DB) BatchStats() (calls, flushes, avgBatchSize int64) {
+	calls, flushes = db.batchCalls.Load(), db.batchFlushes.Load()
+	if flushes > 0 {
+		avgBatchSize = calls / flushes
 	}
-	return db.b.Batch(db.getTxFn(fn))
+	return
 }
 
+// Begin starts a transaction that must be closed with Tx.Commit or Tx.Rollback, see OpenTxCount.
+// Closing it through the embedded bbolt tx leaks it, Close then waits for it forever.
 func (db *DB) Begin(writable bool) (*Tx, error) {
-	tx, err := db.b.Begin(writable)
+	if writable && db.readOnly.Load() {
+		return nil, ErrReadOnly
+	}
+	h, err := db.acquire()
 	if err != nil {
 		return nil, err
 	}
-	return &Tx{tx, db}, nil
+	tx, err := h.Begin(writable)
+	if err != nil {
+		db.release(h)
+		return nil, err
+	}
+	db.openTxs(writable).Add(1)
+	t := &Tx{BBoltTx: tx, db: db, h: h, tracked: true}
+	if writable {
+		t.tickets = new([]*replTicket)
+	}
+	return t, nil
+}
+
+// OpenTxCount returns the number of transactions started with Begin that haven't been committed or rolled back yet,
+// a read count that keeps growing usually means a leaked tx that keeps the file from reusing its free pages.
+func (db *DB) OpenTxCount() (read, write int) {
+	return int(db.openReads.Load()), int(db.openWrites.Load())
+}
+
+func (db *DB) openTxs(writable bool) *genh.AtomicInt64 {
+	if writable {
+		return &db.openWrites
+	}
+	return &db.openReads
 }
 
 func (db *DB) CreateBucket(bucket string) error {
@@ -197,6 +708,33 @@ func (db *DB) CreateBucket(bucket string) error {
 	})
 }
 
+// CreateBuckets creates every missing bucket of names in a single transaction.
+func (db *DB) CreateBuckets(names ...string) error {
+	_, err := db.EnsureBuckets(names...)
+	return err
+}
+
+// EnsureBuckets is like CreateBuckets but returns the names of the buckets that didn't exist, in the order of names.
+func (db *DB) EnsureBuckets(names ...string) (created []string, err error) {
+	err = db.Update(func(tx *Tx) error {
+		created = created[:0]
+		for _, name := range names {
+			if tx.Bucket(name) != nil {
+				continue
+			}
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+			created = append(created, name)
+		}
+		return nil
+	})
+	if err != nil {
+		created = nil
+	}
+	return
+}
+
 func (db *DB) CreateBucketWithIndex(bucket string, idx uint64) error {
 	return db.Update(func(tx *Tx) error {
 		b, err := tx.CreateBucketIfNotExists(bucket)
@@ -207,6 +745,67 @@ func (db *DB) CreateBucketWithIndex(bucket string, idx uint64) error {
 	})
 }
 
+// Truncate deletes every bucket, and with them all the data and sequences, in a single transaction.
+// The file isn't shrunk, the freed pages are reused by later writes.
+func (db *DB) Truncate() error {
+	return db.Update(func(tx *Tx) error {
+		var names [][]byte
+		if err := tx.ForEach(func(name []byte, _ *Bucket) error {
+			names = append(names, append([]byte(nil), name...))
+			return nil
+		}); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err := tx.DeleteBucket(string(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteBucket deletes bucket along with its insertion order and expiries, ErrBucketNotFound if it doesn't exist.
+func (db *DB) DeleteBucket(bucket string) error {
+	return db.Update(func(tx *Tx) error {
+		if err := tx.DeleteBucket(bucket); err != nil {
+			return err
+		}
+		for _, sfx := range [...]string{orderBucketSuffix, expiryBucketSuffix} {
+			if err := tx.DeleteBucket(bucket + sfx); err != nil && err != ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// TruncateBucket empties bucket by deleting and recreating it, if keepSequence is false its sequence is reset to 0.
+func (db *DB) TruncateBucket(bucket string, keepSequence bool) error {
+	return db.Update(func(tx *Tx) error {
+		var seq uint64
+		if b := tx.Bucket(bucket); b != nil {
+			seq = b.Sequence()
+			if err := tx.DeleteBucket(bucket); err != nil {
+				return err
+			}
+		}
+		if db.orderBuckets[bucket] {
+			if err := tx.DeleteBucket(bucket + orderBucketSuffix); err != nil && err != ErrBucketNotFound {
+				return err
+			}
+		}
+		if err := tx.DeleteBucket(bucket + expiryBucketSuffix); err != nil && err != ErrBucketNotFound {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil || !keepSequence {
+			return err
+		}
+		return b.SetSequence(seq)
+	})
+}
+
 func (db *DB) CreateBucketWithIndexBig(bucket string, idx *big.Int) error {
 	if idx == nil {
 		db.CreateBucketWithIndex(bucket, 0)
@@ -230,41 +829,131 @@ func (db *DB) BackupToFile(fp string) (n int64, err error) {
 }
 
 func (db *DB) Backup(w io.Writer) (n int64, err error) {
-	db.b.View(func(tx *BBoltTx) error {
+	h, err := db.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer db.release(h)
+	h.View(func(tx *BBoltTx) error {
 		n, err = tx.WriteTo(w)
 		return err
 	})
 	return
 }
 
-func (db *DB) Path() string  { return db.b.Path() }
-func (db *DB) Raw() *BBoltDB { return db.b }
+func (db *DB) Path() string { return db.path }
+
+// Raw returns the underlying bbolt db, it's replaced by CompactInPlace and by OpenFollower when the file changes,
+// so it shouldn't be kept around.
+func (db *DB) Raw() *BBoltDB {
+	if db.rlock() {
+		defer db.compactMux.RUnlock()
+	}
+	return db.h.Load().BBoltDB
+}
 
+// Close closes the db, calling it more than once is a no-op.
 func (db *DB) Close() error {
-	if db.onClose != nil {
+	return db.close(true)
+}
+
+// close is Close without calling onClose unless runOnClose is set,
+// for MultiDB which already holds its lock when it closes its dbs.
+// It waits for open transactions, nested ones started in the meantime fail instead of deadlocking, see rlock.
+func (db *DB) close(runOnClose bool) error {
+	if db.closed.Swap(true) {
+		return nil
+	}
+	if runOnClose && db.onClose != nil {
 		db.onClose()
 	}
-	return db.b.Close()
+	defer db.closeRepl()
+	db.compactMux.Lock()
+	defer db.compactMux.Unlock()
+	h := db.h.Load()
+	// with every transaction done only the db's own reference is left
+	n := h.refs.Load()
+	if err := h.Close(); err != nil {
+		return err
+	}
+	if n != 1 {
+		return oerrs.Errorf("mbbolt: %s: closed with %d references to the file, expected 1", db.path, n)
+	}
+	return nil
+}
+
+// boltHandle is an open bbolt db, when OpenFollower reopens the file the old one is closed
+// once the transactions using it are done.
+type boltHandle struct {
+	*BBoltDB
+	refs atomic.Int64 // open transactions, plus one while it's the db's current handle
+}
+
+func newBoltHandle(bdb *BBoltDB) *boltHandle {
+	h := &boltHandle{BBoltDB: bdb}
+	h.refs.Store(1)
+	return h
+}
+
+// unref drops a reference to h and closes it if it was the last one.
+func (h *boltHandle) unref() error {
+	if h.refs.Add(-1) == 0 {
+		return h.Close()
+	}
+	return nil
+}
+
+// rlock read locks compactMux unless Close is waiting for it, a transaction that starts a nested one already
+// holds a read lock and would deadlock with Close if it blocked behind it.
+// Only Close blocks on the write lock, and it sets closed before that.
+func (db *DB) rlock() bool {
+	if db.compactMux.TryRLock() {
+		return true
+	}
+	if db.closed.Load() {
+		return false
+	}
+	db.compactMux.RLock()
+	return true
+}
+
+// acquire read locks compactMux and returns the current bbolt db for a transaction, it stays open until release
+// even if it's replaced in the meantime. It returns bbolt.ErrDatabaseNotOpen if the db is closing.
+func (db *DB) acquire() (*boltHandle, error) {
+	if !db.rlock() {
+		return nil, bbolt.ErrDatabaseNotOpen
+	}
+	for !db.closed.Load() {
+		// a replaced handle can drop to 0 between the two loads, the next Load returns its replacement
+		h := db.h.Load()
+		if n := h.refs.Load(); n > 0 && h.refs.CompareAndSwap(n, n+1) {
+			return h, nil
+		}
+	}
+	db.compactMux.RUnlock()
+	return nil, bbolt.ErrDatabaseNotOpen
+}
+
+func (db *DB) release(h *boltHandle) {
+	if err := h.unref(); err != nil {
+		log.Printf("mbbolt: %s: closing the replaced file: %v", db.path, err)
+	}
+	db.compactMux.RUnlock()
 }
 
 func (db *DB) UseBatch(v bool) (old bool) {
 	return db.useBatch.Swap(v)
 }
 
-func (db *DB) updateSlow(fn func(*Tx) error, su *slowUpdate, batch bool) (err error) {
-	var pcs [6]uintptr
-
-	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs[:])])
+func (db *DB) updateSlow(h *boltHandle, fn func(*Tx) error, su *slowUpdate, batch bool) (err error) {
+	pcs, n := callerPCs(2)
+	frames := runtime.CallersFrames(pcs[:n])
 	start := time.Now()
 
 	su.Lock()
 	defer su.Unlock()
 
-	if batch {
-		err = db.b.Batch(db.getTxFn(fn))
-	} else {
-		err = db.b.Update(db.getTxFn(fn))
-	}
+	err = db.update(h, fn, batch)
 	if took := time.Since(start); took >= su.min {
 		su.fn(frames, took)
 	}
@@ -272,8 +961,59 @@ func (db *DB) updateSlow(fn func(*Tx) error, su *slowUpdate, batch bool) (err er
 	return
 }
 
-func (db *DB) getTxFn(fn func(*Tx) error) func(tx *BBoltTx) error {
-	return func(tx *BBoltTx) error {
-		return fn(&Tx{tx, db})
+// update runs fn with bbolt's Update or Batch, then drops the publish tickets of the txs it ran in that didn't commit.
+func (db *DB) update(h *boltHandle, fn func(*Tx) error, batch bool) error {
+	var tickets []*replTicket
+	defer func() { db.dropTickets(tickets) }()
+	if batch {
+		return h.Batch(db.getBatchTxFn(fn, &tickets))
+	}
+	return h.Update(db.getTxFn(fn, &tickets))
+}
+
+// getBatchTxFn counts the call and the tx it ran in once that tx commits,
+// bbolt may retry fn in a new tx if another call in the same batch fails, so only the attempt that commits counts.
+// Every call registers its own hook, committed ids only go up so only the first hook of each tx counts it.
+func (db *DB) getBatchTxFn(fn func(*Tx) error, tickets *[]*replTicket) func(tx *BBoltTx) error {
+	return func(tx *BBoltTx) (err error) {
+		if db.recoverPanics {
+			defer recoverTxPanic(&err)
+		}
+		id := int64(tx.ID())
+		tx.OnCommit(func() {
+			db.batchCalls.Add(1)
+			for last := db.batchTxID.Load(); id > last; last = db.batchTxID.Load() {
+				if db.batchTxID.CompareAndSwap(last, id) {
+					db.batchFlushes.Add(1)
+					break
+				}
+			}
+		})
+		return fn(&Tx{BBoltTx: tx, db: db, tickets: tickets})
+	}
+}
+
+func (db *DB) getTxFn(fn func(*Tx) error, tickets *[]*replTicket) func(tx *BBoltTx) error {
+	return func(tx *BBoltTx) (err error) {
+		if db.recoverPanics {
+			defer recoverTxPanic(&err)
+		}
+		return fn(&Tx{BBoltTx: tx, db: db, tickets: tickets})
+	}
+}
+
+// PanicError is returned by View / Update / Batch when their callback panics and Options.RecoverPanics is set.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("mbbolt: panic in transaction: %v\n%s", e.Value, e.Stack)
+}
+
+func recoverTxPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = &PanicError{Value: r, Stack: debug.Stack()}
 	}
 }
@@ -1,13 +1,27 @@
 package mbbolt
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
 	"reflect"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
 	"time"
+
+	"github.com/alpineiq/genh"
+	"github.com/alpineiq/oerrs"
+	"go.etcd.io/bbolt"
 )
 
 func init() {
@@ -173,3 +187,2529 @@ func slowTest2(db *DB) {
 		return nil
 	})
 }
+
+func TestTxGetMulti(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.PutBytes("b", "a", []byte("1")))
+	dieIf(t, db.PutBytes("b", "c", []byte("3")))
+	// large enough to keep the bucket from being inlined
+	dieIf(t, db.PutBytes("b", "d", make([]byte, 4096)))
+
+	dieIf(t, db.View(func(tx *Tx) error {
+		keys := []string{"c", "b", "a"}
+		for _, clone := range []bool{true, false} {
+			vals := tx.GetMulti("b", keys, clone)
+			if len(vals) != 3 || string(vals[0]) != "3" || vals[1] != nil || string(vals[2]) != "1" {
+				t.Fatalf("clone=%v: unexpected values: %q", clone, vals)
+			}
+			if shared := &vals[0][0] == &tx.Bucket("b").Get([]byte("c"))[0]; shared == clone {
+				t.Fatalf("clone=%v: shared=%v", clone, shared)
+			}
+		}
+		if vals := tx.GetMulti("missing", keys, true); len(vals) != 3 || vals[0] != nil {
+			t.Fatalf("unexpected values: %q", vals)
+		}
+		return nil
+	}))
+}
+
+func TestGetBytesInto(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.PutBytes("b", "k", []byte("value")))
+
+	small := make([]byte, 0, 2)
+	out, err := db.GetBytesInto("b", "k", small)
+	dieIf(t, err)
+	if string(out) != "value" {
+		t.Fatalf("unexpected value: %q", out)
+	}
+
+	big := make([]byte, 3, 64)
+	out, err = db.GetBytesInto("b", "k", big)
+	dieIf(t, err)
+	if string(out) != "value" || &out[0] != &big[:1][0] {
+		t.Fatalf("buffer wasn't reused: %q", out)
+	}
+
+	if out, err = db.GetBytesInto("b", "missing", big); err != ErrKeyNotFound || len(out) != 0 {
+		t.Fatalf("expected ErrKeyNotFound, got %q %v", out, err)
+	}
+	if out, err = db.GetBytesInto("missing", "k", big); err != ErrKeyNotFound || len(out) != 0 {
+		t.Fatalf("expected ErrKeyNotFound, got %q %v", out, err)
+	}
+
+	dieIf(t, db.PutBytes("b", "empty", nil))
+	if out, err = db.GetBytesInto("b", "empty", big); err != nil || len(out) != 0 {
+		t.Fatalf("unexpected value: %q %v", out, err)
+	}
+}
+
+func TestBinaryKeys(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	key := []byte{0, 1, 0xff, 'k'}
+	dieIf(t, db.PutBytesB("b", key, []byte("v1")))
+	if v, err := db.GetBytes("b", string(key)); err != nil || string(v) != "v1" {
+		t.Fatalf("unexpected value: %q %v", v, err)
+	}
+
+	dieIf(t, db.PutBytes("b", string(key), []byte("v2")))
+	if v, err := db.GetBytesB("b", key); err != nil || string(v) != "v2" {
+		t.Fatalf("unexpected value: %q %v", v, err)
+	}
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		if v := tx.GetBytesB("b", key, false); string(v) != "v2" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		dieIf(t, tx.PutBytesB("b", key, []byte("v3")))
+		if v := tx.GetBytes("b", string(key), false); string(v) != "v3" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return tx.DeleteB("b", key)
+	}))
+
+	if v, err := db.GetBytesB("b", key); err != ErrKeyNotFound || v != nil {
+		t.Fatalf("unexpected value: %q %v", v, err)
+	}
+	dieIf(t, db.PutBytesB("b", key, []byte("v4")))
+	dieIf(t, db.DeleteB("b", key))
+	if v, err := db.GetBytes("b", string(key)); err != ErrKeyNotFound || v != nil {
+		t.Fatalf("unexpected value: %q %v", v, err)
+	}
+}
+
+func TestRangeScan(t *testing.T) {
+	db, err := OpenTDB[int](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for _, k := range []string{"a1", "a2", "a3", "b1", "b2", "c1"} {
+		dieIf(t, db.Put("b", k, int(k[1]-'0')))
+	}
+
+	keys := func(kvs []KV[int]) (out string) {
+		for _, kv := range kvs {
+			out += kv.Key + ","
+		}
+		return
+	}
+
+	for _, tc := range []struct {
+		opts RangeOptions
+		keys string
+		next string
+	}{
+		{RangeOptions{}, "a1,a2,a3,b1,b2,c1,", ""},
+		{RangeOptions{Reverse: true}, "c1,b2,b1,a3,a2,a1,", ""},
+		{RangeOptions{Start: []byte("a2"), End: []byte("b2")}, "a2,a3,b1,", ""},
+		{RangeOptions{Start: []byte("b2"), End: []byte("a2"), Reverse: true}, "b2,b1,a3,", ""},
+		{RangeOptions{Start: []byte("b0"), Reverse: true}, "a3,a2,a1,", ""},
+		{RangeOptions{Prefix: []byte("a")}, "a1,a2,a3,", ""},
+		{RangeOptions{Prefix: []byte("b"), Reverse: true}, "b2,b1,", ""},
+		{RangeOptions{Prefix: []byte("a"), Limit: 2}, "a1,a2,", "a3"},
+		{RangeOptions{Prefix: []byte("a"), Start: []byte("a3"), Limit: 2}, "a3,", ""},
+		{RangeOptions{Prefix: []byte("a"), Reverse: true, Limit: 2}, "a3,a2,", "a1"},
+		{RangeOptions{Prefix: []byte("a"), Start: []byte("a1"), Reverse: true, Limit: 2}, "a1,", ""},
+		{RangeOptions{Prefix: []byte("b"), Start: []byte("z"), Reverse: true}, "b2,b1,", ""},
+		{RangeOptions{Reverse: true, Limit: 4}, "c1,b2,b1,a3,", "a2"},
+		{RangeOptions{Limit: 6}, "a1,a2,a3,b1,b2,c1,", ""},
+		{RangeOptions{Prefix: []byte("d")}, "", ""},
+	} {
+		kvs, next, err := db.RangeScan("b", tc.opts)
+		dieIf(t, err)
+		if got := keys(kvs); got != tc.keys || string(next) != tc.next {
+			t.Fatalf("%+v: expected %q (next %q), got %q (next %q)", tc.opts, tc.keys, tc.next, got, next)
+		}
+		for _, kv := range kvs {
+			if kv.Value != int(kv.Key[1]-'0') {
+				t.Fatalf("unexpected value: %+v", kv)
+			}
+		}
+	}
+
+	if _, _, err := db.RangeScan("missing", RangeOptions{}); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.VerifyChecksums = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Put("b", "k", &S{X: 42, Y: "answer"}))
+	var s S
+	dieIf(t, db.Get("b", "k", &s))
+	if s.X != 42 || s.Y != "answer" {
+		t.Fatalf("unexpected value: %+v", s)
+	}
+
+	// values written without checksums are still readable
+	dieIf(t, db.Raw().Update(func(tx *BBoltTx) error {
+		return tx.Bucket([]byte("b")).Put([]byte("legacy"), []byte(`{"X":1}`))
+	}))
+	dieIf(t, db.Get("b", "legacy", &s))
+	if s.X != 1 {
+		t.Fatalf("unexpected value: %+v", s)
+	}
+
+	// flip a byte in the stored data
+	dieIf(t, db.Raw().Update(func(tx *BBoltTx) error {
+		b := tx.Bucket([]byte("b"))
+		v := append([]byte(nil), b.Get([]byte("k"))...)
+		v[len(v)-2] ^= 0xff
+		return b.Put([]byte("k"), v)
+	}))
+
+	var cerr *ChecksumError
+	if err := db.Get("b", "k", &s); !errors.As(err, &cerr) || cerr.Key != "k" {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if _, err := db.GetBytes("b", "k"); !errors.As(err, &cerr) {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if err := db.ForEachBytes("b", func(k, v []byte) error { return nil }); !errors.As(err, &cerr) {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	dieIf(t, db.View(func(tx *Tx) error {
+		if v, err := tx.GetBytesErr("b", "k", false); v != nil || !errors.As(err, &cerr) {
+			t.Fatalf("expected a checksum error, got %q %v", v, err)
+		}
+		if v, err := tx.GetBytesErr("b", "missing", false); v != nil || err != nil {
+			t.Fatalf("expected nil, got %q %v", v, err)
+		}
+		out, errs := tx.GetMultiErr("b", []string{"legacy", "k", "missing"}, false)
+		if out[0] == nil || out[1] != nil || out[2] != nil || len(errs) != 3 || errs[0] != nil || !errors.As(errs[1], &cerr) || errs[2] != nil {
+			t.Fatalf("unexpected result: %q %v", out, errs)
+		}
+		return nil
+	}))
+}
+
+func TestBatchStats(t *testing.T) {
+	const N = 100
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dieIf(t, db.Batch(func(tx *Tx) error {
+				return tx.PutBytes("b", strconv.Itoa(i), nil)
+			}))
+		}(i)
+	}
+	wg.Wait()
+
+	calls, flushes, avg := db.BatchStats()
+	t.Logf("calls: %d, flushes: %d, avg: %d", calls, flushes, avg)
+	if calls != N || flushes < 1 || flushes >= N || avg < 2 {
+		t.Fatalf("batch calls weren't coalesced: %d %d %d", calls, flushes, avg)
+	}
+
+	// a failed call is retried on its own, neither attempt commits
+	if err := db.Batch(func(tx *Tx) error { return errors.New("fail") }); err == nil {
+		t.Fatal("expected an error")
+	}
+	if c, f, _ := db.BatchStats(); c != calls || f != flushes {
+		t.Fatalf("rolled back attempts were counted: %d %d", c-calls, f-flushes)
+	}
+
+	dieIf(t, db.Batch(func(tx *Tx) error { return tx.PutBytes("b", "x", nil) }))
+	if c, f, _ := db.BatchStats(); c != calls+1 || f != flushes+1 {
+		t.Fatalf("expected one more call and flush: %d %d", c-calls, f-flushes)
+	}
+}
+
+func TestBatchIsolated(t *testing.T) {
+	const N = 50
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	const errBad = oerrs.String("bad")
+	var badCalls genh.AtomicInt64
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.BatchIsolated(func(tx *Tx) error {
+				if i == N/2 {
+					badCalls.Add(1)
+					return errBad
+				}
+				return tx.PutBytes("b", strconv.Itoa(i), []byte("v"))
+			})
+			if i == N/2 && err != errBad {
+				t.Errorf("expected errBad, got %v", err)
+			} else if i != N/2 && err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := badCalls.Load(); n != 1 {
+		t.Fatalf("the failing call ran %d times", n)
+	}
+	if n, _ := db.CountPrefix("b", nil); n != N-1 {
+		t.Fatalf("expected %d keys, got %d", N-1, n)
+	}
+}
+
+func TestBatchIsolatedSequence(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	// bumping a sequence is a write, so it must be rolled back like a put would
+	const errBad = oerrs.String("bad")
+	err = db.BatchIsolated(func(tx *Tx) error {
+		if _, err := tx.NextIndex("seq"); err != nil {
+			return err
+		}
+		return errBad
+	})
+	if err != errBad {
+		t.Fatalf("expected errBad, got %v", err)
+	}
+	if idx := db.CurrentIndex("seq"); idx != 0 {
+		t.Fatalf("the failed call's sequence was committed: %d", idx)
+	}
+	if bkts := db.Buckets(); len(bkts) != 0 {
+		t.Fatalf("the failed call's bucket was committed: %v", bkts)
+	}
+}
+
+func TestTypedTxCache(t *testing.T) {
+	db, err := OpenTDB[*S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	var unmarshals int
+	db.SetMarshaler(DefaultMarshalFn, func(b []byte, v any) error {
+		unmarshals++
+		return DefaultUnmarshalFn(b, v)
+	})
+	dieIf(t, db.Put("b", "k", &S{X: 1}))
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		ttx := TypedTx[*S]{tx}.WithCache()
+		v1, err := ttx.Get("b", "k")
+		dieIf(t, err)
+		v1.X = 100 // must not affect the cached value
+		v2, err := ttx.Get("b", "k")
+		dieIf(t, err)
+		if unmarshals != 1 || v2.X != 1 {
+			t.Fatalf("expected 1 unmarshal and X=1, got %d and %+v", unmarshals, v2)
+		}
+
+		dieIf(t, ttx.Put("b", "k", &S{X: 2}))
+		if v, err := ttx.Get("b", "k"); err != nil || v.X != 2 {
+			t.Fatalf("expected the new value, got %+v (%v)", v, err)
+		}
+		dieIf(t, ttx.Delete("b", "k"))
+		if _, err := ttx.Get("b", "k"); err == nil {
+			t.Fatal("expected an error for a deleted key")
+		}
+		return nil
+	}))
+}
+
+func TestCacheClose(t *testing.T) {
+	const N = 100
+	fp := t.TempDir() + "/x.db"
+	db, err := Open(fp, nil)
+	dieIf(t, err)
+
+	c := CacheOf[int](db, "ints", false)
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dieIf(t, c.Put(strconv.Itoa(i), i))
+		}(i)
+	}
+	wg.Wait()
+	dieIf(t, c.Close())
+	dieIf(t, c.Close())
+	if err := c.Put("x", 1); err != ErrCacheClosed {
+		t.Fatalf("expected ErrCacheClosed, got %v", err)
+	}
+	dieIf(t, db.Close())
+
+	db, err = Open(fp, nil)
+	dieIf(t, err)
+	defer db.Close()
+	for i := 0; i < N; i++ {
+		var v int
+		if err := db.Get("ints", strconv.Itoa(i), &v); err != nil || v != i {
+			t.Fatalf("%d: %v %v", i, v, err)
+		}
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	const N, max = 100, 10
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if err := tx.PutValue("ints", strconv.Itoa(i), i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	c := CacheOfLRU[int](db, "ints", max)
+	get := func(i int) {
+		t.Helper()
+		if v, err := c.Get(strconv.Itoa(i)); err != nil || v != i {
+			t.Fatalf("%d: %v %v", i, v, err)
+		}
+	}
+	stats := func(hits, misses int64) {
+		t.Helper()
+		if h, m := c.Stats(); h != hits || m != misses {
+			t.Fatalf("expected %d hits / %d misses, got %d / %d", hits, misses, h, m)
+		}
+	}
+
+	for i := 0; i < max; i++ {
+		get(i)
+	}
+	stats(0, max)
+	for i := max - 1; i >= 0; i-- {
+		get(i)
+	}
+	stats(max, max)
+
+	// 0 is the most recently used one, 9 the least
+	get(max)
+	if n := c.lru.len(); n != max {
+		t.Fatalf("expected %d entries, got %d", max, n)
+	}
+	get(0)
+	stats(max+1, max+1)
+	get(max - 1)
+	stats(max+1, max+2)
+
+	dieIf(t, c.Put("5", 5))
+	get(5)
+	stats(max+2, max+2)
+	dieIf(t, c.Delete("5"))
+	if _, ok := c.lru.get("5"); ok {
+		t.Fatal("deleted key is still cached")
+	}
+
+	n := 0
+	dieIf(t, c.ForEach(func(k string, v int) error {
+		n++
+		return nil
+	}))
+	if n != N-1 {
+		t.Fatalf("expected %d keys, got %d", N-1, n)
+	}
+	if n := c.lru.len(); n > max {
+		t.Fatalf("expected at most %d entries, got %d", max, n)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	const ttl = 200 * time.Millisecond
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for name, c := range map[string]*Cache[int]{
+		"map": CacheOf[int](db, "map", false),
+		"lru": CacheOfLRU[int](db, "lru", 10),
+	} {
+		t.Run(name, func(t *testing.T) {
+			get := func(exp int, hits, misses int64) {
+				t.Helper()
+				if v, err := c.Get("a"); err != nil || v != exp {
+					t.Fatalf("expected %d, got %v %v", exp, v, err)
+				}
+				if h, m := c.Stats(); h != hits || m != misses {
+					t.Fatalf("expected %d hits / %d misses, got %d / %d", hits, misses, h, m)
+				}
+			}
+			dieIf(t, db.Put(name, "a", 1))
+			c.SetTTL(ttl)
+			get(1, 0, 1)
+			dieIf(t, db.Put(name, "a", 2)) // behind the cache's back
+			get(1, 1, 1)
+
+			time.Sleep(ttl + ttl/2)
+			get(2, 1, 2)
+
+			// writes reset the timestamp
+			time.Sleep(ttl / 2)
+			dieIf(t, c.Put("a", 3))
+			time.Sleep(ttl / 2)
+			get(3, 2, 2)
+
+			// 0 never expires
+			c.SetTTL(0)
+			time.Sleep(ttl + ttl/2)
+			get(3, 3, 2)
+		})
+	}
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for name, newCache := range map[string]func() *Cache[int]{
+		"map": func() *Cache[int] { return CacheOf[int](db, "map", true) },
+		"lru": func() *Cache[int] { return CacheOfLRU[int](db, "lru", 10) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			dieIf(t, db.Put(name, "a", 1))
+			dieIf(t, db.Put(name, "b", 1))
+			c := newCache()
+			sum := func() (n int) {
+				dieIf(t, c.ForEach(func(k string, v int) error {
+					n += v
+					return nil
+				}))
+				return
+			}
+			get := func(key string, exp int) {
+				t.Helper()
+				if v, err := c.Get(key); err != nil || v != exp {
+					t.Fatalf("%s: expected %d, got %v %v", key, exp, v, err)
+				}
+			}
+			get("a", 1)
+			get("b", 1)
+			sum()
+
+			// external writes
+			dieIf(t, db.Put(name, "a", 2))
+			dieIf(t, db.Put(name, "b", 2))
+			get("a", 1)
+			c.Invalidate("a")
+			get("a", 2)
+			get("b", 1)
+
+			c.InvalidateAll()
+			get("b", 2)
+			if n := sum(); n != 4 {
+				t.Fatalf("expected 4, got %d", n)
+			}
+			// the bucket is untouched
+			if v, err := db.GetBytes(name, "a"); err != nil || v == nil {
+				t.Fatalf("expected a value, got %q %v", v, err)
+			}
+		})
+	}
+}
+
+func TestViewTimeout(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.InitialMmapSize = 0 // so the write below has to remap, which waits for open read txs
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.PutBytes("b", "k", []byte("v")))
+
+	dieIf(t, db.ViewTimeout(time.Second, func(tx *Tx) error {
+		if v := tx.GetBytes("b", "k", false); string(v) != "v" {
+			t.Fatalf("unexpected value: %q", v)
+		}
+		return nil
+	}))
+
+	// the remap waits for rtx, and new read txs queue up behind the remap
+	rtx, err := db.Begin(false)
+	dieIf(t, err)
+	done := make(chan error, 1)
+	go func() { done <- db.PutBytes("other", "huge", make([]byte, 32<<20)) }()
+	time.Sleep(time.Millisecond * 100)
+	select {
+	case err := <-done:
+		rtx.Rollback()
+		t.Fatalf("the write didn't block on the remap: %v", err)
+	default:
+	}
+
+	err = db.ViewTimeout(time.Millisecond*10, func(tx *Tx) error {
+		t.Fatal("fn shouldn't be called")
+		return nil
+	})
+	if !errors.Is(err, ErrViewTimeout) {
+		t.Fatalf("expected ErrViewTimeout, got %v", err)
+	}
+
+	dieIf(t, rtx.Rollback())
+	dieIf(t, <-done)
+	// the abandoned tx gets rolled back once Begin returns
+	for i := 0; i < 100; i++ {
+		if r, _ := db.OpenTxCount(); r == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("the timed out tx was never rolled back")
+}
+
+func TestAutoCreateBuckets(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.AutoCreateBuckets = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	var v S
+	if err := db.Get("missing", "k", &v); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	dieIf(t, db.ForEachBytes("missing", func(k, v []byte) error {
+		t.Fatal("unexpected key", k)
+		return nil
+	}))
+	if kvs, _, err := DBToTyped[S](db).RangeScan("missing", RangeOptions{}); err != nil || len(kvs) != 0 {
+		t.Fatalf("unexpected result: %v %v", kvs, err)
+	}
+
+	dieIf(t, db.Put("b", "k", &S{X: 1}))
+	if err := db.Get("b", "other", &v); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	dieIf(t, db.Get("b", "k", &v))
+	if v.X != 1 {
+		t.Fatalf("unexpected value: %+v", v)
+	}
+}
+
+func TestGetMissingKey(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Put("b", "k", &S{X: 1}))
+	var v S
+	if err := db.Get("b", "other", &v); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	var b []byte
+	if err := db.GetAny("b", "other", &b, nil); err != ErrKeyNotFound || b != nil {
+		t.Fatalf("expected ErrKeyNotFound, got %q %v", b, err)
+	}
+}
+
+func TestForEachUpdate(t *testing.T) {
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		dieIf(t, db.Put("b", strconv.Itoa(i), S{X: i}))
+	}
+
+	dieIf(t, db.ForEachUpdate("b", func(k string, v S, setValue func(k string, nv *S)) error {
+		if v.X%2 == 1 {
+			setValue(k, nil)
+			return nil
+		}
+		v.X++
+		setValue(k, &v)
+		return nil
+	}))
+
+	n := 0
+	dieIf(t, db.ForEach("b", func(k string, v S) error {
+		if i, _ := strconv.Atoi(k); i%2 == 1 || v.X != i+1 {
+			t.Fatalf("unexpected value for %s: %+v", k, v)
+		}
+		n++
+		return nil
+	}))
+	if n != 5 {
+		t.Fatalf("expected 5 keys, got %d", n)
+	}
+
+	dieIf(t, db.DB.ForEachUpdate("b", func(k, v []byte, setValue func(k, nv []byte)) error {
+		setValue(k, nil)
+		return nil
+	}))
+	if keys := db.Buckets(); len(keys) != 1 {
+		t.Fatalf("unexpected buckets: %v", keys)
+	}
+	dieIf(t, db.ForEach("b", func(k string, v S) error {
+		t.Fatalf("unexpected key: %s", k)
+		return nil
+	}))
+
+	if err := db.DB.ForEachUpdate("missing", nil); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestCountPrefix(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for _, k := range []string{"a/1", "a/2", "a/3", "ab", "b/1", "c"} {
+		dieIf(t, db.PutBytes("b", k, []byte(k)))
+	}
+
+	for prefix, exp := range map[string]int{"": 6, "a": 4, "a/": 3, "b/": 1, "c": 1, "d": 0, "a/4": 0} {
+		if n, err := db.CountPrefix("b", []byte(prefix)); err != nil || n != exp {
+			t.Fatalf("%q: expected %d, got %d (%v)", prefix, exp, n, err)
+		}
+	}
+	if _, err := db.CountPrefix("missing", nil); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestCountKeys(t *testing.T) {
+	const N = 5000
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if err := tx.PutBytes("b", benchKey(uint64(i)), benchVal); err != nil {
+				return err
+			}
+		}
+		// uncommitted writes have to be counted
+		if n, err := tx.CountKeys("b"); err != nil || n != N {
+			t.Fatalf("expected %d keys in the write tx, got %d (%v)", N, n, err)
+		}
+		return nil
+	}))
+	if n, err := db.CountKeys("b"); err != nil || n != N {
+		t.Fatalf("expected %d keys, got %d (%v)", N, n, err)
+	}
+
+	// the keys of a nested bucket aren't counted, only its name
+	dieIf(t, db.Update(func(tx *Tx) error {
+		nb, err := tx.Bucket("b").CreateBucket([]byte("nested"))
+		if err != nil {
+			return err
+		}
+		return nb.Put([]byte("k"), []byte("v"))
+	}))
+	if n, err := db.CountKeys("b"); err != nil || n != N+1 {
+		t.Fatalf("expected %d keys, got %d (%v)", N+1, n, err)
+	}
+
+	if _, err := db.CountKeys("missing"); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestRangePrefix(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.VerifyChecksums = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	for _, k := range []string{"a/1", "a/2", "a/3", "ab", "b/1", "c"} {
+		dieIf(t, db.PutBytes("b", k, []byte(k)))
+	}
+
+	dieIf(t, db.View(func(tx *Tx) error {
+		for prefix, exp := range map[string]string{"": "a/1,a/2,a/3,ab,b/1,c", "a/": "a/1,a/2,a/3", "b": "b/1", "d": ""} {
+			var keys []string
+			if err := tx.RangePrefix("b", []byte(prefix), func(c *Cursor, k, v []byte) error {
+				if string(k) != string(v) {
+					t.Fatalf("%s: unexpected value %q", k, v)
+				}
+				keys = append(keys, string(k))
+				return nil
+			}); err != nil {
+				return err
+			}
+			if got := strings.Join(keys, ","); got != exp {
+				t.Fatalf("%q: expected %s, got %s", prefix, exp, got)
+			}
+		}
+		if err := tx.RangePrefix("missing", nil, nil); err != ErrBucketNotFound {
+			t.Fatalf("expected ErrBucketNotFound, got %v", err)
+		}
+		return nil
+	}))
+}
+
+func TestTypedForEachReverse(t *testing.T) {
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		dieIf(t, db.Put("b", fmt.Sprintf("%02d", i), S{X: i}))
+	}
+
+	var xs []int
+	dieIf(t, db.ForEachReverse("b", func(key string, v S) error {
+		if key != fmt.Sprintf("%02d", v.X) {
+			t.Fatalf("%s: unexpected value %+v", key, v)
+		}
+		xs = append(xs, v.X)
+		return nil
+	}))
+	if !reflect.DeepEqual(xs, []int{4, 3, 2, 1, 0}) {
+		t.Fatalf("expected newest first, got %v", xs)
+	}
+	if err := db.ForEachReverse("missing", nil); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestForEachBytesReverse(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		dieIf(t, db.PutBytes("b", fmt.Sprintf("%02d", i), []byte{byte(i)}))
+	}
+
+	const errStop = oerrs.String("stop")
+	var keys []string
+	err = db.ForEachBytesReverse("b", func(k, v []byte) error {
+		if keys = append(keys, string(k)); len(keys) == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop || strings.Join(keys, ",") != "09,08,07" {
+		t.Fatalf("unexpected %v (%v)", keys, err)
+	}
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		_, err := tx.CreateBucketIfNotExists("empty")
+		return err
+	}))
+	dieIf(t, db.ForEachBytesReverse("empty", func(k, v []byte) error {
+		t.Fatalf("unexpected key %q", k)
+		return nil
+	}))
+	if err := db.ForEachBytesReverse("missing", nil); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestUpdateDurable(t *testing.T) {
+	fp := t.TempDir() + "/x.db"
+	opts := DefaultOptions.Clone()
+	opts.NoSync = true
+	db, err := Open(fp, opts)
+	dieIf(t, err)
+
+	dieIf(t, db.PutBytes("b", "k", []byte("fast")))
+	dieIf(t, db.UpdateDurable(func(tx *Tx) error {
+		return tx.PutBytes("b", "k", []byte("durable"))
+	}))
+	dieIf(t, db.Close())
+
+	db, err = Open(fp, opts)
+	dieIf(t, err)
+	defer db.Close()
+	if v, err := db.GetBytes("b", "k"); err != nil || string(v) != "durable" {
+		t.Fatalf("expected durable, got %q %v", v, err)
+	}
+}
+
+func TestWalkBucketsParallel(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	const N = 50
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if err := tx.PutBytes(fmt.Sprintf("b%02d", i), "k", []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	var seen genh.LMap[string, int]
+	dieIf(t, db.WalkBucketsParallel(8, func(bucket string) error {
+		seen.UpdateKey(bucket, func(n int) int { return n + 1 })
+		_, err := db.GetBytes(bucket, "k")
+		return err
+	}))
+	if n := seen.Len(); n != N {
+		t.Fatalf("expected %d buckets, got %d", N, n)
+	}
+	seen.ForEach(func(k string, v int) bool {
+		if v != 1 {
+			t.Errorf("%s was processed %d times", k, v)
+		}
+		return true
+	})
+
+	const errFail = oerrs.String("fail")
+	var calls int
+	if err := db.WalkBucketsParallel(1, func(bucket string) error {
+		calls++
+		return errFail
+	}); err != errFail || calls != 1 {
+		t.Fatalf("expected errFail after 1 call, got %v after %d", err, calls)
+	}
+}
+
+func TestPutValueBytes(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	db.SetMarshaler(genh.MarshalMsgpack, genh.UnmarshalMsgpack)
+
+	type S struct{ A, B int }
+	var b []byte
+	dieIf(t, db.Update(func(tx *Tx) (err error) {
+		b, err = tx.PutValueBytes("b", "k", &S{1, 2})
+		return
+	}))
+	var s S
+	dieIf(t, db.unmarshalFn(b, &s))
+	if s != (S{1, 2}) {
+		t.Fatalf("unexpected %+v", s)
+	}
+	if v, _ := db.GetBytes("b", "k"); !bytes.Equal(v, b) {
+		t.Fatalf("stored %q, returned %q", v, b)
+	}
+
+	var kerr *KeyTooLargeError
+	dieIf(t, db.Update(func(tx *Tx) (err error) {
+		if b, err = tx.PutValueBytes("b", strings.Repeat("k", boltMaxKeySize+1), &S{1, 2}); b != nil || !errors.As(err, &kerr) {
+			t.Fatalf("expected nil and a key size error, got %q %v", b, err)
+		}
+		return nil
+	}))
+}
+
+func TestBloom(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	const N = 10000
+	put := func(from, to int) {
+		dieIf(t, db.Update(func(tx *Tx) error {
+			for i := from; i < to; i++ {
+				if err := tx.PutBytes("b", fmt.Sprintf("k%06d", i), []byte("v")); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+	put(0, N/2)
+	dieIf(t, db.EnableBloom("b", N))
+	put(N/2, N) // keys added after the filter was built
+
+	for i := 0; i < N; i++ {
+		k := fmt.Sprintf("k%06d", i)
+		if !db.Exists("b", k) {
+			t.Fatalf("false negative for %s", k)
+		}
+		if v, err := db.GetBytes("b", k); err != nil || string(v) != "v" {
+			t.Fatalf("%s: unexpected %q (%v)", k, v, err)
+		}
+	}
+
+	var fp int
+	for i := N; i < 2*N; i++ {
+		k := []byte(fmt.Sprintf("k%06d", i))
+		if db.Exists("b", string(k)) {
+			t.Fatalf("unexpected key %s", k)
+		}
+		if !db.bloomMiss("b", k) {
+			fp++
+			// a false positive must fail the same way a definite miss does
+			var s string
+			if err := db.Get("b", string(k), &s); err != ErrKeyNotFound {
+				t.Fatalf("%s: expected ErrKeyNotFound, got %v", k, err)
+			}
+		}
+	}
+	if fp > N/20 {
+		t.Fatalf("too many false positives: %d", fp)
+	}
+
+	var s string
+	if err := db.Get("b", "missing", &s); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestBloomSameErrors(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.Put("b", "k", "v"))
+
+	check := func(bloom bool) {
+		t.Helper()
+		var s string
+		if err := db.Get("b", "missing", &s); err != ErrKeyNotFound {
+			t.Fatalf("bloom %v: expected ErrKeyNotFound, got %v", bloom, err)
+		}
+		var b []byte
+		if err := db.GetAny("b", "missing", &b, nil); err != ErrKeyNotFound {
+			t.Fatalf("bloom %v: expected ErrKeyNotFound, got %v", bloom, err)
+		}
+		if _, err := db.GetBytes("b", "missing"); err != ErrKeyNotFound {
+			t.Fatalf("bloom %v: expected ErrKeyNotFound, got %v", bloom, err)
+		}
+		dieIf(t, db.Get("b", "k", &s))
+		if s != "v" {
+			t.Fatalf("bloom %v: unexpected value %q", bloom, s)
+		}
+	}
+	missingBucket := func(bloom bool) {
+		t.Helper()
+		var s string
+		if err := db.Get("nob", "k", &s); !errors.Is(err, ErrBucketNotFound) {
+			t.Fatalf("bloom %v: expected ErrBucketNotFound, got %v", bloom, err)
+		}
+		if _, err := db.GetBytes("nob", "k"); err != ErrKeyNotFound {
+			t.Fatalf("bloom %v: expected ErrKeyNotFound, got %v", bloom, err)
+		}
+	}
+	check(false)
+	missingBucket(false)
+	dieIf(t, db.EnableBloom("b", 100))
+	dieIf(t, db.EnableBloom("nob", 100))
+	check(true)
+	missingBucket(true)
+
+	// a deleted bucket fails like a missing one
+	dieIf(t, db.Put("nob", "k", "v"))
+	dieIf(t, db.DeleteBucket("nob"))
+	missingBucket(true)
+
+	db.DisableBloom("b")
+	db.DisableBloom("nob")
+	check(false)
+	missingBucket(false)
+}
+
+func TestKeysChan(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		dieIf(t, db.PutBytes("b", fmt.Sprintf("%03d", i), nil))
+	}
+
+	keys, errs := db.KeysChan(context.Background(), "b")
+	var n int
+	for k := range keys {
+		if k != fmt.Sprintf("%03d", n) {
+			t.Fatalf("unexpected key %s", k)
+		}
+		n++
+	}
+	if err := <-errs; err != nil || n != 100 {
+		t.Fatalf("expected 100 keys, got %d (%v)", n, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	keys, errs = db.KeysChan(ctx, "b")
+	<-keys
+	<-keys
+	cancel()
+	for range keys {
+	}
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if n := db.Raw().Stats().OpenTxN; n != 0 {
+		t.Fatalf("leaked %d transactions", n)
+	}
+}
+
+func TestReadPoolGrow(t *testing.T) {
+	const maxAge = 200 * time.Millisecond
+	opts := DefaultOptions.Clone()
+	opts.InitialMmapSize = 0 // so the write below has to remap
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+	p := db.NewReadPool(maxAge)
+	defer p.Close()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				p.View(func(tx *Tx) error {
+					tx.GetBytes("b", "k", false)
+					return nil
+				})
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	time.Sleep(maxAge / 2)
+
+	// the commit waits for the pooled transactions to be rolled back, that has to happen within about maxAge
+	start := time.Now()
+	dieIf(t, db.PutBytes("b", "big", make([]byte, 8<<20)))
+	if took := time.Since(start); took > maxAge*2 {
+		t.Fatalf("growing the file took %v with maxAge %v", took, maxAge)
+	}
+}
+
+func TestReadPool(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	const maxAge = 20 * time.Millisecond
+	p := db.NewReadPool(maxAge)
+	defer p.Close()
+
+	get := func() (v string) {
+		dieIf(t, p.View(func(tx *Tx) error {
+			v = string(tx.GetBytes("b", "k", false))
+			return nil
+		}))
+		return
+	}
+
+	dieIf(t, db.PutBytes("b", "k", []byte("1")))
+	if v := get(); v != "1" {
+		t.Fatalf("expected 1, got %q", v)
+	}
+
+	dieIf(t, db.PutBytes("b", "k", []byte("2")))
+	time.Sleep(maxAge)
+	if v := get(); v != "2" {
+		t.Fatalf("expected 2 after the refresh interval, got %q", v)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				p.View(func(tx *Tx) error {
+					tx.GetBytes("b", "k", false)
+					return nil
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	dieIf(t, p.Close())
+	if n := db.Raw().Stats().OpenTxN; n != 0 {
+		t.Fatalf("leaked %d transactions", n)
+	}
+}
+
+func TestDebugDump(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		dieIf(t, db.PutBytes("users", fmt.Sprintf("u%02d", i), []byte("name")))
+	}
+	dieIf(t, db.PutBytes("bin", "k", []byte{0, 1, 2}))
+	dieIf(t, db.Update(func(tx *Tx) error {
+		nested, err := tx.MustBucket("nested").CreateBucket([]byte("sub"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := nested.Put([]byte(strconv.Itoa(i)), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return tx.PutBytes("nested", "k", []byte("v"))
+	}))
+
+	var buf bytes.Buffer
+	dieIf(t, db.DebugDump(&buf, DumpOptions{MaxKeysPerBucket: 5}))
+	out := buf.String()
+	for _, s := range []string{
+		`bucket "users" seq=0 keys=20`, `bucket "bin"`, `"k": 0x000102`, `"u04": "name"`, "... 15 more",
+		`bucket "nested" seq=0 keys=2`, `"sub": <bucket>`,
+	} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("missing %q in:\n%s", s, out)
+		}
+	}
+	if strings.Contains(out, `"u05"`) {
+		t.Fatalf("the key limit wasn't respected:\n%s", out)
+	}
+}
+
+func TestTxDeletedBucket(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		dieIf(t, tx.PutBytes("b", "k", []byte("v")))
+		dieIf(t, tx.PutBytes("raw", "k", []byte("v")))
+		if tx.Bucket("b") == nil || tx.Bucket("raw") == nil {
+			t.Fatal("missing bucket")
+		}
+		dieIf(t, tx.DeleteBucket("b"))
+		dieIf(t, tx.BBoltTx.DeleteBucket([]byte("raw")))
+		if tx.Bucket("b") != nil || tx.Bucket("raw") != nil {
+			t.Fatal("a deleted bucket is still returned")
+		}
+		if v := tx.GetBytes("b", "k", false); v != nil {
+			t.Fatalf("unexpected %q", v)
+		}
+		return tx.PutBytes("b", "k2", []byte("v2"))
+	}))
+
+	if v, _ := db.GetBytes("b", "k"); v != nil {
+		t.Fatalf("unexpected %q", v)
+	}
+	if v, _ := db.GetBytes("b", "k2"); string(v) != "v2" {
+		t.Fatalf("unexpected %q", v)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.RecoverPanics = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	err = db.Update(func(tx *Tx) error {
+		dieIf(t, tx.PutBytes("b", "k", []byte("v")))
+		panic("boom")
+	})
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "boom" || len(perr.Stack) == 0 {
+		t.Fatalf("expected a *PanicError, got %v", err)
+	}
+	if err := db.View(func(tx *Tx) error { panic("boom") }); !errors.As(err, &perr) {
+		t.Fatalf("expected a *PanicError, got %v", err)
+	}
+	if err := db.Batch(func(tx *Tx) error { panic("boom") }); !errors.As(err, &perr) {
+		t.Fatalf("expected a *PanicError, got %v", err)
+	}
+	if err := db.BatchIsolated(func(tx *Tx) error { panic("boom") }); !errors.As(err, &perr) {
+		t.Fatalf("expected a *PanicError, got %v", err)
+	}
+
+	// the panicking update was rolled back and the db is still usable
+	if v, _ := db.GetBytes("b", "k"); v != nil {
+		t.Fatalf("unexpected %q", v)
+	}
+	dieIf(t, db.PutBytes("b", "k", []byte("v2")))
+	if v, _ := db.GetBytes("b", "k"); string(v) != "v2" {
+		t.Fatalf("unexpected %q", v)
+	}
+}
+
+func TestOpenTxCount(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	tx, err := db.Begin(false)
+	dieIf(t, err)
+	dieIf(t, db.View(func(*Tx) error { return nil }))
+	if r, w := db.OpenTxCount(); r != 1 || w != 0 {
+		t.Fatalf("expected 1 read tx, got %d, %d", r, w)
+	}
+	dieIf(t, tx.Rollback())
+	tx.Rollback()
+	if r, w := db.OpenTxCount(); r != 0 || w != 0 {
+		t.Fatalf("expected no open txs, got %d, %d", r, w)
+	}
+
+	wtx, err := db.Begin(true)
+	dieIf(t, err)
+	if _, w := db.OpenTxCount(); w != 1 {
+		t.Fatalf("expected 1 write tx, got %d", w)
+	}
+	dieIf(t, wtx.PutBytes("b", "k", nil))
+	dieIf(t, wtx.Commit())
+	if r, w := db.OpenTxCount(); r != 0 || w != 0 {
+		t.Fatalf("expected no open txs, got %d, %d", r, w)
+	}
+}
+
+func TestSetReadOnly(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.PutBytes("b", "k", []byte("v")))
+
+	db.SetReadOnly(true)
+	if err := db.PutBytes("b", "k2", []byte("v")); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := db.Delete("b", "k"); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if err := db.Batch(func(*Tx) error { return nil }); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if _, err := db.Begin(true); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+	if v, err := db.GetBytes("b", "k"); err != nil || string(v) != "v" {
+		t.Fatalf("unexpected read %q: %v", v, err)
+	}
+
+	db.SetReadOnly(false)
+	dieIf(t, db.PutBytes("b", "k2", []byte("v2")))
+	dieIf(t, db.Delete("b", "k"))
+	if v, _ := db.GetBytes("b", "k2"); string(v) != "v2" {
+		t.Fatalf("unexpected value %q", v)
+	}
+}
+
+func TestDoubleClose(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	dieIf(t, db.Close())
+	if err := db.Close(); err != nil {
+		t.Fatalf("second close: %v", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	tmp := t.TempDir()
+	primary, err := Open(tmp+"/primary.db", nil)
+	dieIf(t, err)
+	defer primary.Close()
+	follower, err := Open(tmp+"/follower.db", nil)
+	dieIf(t, err)
+	defer follower.Close()
+
+	src := primary.ReplicationSource()
+	dieIf(t, primary.PutBytes("b", "a", []byte("1")))
+	dieIf(t, primary.PutBytes("b", "b", []byte("2")))
+	dieIf(t, primary.Delete("b", "a"))
+	if err := primary.Update(func(tx *Tx) error {
+		tx.PutBytes("b", "c", []byte("3"))
+		return errors.New("rollback")
+	}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for i := 0; i < 3; i++ {
+		dieIf(t, follower.ApplyReplication(<-src))
+	}
+	select {
+	case muts := <-src:
+		t.Fatalf("rolled back tx was replicated: %+v", muts)
+	default:
+	}
+
+	if v, _ := follower.GetBytes("b", "a"); v != nil {
+		t.Fatalf("deleted key replicated: %q", v)
+	}
+	if v, _ := follower.GetBytes("b", "b"); string(v) != "2" {
+		t.Fatalf("unexpected value: %q", v)
+	}
+}
+
+func TestReplicationRollback(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.RecoverPanics = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+	src := db.ReplicationSource()
+
+	put := func(tx *Tx) error { return tx.PutBytes("b", "k", []byte("rolled back")) }
+	fails := map[string]func(){
+		"update": func() { db.Update(func(tx *Tx) error { put(tx); return errors.New("rollback") }) },
+		"panic":  func() { db.Update(func(tx *Tx) error { put(tx); panic("rollback") }) },
+		"batch":  func() { db.Batch(func(tx *Tx) error { put(tx); return errors.New("rollback") }) },
+		"begin": func() {
+			tx, err := db.Begin(true)
+			dieIf(t, err)
+			put(tx)
+			dieIf(t, tx.Rollback())
+		},
+	}
+	for name, fail := range fails {
+		fail()
+		// a commit that doesn't record anything moves the tx id past the rolled back one
+		dieIf(t, db.Update(func(tx *Tx) error { _, err := tx.CreateBucketIfNotExists(name); return err }))
+		dieIf(t, db.PutBytes("b", name, []byte("v")))
+		select {
+		case muts := <-src:
+			if len(muts) != 1 || string(muts[0].Key) != name {
+				t.Fatalf("%s: unexpected mutations: %+v", name, muts)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: the put after the rollback wasn't published", name)
+		}
+	}
+}
+
+func TestReplicationOrder(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	src := db.ReplicationSource()
+
+	// every committed tx writes the next counter value, so the source has to see them increasing
+	const workers, n = 8, 200
+	incr := func(tx *Tx) error {
+		var c uint64
+		if v := tx.GetBytes("b", "n", false); v != nil {
+			c = binary.BigEndian.Uint64(v)
+		}
+		return tx.PutBytes("b", "n", binary.BigEndian.AppendUint64(nil, c+1))
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		w := w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				if i%10 == 0 {
+					db.Update(func(tx *Tx) error {
+						incr(tx)
+						return errors.New("rollback")
+					})
+				}
+				if w%2 == 0 {
+					if err := db.Update(incr); err != nil {
+						t.Error(err)
+					}
+				} else {
+					if err := db.Batch(incr); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+
+	var last uint64
+	for seen := 0; seen < workers*n; {
+		for _, m := range <-src {
+			if c := binary.BigEndian.Uint64(m.Value); c != last+1 {
+				t.Errorf("out of order: %d after %d", c, last)
+			}
+			last, seen = binary.BigEndian.Uint64(m.Value), seen+1
+		}
+	}
+	wg.Wait()
+}
+
+type hookEncoder struct {
+	Encoder
+	once sync.Once
+	fn   func()
+}
+
+func (e *hookEncoder) Encode(v any) error {
+	e.once.Do(e.fn)
+	return e.Encoder.Encode(v)
+}
+
+func TestExportBuckets(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < 10; i++ {
+			dieIf(t, tx.PutBytes("users", fmt.Sprintf("u%d", i), []byte("user")))
+			dieIf(t, tx.PutBytes("orders", fmt.Sprintf("u%d", i), []byte("order")))
+		}
+		return nil
+	}))
+
+	var buf bytes.Buffer
+	dieIf(t, db.ExportBuckets([]string{"users", "orders"}, &buf, func(w io.Writer) Encoder {
+		return &hookEncoder{Encoder: JSONEncoder(w), fn: func() {
+			// runs inside the export's read tx, the write must not show up in the export
+			dieIf(t, db.Update(func(tx *Tx) error {
+				dieIf(t, tx.PutBytes("users", "new", []byte("user")))
+				dieIf(t, tx.PutBytes("orders", "new", []byte("order")))
+				return tx.Delete("orders", "u0")
+			}))
+		}}
+	}))
+
+	counts := map[string]int{}
+	var bucket string
+	dec := json.NewDecoder(&buf)
+	for {
+		var r ExportRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else {
+			dieIf(t, err)
+		}
+		if r.Bucket != "" {
+			bucket = r.Bucket
+			continue
+		}
+		if string(r.Key) == "new" {
+			t.Fatalf("concurrent write leaked into the export: %s", bucket)
+		}
+		counts[bucket]++
+	}
+	if counts["users"] != 10 || counts["orders"] != 10 {
+		t.Fatalf("unexpected counts: %v", counts)
+	}
+	if v, _ := db.GetBytes("orders", "new"); v == nil {
+		t.Fatal("the concurrent write wasn't committed")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.MaxKeySize, opts.MaxValueSize = 8, 16
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	var kerr *KeyTooLargeError
+	if err := db.PutBytes("b", "123456789", []byte("v")); !errors.As(err, &kerr) || kerr.Size != 9 || kerr.Max != 8 {
+		t.Fatalf("expected a KeyTooLargeError, got %v", err)
+	}
+
+	var verr *ValueTooLargeError
+	dieIf(t, db.Update(func(tx *Tx) error {
+		if err := tx.PutBytes("b", "k", make([]byte, 17)); !errors.As(err, &verr) || verr.Size != 17 || verr.Max != 16 {
+			t.Fatalf("expected a ValueTooLargeError, got %v", err)
+		}
+		return tx.PutBytes("b", "k", make([]byte, 16))
+	}))
+
+	dieIf(t, db.View(func(tx *Tx) error {
+		if n := tx.Bucket("b").Stats().KeyN; n != 1 {
+			t.Fatalf("oversized values reached bbolt: %d keys", n)
+		}
+		return nil
+	}))
+}
+
+func TestInsertionOrder(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.InsertionOrderBuckets = []string{"ordered"}
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	for _, k := range []string{"zeta", "alpha", "mid", "beta"} {
+		dieIf(t, db.PutBytes("ordered", k, []byte(k)))
+	}
+	dieIf(t, db.PutBytes("ordered", "alpha", []byte("updated"))) // overwrites keep their position
+	dieIf(t, db.Delete("ordered", "mid"))
+	dieIf(t, db.PutBytes("ordered", "mid", []byte("mid"))) // re-inserted keys move to the end
+
+	var keys []string
+	dieIf(t, db.ForEachInsertionOrder("ordered", func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	if exp := []string{"zeta", "alpha", "beta", "mid"}; !reflect.DeepEqual(keys, exp) {
+		t.Fatalf("expected %v, got %v", exp, keys)
+	}
+}
+
+func TestGetAuto(t *testing.T) {
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	want := S{X: 1, Y: "mixed"}
+	j, _ := json.Marshal(want)
+	m, _ := genh.MarshalMsgpack(want)
+	dieIf(t, db.PutBytes("b", "json", j))
+	dieIf(t, db.PutBytes("b", "msgp", m))
+
+	for _, k := range []string{"json", "msgp"} {
+		v, err := db.GetAuto("b", k)
+		dieIf(t, err)
+		if v != want {
+			t.Fatalf("%s: expected %+v, got %+v", k, want, v)
+		}
+	}
+	if _, err := db.Get("b", "msgp"); err == nil {
+		t.Fatal("expected Get to fail on a msgpack value")
+	}
+}
+
+func TestTypedGetPutWith(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.MarshalFn, opts.UnmarshalFn = genh.MarshalMsgpack, genh.UnmarshalMsgpack
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	m, u := db.Marshalers()
+	if reflect.ValueOf(m).Pointer() != reflect.ValueOf(genh.MarshalMsgpack).Pointer() ||
+		reflect.ValueOf(u).Pointer() != reflect.ValueOf(genh.UnmarshalMsgpack).Pointer() {
+		t.Fatal("expected the msgpack marshalers")
+	}
+
+	// a legacy json value next to a msgpack one
+	want := S{X: 1, Y: "legacy"}
+	dieIf(t, db.PutWith("b", "json", want, json.Marshal))
+	dieIf(t, db.Put("b", "msgp", want))
+	if b, _ := db.GetBytes("b", "json"); !json.Valid(b) {
+		t.Fatalf("PutWith didn't use json: %q", b)
+	}
+
+	v, err := db.GetWith("b", "json", json.Unmarshal)
+	dieIf(t, err)
+	if v != want {
+		t.Fatalf("expected %+v, got %+v", want, v)
+	}
+	if _, err := db.Get("b", "json"); err == nil {
+		t.Fatal("expected Get to fail on a json value")
+	}
+	if v, err = db.GetWith("b", "msgp", nil); err != nil || v != want {
+		t.Fatalf("expected %+v, got %+v (%v)", want, v, err)
+	}
+}
+
+func TestTypedPutAll(t *testing.T) {
+	const errBad = oerrs.String("bad value")
+	opts := DefaultOptions.Clone()
+	opts.MarshalFn = func(v any) ([]byte, error) {
+		if v.(S).Y == "bad" {
+			return nil, errBad
+		}
+		return DefaultMarshalFn(v)
+	}
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	m := map[string]S{}
+	for i := 0; i < 100; i++ {
+		m[strconv.Itoa(i)] = S{X: i}
+	}
+	m["50"] = S{Y: "bad"}
+	if err := db.PutAll("b", m); !errors.Is(err, errBad) {
+		t.Fatalf("expected errBad, got %v", err)
+	}
+	if n := len(db.Buckets()); n != 0 {
+		t.Fatalf("expected nothing to be written, got %d buckets", n)
+	}
+
+	m["50"] = S{X: 50}
+	dieIf(t, db.PutAll("b", m))
+	n := 0
+	dieIf(t, db.ForEach("b", func(k string, v S) error {
+		if m[k] != v {
+			t.Fatalf("%s: expected %+v, got %+v", k, m[k], v)
+		}
+		n++
+		return nil
+	}))
+	if n != len(m) {
+		t.Fatalf("expected %d entries, got %d", len(m), n)
+	}
+}
+
+func TestImportJSONL(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	in := `{"k": "a", "v": {"X": 1}}
+{"k": "b", "v": "str"}
+not json
+{"k": "c"}
+
+{"k": "d", "v": [1, 2]}
+`
+	n, err := ImportJSONL(db, "imported", strings.NewReader(in))
+	var el *oerrs.ErrorList
+	if !errors.As(err, &el) || len(el.Errors()) != 2 {
+		t.Fatalf("expected 2 malformed lines, got %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("expected 3 imported lines, got %d", n)
+	}
+	for k, exp := range map[string]string{"a": `{"X": 1}`, "b": `"str"`, "d": `[1, 2]`} {
+		if v, _ := db.GetBytes("imported", k); string(v) != exp {
+			t.Fatalf("%s: expected %s, got %s", k, exp, v)
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	n, err := ImportCSV(db, "imported", strings.NewReader("id,name\n1,a\n2\n3,c\n"), 0)
+	if err == nil || n != 2 {
+		t.Fatalf("expected 2 rows and an error, got %d: %v", n, err)
+	}
+	var m map[string]string
+	dieIf(t, db.Get("imported", "3", &m))
+	if m["id"] != "3" || m["name"] != "c" {
+		t.Fatalf("unexpected value: %v", m)
+	}
+
+	// a reader that fails after the header stops the import instead of being retried forever
+	errBroken := errors.New("broken pipe")
+	r := io.MultiReader(strings.NewReader("id,name\n1,a\n"), iotest.ErrReader(errBroken))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err = ImportCSV(db, "failed", r, 0)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ImportCSV kept retrying the failing reader")
+	}
+	if !errors.Is(err, errBroken) || n != 1 {
+		t.Fatalf("expected 1 row and the read error, got %d: %v", n, err)
+	}
+}
+
+func callerStatsA(db *DB) error { return db.PutBytes("b", "a", []byte("a")) }
+
+func callerStatsB(db *DB) error {
+	return db.Update(func(tx *Tx) error { return tx.PutBytes("b", "b", []byte("b")) })
+}
+
+func TestCallerStats(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	dieIf(t, callerStatsA(db))
+	if st := db.CallerStats(); len(st) != 0 {
+		t.Fatalf("expected no stats without TrackCallers: %+v", st)
+	}
+	dieIf(t, db.Close())
+
+	opts := DefaultOptions.Clone()
+	opts.TrackCallers = true
+	db, err = Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 3; i++ {
+		dieIf(t, callerStatsA(db))
+	}
+	dieIf(t, callerStatsB(db))
+
+	st := db.CallerStats()
+	a, b := st[pkgPrefix+"callerStatsA"], st[pkgPrefix+"callerStatsB"]
+	if a.Count != 3 || b.Count != 1 {
+		t.Fatalf("unexpected stats: %+v", st)
+	}
+	if a.TotalDur < a.MaxDur || a.MaxDur <= 0 {
+		t.Fatalf("unexpected durations: %+v", a)
+	}
+}
+
+func TestRawStrings(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.RawStrings = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Put("b", "k", "hello"))
+	if v, _ := db.GetBytes("b", "k"); string(v) != "hello" {
+		t.Fatalf("expected the raw string, got %q", v)
+	}
+	var s string
+	dieIf(t, db.Get("b", "k", &s))
+	if s != "hello" {
+		t.Fatalf("unexpected value: %q", s)
+	}
+
+	dieIf(t, db.Update(func(tx *Tx) error { return tx.PutValue("b", "tx", "world") }))
+	if v, _ := db.GetBytes("b", "tx"); string(v) != "world" {
+		t.Fatalf("expected the raw string, got %q", v)
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	inc := func(old S, existed bool) S {
+		if existed != (old.X > 0) {
+			t.Fatalf("existed = %v for %+v", existed, old)
+		}
+		old.X++
+		return old
+	}
+	dieIf(t, db.Upsert("counters", "c", inc))
+	dieIf(t, db.Upsert("counters", "c", inc))
+
+	v, err := db.Get("counters", "c")
+	dieIf(t, err)
+	if v.X != 2 {
+		t.Fatalf("expected 2, got %d", v.X)
+	}
+}
+
+func TestGetSet(t *testing.T) {
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	old, err := db.DB.GetSet("raw", "k", []byte("1"))
+	if err != nil || old != nil {
+		t.Fatalf("expected nil, got %q (%v)", old, err)
+	}
+	if old, err = db.DB.GetSet("raw", "k", []byte("2")); err != nil || string(old) != "1" {
+		t.Fatalf("expected 1, got %q (%v)", old, err)
+	}
+	if v, _ := db.GetBytes("raw", "k"); string(v) != "2" {
+		t.Fatalf("expected 2, got %q", v)
+	}
+
+	tv, err := db.GetSet("typed", "k", S{X: 1})
+	if err != nil || tv != (S{}) {
+		t.Fatalf("expected the zero value, got %+v (%v)", tv, err)
+	}
+	if tv, err = db.GetSet("typed", "k", S{X: 2}); err != nil || tv.X != 1 {
+		t.Fatalf("expected 1, got %+v (%v)", tv, err)
+	}
+	if tv, _ = db.Get("typed", "k"); tv.X != 2 {
+		t.Fatalf("expected 2, got %+v", tv)
+	}
+}
+
+func TestGetSetChecksum(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.VerifyChecksums = true
+	db, err := OpenTDB[S](t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.Put("b", "k", S{X: 1}))
+	dieIf(t, db.Raw().Update(func(tx *BBoltTx) error {
+		b := tx.Bucket([]byte("b"))
+		v := append([]byte(nil), b.Get([]byte("k"))...)
+		v[len(v)-2] ^= 0xff
+		return b.Put([]byte("k"), v)
+	}))
+
+	var cerr *ChecksumError
+	if _, err := db.GetSet("b", "k", S{X: 2}); !errors.As(err, &cerr) {
+		t.Fatalf("expected a checksum error, got %v", err)
+	}
+	if _, err := db.Get("b", "k"); !errors.As(err, &cerr) {
+		t.Fatalf("the corrupt value was overwritten: %v", err)
+	}
+}
+
+func TestPop(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	push := func() {
+		for i := 0; i < 3; i++ {
+			dieIf(t, db.PutBytes("q", fmt.Sprintf("%02d", i), []byte{byte(i)}))
+		}
+	}
+
+	push()
+	for i := 0; i < 3; i++ {
+		k, v, err := db.PopFirst("q")
+		if err != nil || string(k) != fmt.Sprintf("%02d", i) || v[0] != byte(i) {
+			t.Fatalf("%d: unexpected %q %v (%v)", i, k, v, err)
+		}
+	}
+	if _, _, err := db.PopFirst("q"); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	push()
+	for i := 2; i >= 0; i-- {
+		k, v, err := db.PopLast("q")
+		if err != nil || string(k) != fmt.Sprintf("%02d", i) || v[0] != byte(i) {
+			t.Fatalf("%d: unexpected %q %v (%v)", i, k, v, err)
+		}
+	}
+	if _, _, err := db.PopLast("q"); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+	if _, _, err := db.PopFirst("missing"); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestBPop(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	type kv struct {
+		k, v []byte
+		err  error
+	}
+	ch := make(chan kv, 1)
+	go func() {
+		k, v, err := db.BPop(context.Background(), "q")
+		ch <- kv{k, v, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case r := <-ch:
+		t.Fatalf("BPop returned early: %+v", r)
+	default:
+	}
+
+	dieIf(t, db.PutBytes("q", "job", []byte("data")))
+	select {
+	case r := <-ch:
+		if r.err != nil || string(r.k) != "job" || string(r.v) != "data" {
+			t.Fatalf("unexpected %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BPop wasn't woken up")
+	}
+	if n, _ := db.CountPrefix("q", nil); n != 0 {
+		t.Fatalf("expected an empty queue, got %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := db.BPop(ctx, "q"); err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	// a put that isn't published is still picked up by the poll
+	defer func(d time.Duration) { BPopPollInterval = d }(BPopPollInterval)
+	BPopPollInterval = 20 * time.Millisecond
+	go func() {
+		k, v, err := db.BPop(context.Background(), "q")
+		ch <- kv{k, v, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dieIf(t, db.Raw().Update(func(tx *BBoltTx) error {
+		return tx.Bucket([]byte("q")).Put([]byte("raw"), []byte("data"))
+	}))
+	select {
+	case r := <-ch:
+		if r.err != nil || string(r.k) != "raw" {
+			t.Fatalf("unexpected %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("BPop didn't poll the bucket")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	fp := t.TempDir() + "/x.db"
+	db, err := Open(fp, nil)
+	dieIf(t, err)
+
+	for _, bkt := range []string{"a", "b"} {
+		dieIf(t, db.PutBytes(bkt, "k", []byte("v")))
+		_, err := db.NextIndex(bkt)
+		dieIf(t, err)
+	}
+
+	dieIf(t, db.TruncateBucket("a", true))
+	if v, _ := db.GetBytes("a", "k"); v != nil || db.CurrentIndex("a") != 1 {
+		t.Fatalf("expected an empty bucket with its sequence, got %q %d", v, db.CurrentIndex("a"))
+	}
+	dieIf(t, db.TruncateBucket("a", false))
+	if db.CurrentIndex("a") != 0 {
+		t.Fatalf("expected a reset sequence, got %d", db.CurrentIndex("a"))
+	}
+
+	dieIf(t, db.Truncate())
+	if b := db.Buckets(); len(b) != 0 {
+		t.Fatalf("expected no buckets, got %v", b)
+	}
+	dieIf(t, db.Close())
+
+	db, err = Open(fp, nil)
+	dieIf(t, err)
+	defer db.Close()
+	if b := db.Buckets(); len(b) != 0 {
+		t.Fatalf("expected no buckets, got %v", b)
+	}
+	if idx, _ := db.NextIndex("b"); idx != 1 {
+		t.Fatalf("expected the sequence to be reset, got %d", idx)
+	}
+}
+
+func TestChunkedView(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.InitialMmapSize = 0 // so the write below has to remap, which waits for open read txs
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		dieIf(t, db.PutBytes("b", fmt.Sprintf("%03d", i), []byte(strconv.Itoa(i))))
+	}
+
+	n := 0
+	dieIf(t, db.ChunkedView("b", 7, func(k, v []byte) error {
+		if string(k) != fmt.Sprintf("%03d", n) || string(v) != strconv.Itoa(n) {
+			t.Fatalf("unexpected %s: %s", k, v)
+		}
+		if n++; n == 1 {
+			// would deadlock if fn was called inside the read tx
+			done := make(chan error, 1)
+			go func() { done <- db.PutBytes("other", "huge", make([]byte, 32<<20)) }()
+			select {
+			case err := <-done:
+				dieIf(t, err)
+			case <-time.After(time.Second * 5):
+				t.Fatal("write blocked by the view")
+			}
+		}
+		return nil
+	}))
+	if n != 100 {
+		t.Fatalf("expected 100 keys, got %d", n)
+	}
+
+	var keys []string
+	dieIf(t, db.ChunkedViewFrom("b", []byte("094x"), 2, func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	dieIf(t, db.View(func(tx *Tx) error {
+		return tx.ForEachBytesFrom("b", []byte("095"), func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	}))
+	if exp := "095,096,097,098,099,095,096,097,098,099"; strings.Join(keys, ",") != exp {
+		t.Fatalf("expected %s, got %v", exp, keys)
+	}
+}
+
+func TestSetMarshalerRace(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				k := strconv.Itoa(i*100 + j)
+				var s S
+				if err := db.Put("b", k, &S{X: j}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := db.Get("b", k, &s); err != nil || s.X != j {
+					t.Error(s, err)
+					return
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 50; i++ {
+		// same encoding, so concurrent gets always decode what was written
+		db.SetMarshaler(json.Marshal, json.Unmarshal)
+	}
+	wg.Wait()
+}
+
+func TestOrderedIndex(t *testing.T) {
+	db, err := OpenTDB[*S](t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	idx := NewOrderedIndex(db, "s", "s_by_x", func(s *S) int { return s.X }, func(x int) []byte {
+		return binary.BigEndian.AppendUint64(nil, uint64(x))
+	})
+	for i, x := range []int{50, 10, 40, 20, 30, 20} {
+		dieIf(t, idx.Put(fmt.Sprintf("pk%d", i), &S{X: x, Y: fmt.Sprintf("pk%d", i)}))
+	}
+	// move pk2 from 40 to 5, its old entry must be gone
+	dieIf(t, idx.Put("pk2", &S{X: 5, Y: "pk2"}))
+	dieIf(t, idx.Delete("pk4"))
+
+	out, err := idx.RangeByIndex(5, 40)
+	dieIf(t, err)
+	var got []string
+	for _, s := range out {
+		got = append(got, fmt.Sprintf("%s:%d", s.Y, s.X))
+	}
+	if exp := "pk2:5 pk1:10 pk3:20 pk5:20"; strings.Join(got, " ") != exp {
+		t.Fatalf("expected %s, got %s", exp, strings.Join(got, " "))
+	}
+
+	if out, err = idx.RangeByIndex(21, 49); err != nil || len(out) != 0 {
+		t.Fatalf("expected no values, got %v (%v)", out, err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), []byte("v")))
+	}
+	if err := db.SetExpiry("b", "missing", time.Now()); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	dieIf(t, db.SetExpiry("b", "0", future))
+	dieIf(t, db.SetExpiry("b", "0", past)) // replaces the previous one
+	dieIf(t, db.SetExpiry("b", "1", past))
+	dieIf(t, db.SetExpiry("b", "2", future))
+	dieIf(t, db.SetExpiry("b", "3", past))
+	dieIf(t, db.ClearExpiry("b", "3"))
+
+	if at, ok := db.Expiry("b", "2"); !ok || !at.Equal(future) {
+		t.Fatalf("unexpected expiry %v %v", at, ok)
+	}
+	if _, ok := db.Expiry("b", "3"); ok {
+		t.Fatal("expected the expiry of 3 to be cleared")
+	}
+	if v, _ := db.GetBytes("b", "0"); string(v) != "v" {
+		t.Fatalf("the value was modified: %q", v)
+	}
+
+	// a deleted then recreated key doesn't keep its old expiry
+	dieIf(t, db.SetExpiry("b", "4", past))
+	dieIf(t, db.Delete("b", "4"))
+	dieIf(t, db.PutBytes("b", "4", []byte("v")))
+
+	n, err := db.ReapExpired("b")
+	dieIf(t, err)
+	if n != 2 {
+		t.Fatalf("expected 2 reaped keys, got %d", n)
+	}
+	var keys []string
+	dieIf(t, db.ForEachBytes("b", func(k, v []byte) error {
+		keys = append(keys, string(k))
+		return nil
+	}))
+	if strings.Join(keys, ",") != "2,3,4" {
+		t.Fatalf("unexpected keys left: %v", keys)
+	}
+	if _, ok := db.Expiry("b", "0"); ok {
+		t.Fatal("expected the expiry of a reaped key to be gone")
+	}
+
+	dieIf(t, db.SetExpiry("b", "2", time.Now()))
+	stop := db.StartReaper(time.Millisecond*10, "b")
+	defer stop()
+	for i := 0; i < 100; i++ {
+		if v, _ := db.GetBytes("b", "2"); v == nil {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatal("the reaper didn't delete the key")
+}
+
+func TestGetAcrossBuckets(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	set := func(i int) error {
+		return db.Update(func(tx *Tx) error {
+			v := []byte(strconv.Itoa(i))
+			if err := tx.PutBytes("a", "k", v); err != nil {
+				return err
+			}
+			return tx.PutBytes("b", "k", v)
+		})
+	}
+	dieIf(t, set(0))
+
+	reqs := []BucketKey{{"a", "k"}, {"missing", "k"}, {"b", "k"}, {"a", "missing"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 500; i++ {
+			if err := set(i); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		out, err := db.GetAcrossBuckets(reqs)
+		dieIf(t, err)
+		if len(out) != 4 || out[1] != nil || out[3] != nil {
+			t.Fatalf("unexpected values: %q", out)
+		}
+		if !bytes.Equal(out[0], out[2]) {
+			t.Fatalf("inconsistent snapshot: a=%s b=%s", out[0], out[2])
+		}
+	}
+}
+
+func TestForEachBytesTransform(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	vals := []string{"abc", "hello world", "x"}
+	for i, v := range vals {
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), []byte(v)))
+	}
+
+	var got []string
+	dieIf(t, db.ForEachBytesTransform("b", func(v []byte) ([]byte, error) {
+		// modifying the value in place is allowed, it's a copy
+		for i, c := range v {
+			if c >= 'a' && c <= 'z' {
+				v[i] = c - 'a' + 'A'
+			}
+		}
+		return v, nil
+	}, func(k, v []byte) error {
+		got = append(got, string(v))
+		return nil
+	}))
+	if strings.Join(got, ",") != "ABC,HELLO WORLD,X" {
+		t.Fatalf("unexpected values: %q", got)
+	}
+	if v, _ := db.GetBytes("b", "1"); string(v) != "hello world" {
+		t.Fatalf("the stored value was modified: %q", v)
+	}
+
+	const errBad = oerrs.String("bad value")
+	err = db.ForEachBytesTransform("b", func(v []byte) ([]byte, error) { return nil, errBad }, func(k, v []byte) error {
+		t.Fatal("fn called after a transform error")
+		return nil
+	})
+	if err != errBad {
+		t.Fatalf("expected errBad, got %v", err)
+	}
+}
+
+func TestSetNextIndexIf(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.SetNextIndex("b", 10))
+	for _, tc := range []struct {
+		higher bool
+		seq    uint64
+		set    bool
+		exp    uint64
+	}{
+		{true, 5, false, 10},
+		{true, 10, false, 10},
+		{true, 20, true, 20},
+		{false, 30, false, 20},
+		{false, 15, true, 15},
+	} {
+		var set bool
+		if tc.higher {
+			set, err = db.SetNextIndexIfHigher("b", tc.seq)
+		} else {
+			set, err = db.SetNextIndexIfLower("b", tc.seq)
+		}
+		dieIf(t, err)
+		if set != tc.set || db.CurrentIndex("b") != tc.exp {
+			t.Fatalf("%+v: got set=%v, seq=%d", tc, set, db.CurrentIndex("b"))
+		}
+	}
+
+	// a missing bucket starts at 0
+	if set, err := db.SetNextIndexIfHigher("new", 3); err != nil || !set || db.CurrentIndex("new") != 3 {
+		t.Fatalf("unexpected %v %v %d", set, err, db.CurrentIndex("new"))
+	}
+}
+
+func TestGetBytesNotFound(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	if v, err := db.GetBytes("missing", "k"); err != ErrKeyNotFound || v != nil {
+		t.Fatalf("missing bucket: %q %v", v, err)
+	}
+	dieIf(t, db.PutBytes("b", "empty", []byte{}))
+	if v, err := db.GetBytes("b", "k"); err != ErrKeyNotFound || v != nil {
+		t.Fatalf("missing key: %q %v", v, err)
+	}
+	if v, err := db.GetBytes("b", "empty"); err != nil || v == nil || len(v) != 0 {
+		t.Fatalf("empty value: %q %v", v, err)
+	}
+}
+
+func TestDeleteWhere(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	const N = 1000
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if err := tx.PutBytes("b", fmt.Sprintf("%04d", i), []byte(strconv.Itoa(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	n, err := db.DeleteWhere("b", func(k, v []byte) bool {
+		i, _ := strconv.Atoi(string(v))
+		return i%2 == 0
+	})
+	dieIf(t, err)
+	if n != N/2 {
+		t.Fatalf("expected %d deleted keys, got %d", N/2, n)
+	}
+
+	left := 0
+	dieIf(t, db.ForEachBytes("b", func(k, v []byte) error {
+		if i, _ := strconv.Atoi(string(v)); i%2 == 0 {
+			t.Fatalf("%s wasn't deleted", k)
+		}
+		left++
+		return nil
+	}))
+	if left != N/2 {
+		t.Fatalf("expected %d keys left, got %d", N/2, left)
+	}
+}
+
+func TestEnsureBuckets(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.CreateBuckets("a", "b"))
+	dieIf(t, db.PutBytes("a", "k", []byte("v")))
+
+	created, err := db.EnsureBuckets("a", "c", "b", "d")
+	dieIf(t, err)
+	if !reflect.DeepEqual(created, []string{"c", "d"}) {
+		t.Fatalf("expected [c d] to be created, got %v", created)
+	}
+	if got := db.Buckets(); !reflect.DeepEqual(got, []string{"a", "b", "c", "d"}) {
+		t.Fatalf("unexpected buckets: %v", got)
+	}
+	if v, _ := db.GetBytes("a", "k"); string(v) != "v" {
+		t.Fatalf("existing bucket was modified: %q", v)
+	}
+	if created, err = db.EnsureBuckets("a", "b", "c", "d"); err != nil || len(created) != 0 {
+		t.Fatalf("expected nothing to be created, got %v (%v)", created, err)
+	}
+}
+
+// TestPutNoLogging makes sure the write paths don't log anything, a log line per put floods production logs.
+func TestPutNoLogging(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+
+	type S struct{ A int }
+	for i := 0; i < 1000; i++ {
+		dieIf(t, db.Put("b", strconv.Itoa(i), &S{i}))
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), []byte("v")))
+	}
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < 1000; i++ {
+			if err := tx.PutAny("b", strconv.Itoa(i), &S{i}, nil); err != nil {
+				return err
+			}
+			if _, err := tx.PutValueBytes("b", strconv.Itoa(i), "v"); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	if buf.Len() > 0 {
+		t.Fatalf("puts logged:\n%s", buf.Bytes())
+	}
+}
+
+func TestEventLog(t *testing.T) {
+	type Event struct {
+		ID   int
+		Name string
+	}
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	el := NewEventLog[Event](db, "events")
+
+	for i := 1; i <= 10; i++ {
+		seq, err := el.Append(Event{i, "ev" + strconv.Itoa(i)})
+		dieIf(t, err)
+		if seq != uint64(i) {
+			t.Fatalf("expected seq %d, got %d", i, seq)
+		}
+	}
+
+	evs, err := el.Read(4, 3)
+	dieIf(t, err)
+	if !reflect.DeepEqual(evs, []Event{{4, "ev4"}, {5, "ev5"}, {6, "ev6"}}) {
+		t.Fatalf("unexpected events: %+v", evs)
+	}
+	if evs, _ = el.Read(9, 0); len(evs) != 2 || evs[1].ID != 10 {
+		t.Fatalf("unexpected events: %+v", evs)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := el.Follow(ctx)
+	go func() {
+		for i := 11; i <= 20; i++ {
+			if _, err := el.Append(Event{i, "ev" + strconv.Itoa(i)}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 11; i <= 20; i++ {
+		select {
+		case ev := <-ch:
+			if ev.ID != i {
+				t.Fatalf("expected event %d, got %+v", i, ev)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+	cancel()
+	for range ch {
+	}
+
+	// an event that isn't published is still picked up by the poll
+	defer func(d time.Duration) { EventLogPollInterval = d }(EventLogPollInterval)
+	EventLogPollInterval = 20 * time.Millisecond
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	ch = el.Follow(ctx)
+	raw, err := json.Marshal(Event{21, "ev21"})
+	dieIf(t, err)
+	dieIf(t, db.Raw().Update(func(tx *BBoltTx) error {
+		return tx.Bucket([]byte("events")).Put(eventKey(21), raw)
+	}))
+	select {
+	case ev := <-ch:
+		if ev.ID != 21 {
+			t.Fatalf("expected event 21, got %+v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Follow didn't poll the log")
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	dieIf(t, db.PutBytes("b", "k", []byte("v")))
+	dieIf(t, db.SetExpiry("b", "k", time.Now().Add(time.Hour)))
+	dieIf(t, db.PutBytes("other", "k", []byte("v")))
+
+	dieIf(t, db.DeleteBucket("b"))
+	dieIf(t, db.View(func(tx *Tx) error {
+		if tx.Bucket("b") != nil || tx.Bucket("b"+expiryBucketSuffix) != nil {
+			t.Fatal("bucket or its expiries weren't deleted")
+		}
+		if tx.Bucket("other") == nil {
+			t.Fatal("other bucket was deleted")
+		}
+		return nil
+	}))
+	if err := db.DeleteBucket("b"); err != ErrBucketNotFound {
+		t.Fatalf("expected ErrBucketNotFound, got %v", err)
+	}
+}
+
+func TestCloseNestedView(t *testing.T) {
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	dieIf(t, db.PutBytes("b", "k", []byte("v")))
+
+	started, done := make(chan struct{}), make(chan error, 1)
+	go func() {
+		done <- db.View(func(tx *Tx) error {
+			close(started)
+			time.Sleep(50 * time.Millisecond) // let Close start waiting
+			_, err := db.GetBytes("b", "k")
+			return err
+		})
+	}()
+	<-started
+	closed := make(chan error, 1)
+	go func() { closed <- db.Close() }()
+
+	select {
+	case err := <-done:
+		if err != bbolt.ErrDatabaseNotOpen {
+			t.Fatalf("expected ErrDatabaseNotOpen from the nested view, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("nested view deadlocked with Close")
+	}
+	dieIf(t, <-closed)
+}
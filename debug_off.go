@@ -0,0 +1,5 @@
+//go:build !mbbolt_debug
+
+package mbbolt
+
+const debugChecks = false
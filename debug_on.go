@@ -0,0 +1,6 @@
+//go:build mbbolt_debug
+
+package mbbolt
+
+// debugChecks enables the extra (and slower) sanity checks of the mbbolt_debug build tag.
+const debugChecks = true
@@ -0,0 +1,87 @@
+package mbbolt
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"unicode/utf8"
+)
+
+// DumpOptions bounds the output of DebugDump, zero values use the defaults.
+type DumpOptions struct {
+	MaxKeysPerBucket int // default 10
+	MaxValueBytes    int // default 64
+}
+
+// DebugDump writes a human readable summary of every top level bucket (its sequence, number of keys and first keys)
+// to w from a single read transaction, it's meant for eyeballing a db, use ExportBuckets for a machine readable dump.
+// Printable keys and values are quoted, anything else is hex encoded.
+func (db *DB) DebugDump(w io.Writer, opts DumpOptions) error {
+	if opts.MaxKeysPerBucket <= 0 {
+		opts.MaxKeysPerBucket = 10
+	}
+	if opts.MaxValueBytes <= 0 {
+		opts.MaxValueBytes = 64
+	}
+
+	bw := bufio.NewWriter(w)
+	if err := db.View(func(tx *Tx) error {
+		return tx.ForEach(func(name []byte, b *Bucket) error {
+			// only the top level entries, nested buckets count as one key
+			keys, err := tx.CountKeys(string(name))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(bw, "bucket %s seq=%d keys=%d\n", dumpBytes(name, len(name)), b.Sequence(), keys)
+
+			n := 0
+			c := b.Cursor()
+			for k, v := c.First(); k != nil && n < opts.MaxKeysPerBucket; k, v = c.Next() {
+				n++
+				if v == nil {
+					fmt.Fprintf(bw, "  %s: <bucket>\n", dumpBytes(k, len(k)))
+					continue
+				}
+				dv, err := db.decodeValue(string(name), k, v)
+				if err != nil {
+					fmt.Fprintf(bw, "  %s: <%v>\n", dumpBytes(k, len(k)), err)
+					continue
+				}
+				fmt.Fprintf(bw, "  %s: %s\n", dumpBytes(k, len(k)), dumpBytes(dv, opts.MaxValueBytes))
+			}
+			if keys > n {
+				fmt.Fprintf(bw, "  ... %d more\n", keys-n)
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// dumpBytes quotes b if it's printable or hex encodes it, cutting it at limit bytes.
+func dumpBytes(b []byte, limit int) string {
+	var suffix string
+	if len(b) > limit {
+		suffix = fmt.Sprintf("... (%d bytes)", len(b))
+		b = b[:limit]
+	}
+	if isPrintable(b) {
+		return fmt.Sprintf("%q%s", b, suffix)
+	}
+	return "0x" + hex.EncodeToString(b) + suffix
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if r < 0x20 && r != '\t' && r != '\n' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package mbbolt
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+// EventLogPollInterval is how often EventLog.Follow checks for new events even without a commit notification,
+// so a missed one (like an event written directly through the bbolt db) doesn't stall it.
+var EventLogPollInterval = time.Second
+
+// EventLog is an append-only log of T stored in a bucket, keyed by the big endian sequence returned by NextIndex,
+// so the events are stored in the order they were appended. Sequences start at 1.
+type EventLog[T any] struct {
+	db     *DB
+	bucket string
+}
+
+// NewEventLog returns the EventLog stored in bucket, which is created by the first Append.
+func NewEventLog[T any](db *DB, bucket string) *EventLog[T] {
+	return &EventLog[T]{db: db, bucket: bucket}
+}
+
+// Append stores v as the next event and returns its sequence.
+func (l *EventLog[T]) Append(v T) (seq uint64, err error) {
+	err = l.db.Update(func(tx *Tx) (err error) {
+		seq, err = l.AppendTx(tx, v)
+		return
+	})
+	return
+}
+
+// AppendTx is Append inside an existing write transaction.
+func (l *EventLog[T]) AppendTx(tx *Tx, v T) (seq uint64, err error) {
+	b, err := tx.db.marshalFn(v)
+	if err != nil {
+		return
+	}
+	if seq, err = tx.NextIndex(l.bucket); err != nil {
+		return
+	}
+	return seq, tx.PutBytesB(l.bucket, eventKey(seq), b)
+}
+
+// Read returns up to n events starting at the sequence from, all of them if n <= 0.
+func (l *EventLog[T]) Read(from uint64, n int) (out []T, err error) {
+	err = l.read(from, n, func(_ uint64, v T) error {
+		out = append(out, v)
+		return nil
+	})
+	return
+}
+
+func (l *EventLog[T]) read(from uint64, n int, fn func(seq uint64, v T) error) error {
+	return l.db.View(func(tx *Tx) error {
+		b := tx.Bucket(l.bucket)
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		read := 0
+		for k, v := c.Seek(eventKey(from)); k != nil && (n <= 0 || read < n); k, v = c.Next() {
+			if len(k) != 8 {
+				continue
+			}
+			raw, err := tx.db.decodeValue(l.bucket, k, v)
+			if err != nil {
+				return err
+			}
+			var ev T
+			if err = tx.db.unmarshalFn(raw, &ev); err != nil {
+				return err
+			}
+			if err = fn(binary.BigEndian.Uint64(k), ev); err != nil {
+				return err
+			}
+			read++
+		}
+		return nil
+	})
+}
+
+// Follow returns a channel that receives the events appended after the call, in order,
+// it's closed once ctx is done or reading an event fails.
+// Commits only signal that there's something new (see Watch), with a check every EventLogPollInterval in case one
+// is missed, and the events are read from the db in batches, so a slow reader doesn't block writers
+// or hold a transaction open. Use Read first to catch up on the existing events.
+func (l *EventLog[T]) Follow(ctx context.Context) <-chan T {
+	notify := make(chan struct{}, 1)
+	cancel := l.db.Watch(func(muts []Mutation) {
+		for _, m := range muts {
+			if m.Bucket == l.bucket && !m.Delete {
+				select {
+				case notify <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	})
+	next := l.db.CurrentIndex(l.bucket) + 1
+
+	ch := make(chan T)
+	go func() {
+		defer close(ch)
+		defer cancel()
+		t := time.NewTicker(EventLogPollInterval)
+		defer t.Stop()
+		var batch []seqEvent[T]
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-notify:
+			case <-t.C:
+			}
+			for {
+				batch = batch[:0]
+				if err := l.read(next, followBatchSize, func(seq uint64, v T) error {
+					batch = append(batch, seqEvent[T]{seq, v})
+					return nil
+				}); err != nil {
+					return
+				}
+				if len(batch) == 0 {
+					break
+				}
+				for _, ev := range batch {
+					select {
+					case ch <- ev.v:
+						next = ev.seq + 1
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}
+	}()
+	return ch
+}
+
+type seqEvent[T any] struct {
+	seq uint64
+	v   T
+}
+
+// followBatchSize is the number of events Follow reads per transaction.
+const followBatchSize = 1000
+
+func eventKey(seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, seq)
+}
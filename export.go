@@ -0,0 +1,51 @@
+package mbbolt
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/alpineiq/genh"
+)
+
+type (
+	Encoder interface {
+		Encode(v any) error
+	}
+
+	// NewEncoderFn creates the Encoder used by ExportBuckets, see JSONEncoder and MsgpackEncoder.
+	NewEncoderFn = func(w io.Writer) Encoder
+
+	// ExportRecord is a single record written by ExportBuckets,
+	// a record with Bucket set starts a bucket and is followed by that bucket's key / value records.
+	ExportRecord struct {
+		Bucket string `json:"bucket,omitempty" msgpack:"bucket,omitempty"`
+		Key    []byte `json:"key,omitempty" msgpack:"key,omitempty"`
+		Value  []byte `json:"value,omitempty" msgpack:"value,omitempty"`
+	}
+)
+
+func JSONEncoder(w io.Writer) Encoder    { return json.NewEncoder(w) }
+func MsgpackEncoder(w io.Writer) Encoder { return genh.NewMsgpackEncoder(w) }
+
+// ExportBuckets writes the contents of buckets to w from a single read transaction,
+// so the export is a consistent snapshot across all of them.
+// If newEnc is nil, JSONEncoder is used.
+func (db *DB) ExportBuckets(buckets []string, w io.Writer, newEnc NewEncoderFn) error {
+	if newEnc == nil {
+		newEnc = JSONEncoder
+	}
+	enc := newEnc(w)
+	return db.View(func(tx *Tx) error {
+		for _, bkt := range buckets {
+			if err := enc.Encode(&ExportRecord{Bucket: bkt}); err != nil {
+				return err
+			}
+			if err := tx.ForEachBytes(bkt, func(k, v []byte) error {
+				return enc.Encode(&ExportRecord{Key: k, Value: v})
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
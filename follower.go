@@ -0,0 +1,90 @@
+package mbbolt
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/alpineiq/oerrs"
+)
+
+const ErrAlreadyOpen = oerrs.String("db is already open for writing")
+
+// FollowerPollInterval is how often a follower opened by OpenFollower checks its file for changes.
+var FollowerPollInterval = time.Second
+
+// OpenFollower opens path read-only and reopens it every time its mtime or size changes,
+// so long-lived readers pick up a snapshot copied over the file.
+// The file should be replaced atomically (written next to it then renamed over it), a half copied file
+// fails to open and is retried on the next check, but one that happens to open would be served as is.
+// Transactions that are open when the file changes keep reading the old one, which is closed once they're done,
+// new ones use the new file right away.
+// Writes fail with ErrReadOnly, and the checks stop once the db is closed.
+// Like Open, calling it again for the same path returns the same *DB, which keeps a single poller.
+func OpenFollower(path string) (*DB, error) {
+	opts := DefaultOptions.Clone()
+	opts.ReadOnly = true
+	opts.InitialBuckets = nil
+
+	db, err := Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	if !db.opts.ReadOnly {
+		return nil, ErrAlreadyOpen
+	}
+	db.SetReadOnly(true)
+	if db.following.Swap(true) {
+		return db, nil
+	}
+
+	st, err := os.Stat(db.path)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	go db.follow(st, FollowerPollInterval)
+	return db, nil
+}
+
+func (db *DB) follow(last os.FileInfo, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		if db.closed.Load() {
+			return
+		}
+		st, err := os.Stat(db.path)
+		if err != nil || (st.ModTime().Equal(last.ModTime()) && st.Size() == last.Size()) {
+			continue
+		}
+		if err = db.reopen(); err != nil {
+			log.Printf("mbbolt: follower %s: %v", db.path, err)
+			continue
+		}
+		last = st
+	}
+}
+
+// reopen swaps the underlying bbolt db for a freshly opened one without waiting for open transactions,
+// the old one is closed by the last of them, see DB.acquire.
+func (db *DB) reopen() error {
+	// only read locked to keep Close and CompactInPlace out, transactions don't wait for it
+	db.compactMux.RLock()
+	defer db.compactMux.RUnlock()
+	if db.closed.Load() {
+		return nil
+	}
+
+	bdb, err := db.opts.openBolt(db.path)
+	if err != nil {
+		return err
+	}
+	old := db.h.Load()
+	bdb.MaxBatchDelay, bdb.MaxBatchSize = old.MaxBatchDelay, old.MaxBatchSize
+	if err = db.reloadBlooms(bdb, func() { db.h.Store(newBoltHandle(bdb)) }); err != nil {
+		bdb.Close()
+		return err
+	}
+	return old.unref()
+}
@@ -0,0 +1,141 @@
+package mbbolt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOpenFollower(t *testing.T) {
+	defer func(d time.Duration) { FollowerPollInterval = d }(FollowerPollInterval)
+	FollowerPollInterval = time.Millisecond * 10
+
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "follower.db")
+	snapshot := func(v string) {
+		src := filepath.Join(dir, "primary.db")
+		db, err := Open(src, nil)
+		dieIf(t, err)
+		dieIf(t, db.Put("b", "k", v))
+		dieIf(t, db.Close())
+		dieIf(t, os.Rename(src, fp))
+	}
+
+	snapshot("v1")
+	db, err := OpenFollower(fp)
+	dieIf(t, err)
+	defer db.Close()
+
+	get := func() (v string) {
+		dieIf(t, db.Get("b", "k", &v))
+		return
+	}
+	pollers := func() int {
+		buf := make([]byte, 1<<20)
+		return strings.Count(string(buf[:runtime.Stack(buf, true)]), "created by "+pkgPrefix+"OpenFollower")
+	}
+	n := pollers()
+	if db2, err := OpenFollower(fp); err != nil || db2 != db {
+		t.Fatalf("expected the same follower, got %p %v", db2, err)
+	}
+	if n2 := pollers(); n2 > n {
+		t.Fatalf("another poller was started: %d -> %d", n, n2)
+	}
+	if v := get(); v != "v1" {
+		t.Fatalf("expected v1, got %q", v)
+	}
+	if err := db.Put("b", "k", "x"); err != ErrReadOnly {
+		t.Fatalf("expected ErrReadOnly, got %v", err)
+	}
+
+	// a long read keeps the old file while new and nested reads pick up the new one without waiting for it
+	started, viewErr := make(chan struct{}), make(chan error, 1)
+	go func() {
+		viewErr <- db.View(func(tx *Tx) error {
+			close(started)
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond * 10) {
+				var v string
+				if err := db.Get("b", "k", &v); err != nil || v == "v2" {
+					break
+				}
+				if time.Now().After(deadline) {
+					return errors.New("nested read didn't pick up the new file")
+				}
+			}
+			if v := tx.GetBytes("b", "k", false); !bytes.Contains(v, []byte("v1")) {
+				return fmt.Errorf("open tx switched files: %q", v)
+			}
+			return nil
+		})
+	}()
+	<-started
+
+	snapshot("v2")
+	// make sure the mtime moves even on filesystems with a coarse resolution
+	future := time.Now().Add(time.Minute)
+	dieIf(t, os.Chtimes(fp, future, future))
+
+	for deadline := time.Now().Add(5 * time.Second); get() != "v2"; {
+		if time.Now().After(deadline) {
+			t.Fatal("follower didn't pick up the new file")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	dieIf(t, <-viewErr)
+
+	dieIf(t, db.Close())
+	db2, err := OpenFollower(fp)
+	dieIf(t, err)
+	defer db2.Close()
+	if db2 == db {
+		t.Fatal("closed follower was reused")
+	}
+}
+
+func TestFollowerBloom(t *testing.T) {
+	defer func(d time.Duration) { FollowerPollInterval = d }(FollowerPollInterval)
+	FollowerPollInterval = time.Millisecond * 10
+
+	dir := t.TempDir()
+	fp := filepath.Join(dir, "follower.db")
+	snapshot := func(keys ...string) {
+		src := filepath.Join(dir, "primary.db")
+		db, err := Open(src, nil)
+		dieIf(t, err)
+		for _, k := range keys {
+			dieIf(t, db.PutBytes("b", k, []byte(k)))
+		}
+		dieIf(t, db.Close())
+		dieIf(t, os.Rename(src, fp))
+	}
+
+	snapshot("old")
+	db, err := OpenFollower(fp)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.EnableBloom("b", 100))
+
+	snapshot("new")
+	future := time.Now().Add(time.Minute)
+	dieIf(t, os.Chtimes(fp, future, future))
+
+	// the rebuilt filter has the new file's keys and not the old one's
+	for deadline := time.Now().Add(5 * time.Second); !db.bloomMiss("b", []byte("old")); {
+		if time.Now().After(deadline) {
+			t.Fatal("the bloom filter wasn't rebuilt")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !db.Exists("b", "new") {
+		t.Fatal("the key from the new file is missing from the bloom filter")
+	}
+	if v, err := db.GetBytes("b", "new"); err != nil || string(v) != "new" {
+		t.Fatalf("unexpected %q %v", v, err)
+	}
+}
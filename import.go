@@ -0,0 +1,182 @@
+package mbbolt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+
+	"github.com/alpineiq/oerrs"
+)
+
+// DefaultBulkLoadChunkSize is the number of records BulkLoad applies per transaction if chunkSize <= 0.
+const DefaultBulkLoadChunkSize = 1000
+
+// BulkLoad puts every key / value pair yielded by seq into bucket in transactions of chunkSize records,
+// seq can be an iter.Seq2[[]byte, []byte] and is free to reuse the slices it yields.
+// On error, the chunks committed before it are kept and n is the number of records in them.
+func (db *DB) BulkLoad(bucket string, seq func(yield func(k, v []byte) bool), chunkSize int) (n int, err error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultBulkLoadChunkSize
+	}
+
+	chunk := make([][2][]byte, 0, chunkSize)
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := db.Update(func(tx *Tx) error {
+			for _, kv := range chunk {
+				if err := tx.PutBytesB(bucket, kv[0], kv[1]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		n += len(chunk)
+		chunk = chunk[:0]
+		return nil
+	}
+
+	seq(func(k, v []byte) bool {
+		chunk = append(chunk, [2][]byte{append([]byte(nil), k...), append([]byte(nil), v...)})
+		if len(chunk) == chunkSize {
+			err = flush()
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return
+}
+
+// BatchPutSorted puts kvs into bucket in a single transaction with the bucket's FillPercent set to 1,
+// so appending already sorted keys (e.g. time-series or log ingestion) leaves full pages rather than half empty ones.
+// kvs must be sorted by Key, which is only verified when built with the mbbolt_debug tag,
+// unsorted keys still get stored but the full pages will be split again by later inserts.
+func (db *DB) BatchPutSorted(bucket string, kvs []KV[[]byte]) error {
+	if debugChecks {
+		for i := 1; i < len(kvs); i++ {
+			if kvs[i-1].Key > kvs[i].Key {
+				log.Panicf("BatchPutSorted: %q > %q", kvs[i-1].Key, kvs[i].Key)
+			}
+		}
+	}
+	return db.Update(func(tx *Tx) error {
+		b := tx.MustBucket(bucket)
+		if b == nil {
+			return ErrBucketNotFound
+		}
+		b.FillPercent = 1
+		for _, kv := range kvs {
+			key := unsafeBytes(kv.Key)
+			if err := tx.db.checkSize(bucket, key, kv.Value); err != nil {
+				return err
+			}
+			if err := tx.put(b, bucket, key, kv.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ImportJSONL loads `{"k": "key", "v": <any json value>}` lines from r into bucket, v is stored as-is.
+// Malformed lines are skipped and returned in an *oerrs.ErrorList along with the number of imported lines.
+func ImportJSONL(db *DB, bucket string, r io.Reader) (n int, err error) {
+	var el oerrs.ErrorList
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20)
+	line := 0
+	n, err = db.BulkLoad(bucket, func(yield func(k, v []byte) bool) {
+		for sc.Scan() {
+			line++
+			b := bytes.TrimSpace(sc.Bytes())
+			if len(b) == 0 {
+				continue
+			}
+			var rec struct {
+				K string          `json:"k"`
+				V json.RawMessage `json:"v"`
+			}
+			if err := json.Unmarshal(b, &rec); err != nil {
+				el.Errorf("line %d: %v", line, err)
+				continue
+			}
+			if rec.K == "" || rec.V == nil {
+				el.Errorf("line %d: missing k or v", line)
+				continue
+			}
+			if !yield(unsafeBytes(rec.K), rec.V) {
+				return
+			}
+		}
+		el.PushIf(sc.Err())
+	}, 0)
+	el.PushIf(err)
+	return n, el.Err()
+}
+
+// ImportCSV loads the rows of r into bucket, the first row is the header, the key is the keyCol column
+// and the value is the row marshaled as a map of header -> column with the db's marshaler.
+// Malformed rows are skipped and returned in an *oerrs.ErrorList along with the number of imported rows,
+// any other read error stops the import and is added to the list.
+func ImportCSV(db *DB, bucket string, r io.Reader, keyCol int) (n int, err error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	hdr, err := cr.Read()
+	if err != nil {
+		return 0, err
+	}
+	hdr = append([]string(nil), hdr...)
+	if keyCol < 0 || keyCol >= len(hdr) {
+		return 0, oerrs.Errorf("invalid key column %d (%d columns)", keyCol, len(hdr))
+	}
+
+	var el oerrs.ErrorList
+	row := 1
+	n, err = db.BulkLoad(bucket, func(yield func(k, v []byte) bool) {
+		for {
+			rec, err := cr.Read()
+			if err == io.EOF {
+				return
+			}
+			row++
+			if err != nil {
+				var perr *csv.ParseError
+				if errors.As(err, &perr) {
+					el.Errorf("row %d: %v", row, err)
+					continue
+				}
+				// a failing reader keeps failing, stop instead of retrying it forever
+				el.PushIf(err)
+				return
+			}
+			if len(rec) != len(hdr) || rec[keyCol] == "" {
+				el.Errorf("row %d: expected %d columns and a key, got %d", row, len(hdr), len(rec))
+				continue
+			}
+			m := make(map[string]string, len(hdr))
+			for i, h := range hdr {
+				m[h] = rec[i]
+			}
+			v, err := db.marshalFn(m)
+			if err != nil {
+				el.Errorf("row %d: %v", row, err)
+				continue
+			}
+			if !yield(unsafeBytes(rec[keyCol]), v) {
+				return
+			}
+		}
+	}, 0)
+	el.PushIf(err)
+	return n, el.Err()
+}
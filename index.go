@@ -0,0 +1,110 @@
+package mbbolt
+
+// OrderedIndex keeps a secondary index of the values in bucket, ordered by encodeK(key(v)), in indexBucket,
+// it's only maintained for the writes done through it.
+// encodeK has to preserve the order of K (e.g. big endian ints), and if its output has a variable length,
+// no encoded key can be a prefix of another one, since the primary key is appended to it to allow duplicates.
+type OrderedIndex[T, K any] struct {
+	db          TypedDB[T]
+	bucket      string
+	indexBucket string
+	key         func(T) K
+	encodeK     func(K) []byte
+}
+
+func NewOrderedIndex[T, K any](db TypedDB[T], bucket, indexBucket string, key func(T) K, encodeK func(K) []byte) *OrderedIndex[T, K] {
+	return &OrderedIndex[T, K]{
+		db:          db,
+		bucket:      bucket,
+		indexBucket: indexBucket,
+		key:         key,
+		encodeK:     encodeK,
+	}
+}
+
+// Put stores v under pk and updates its index entry.
+func (idx *OrderedIndex[T, K]) Put(pk string, v T) error {
+	return idx.db.Update(func(tx *Tx) error {
+		return idx.PutTx(tx, pk, v)
+	})
+}
+
+// PutTx is Put inside an existing write transaction.
+func (idx *OrderedIndex[T, K]) PutTx(tx *Tx, pk string, v T) error {
+	if err := idx.deleteEntry(tx, pk); err != nil {
+		return err
+	}
+	if err := (TypedTx[T]{tx}).Put(idx.bucket, pk, v); err != nil {
+		return err
+	}
+	return tx.PutBytesB(idx.indexBucket, idx.entryKey(idx.key(v), pk), []byte(pk))
+}
+
+// Delete removes pk and its index entry.
+func (idx *OrderedIndex[T, K]) Delete(pk string) error {
+	return idx.db.Update(func(tx *Tx) error {
+		return idx.DeleteTx(tx, pk)
+	})
+}
+
+// DeleteTx is Delete inside an existing write transaction.
+func (idx *OrderedIndex[T, K]) DeleteTx(tx *Tx, pk string) error {
+	if err := idx.deleteEntry(tx, pk); err != nil {
+		return err
+	}
+	return tx.Delete(idx.bucket, pk)
+}
+
+// RangeByIndex returns the values with fromK <= key(v) <= toK, in index order,
+// values with the same index key are ordered by their primary key.
+func (idx *OrderedIndex[T, K]) RangeByIndex(fromK, toK K) (out []T, err error) {
+	err = idx.db.View(func(tx *Tx) error {
+		out, err = idx.RangeByIndexTx(tx, fromK, toK)
+		return err
+	})
+	return
+}
+
+// RangeByIndexTx is RangeByIndex inside an existing transaction.
+func (idx *OrderedIndex[T, K]) RangeByIndexTx(tx *Tx, fromK, toK K) (out []T, err error) {
+	b, err := tx.readBucket(idx.indexBucket)
+	if b == nil {
+		return nil, err
+	}
+
+	ttx := TypedTx[T]{tx}
+	opts := RangeOptions{Start: idx.encodeK(fromK), End: prefixEnd(idx.encodeK(toK))}
+	c := b.Cursor()
+	for k, pk := opts.seek(c); k != nil && opts.inRange(k); k, pk = opts.step(c) {
+		if pk, err = tx.db.decodeValue(idx.indexBucket, k, pk); err != nil {
+			return
+		}
+		var v T
+		if v, err = ttx.Get(idx.bucket, string(pk)); err != nil {
+			return
+		}
+		out = append(out, v)
+	}
+	return
+}
+
+// deleteEntry removes the index entry of the current value of pk, if there's one.
+func (idx *OrderedIndex[T, K]) deleteEntry(tx *Tx, pk string) error {
+	raw, err := tx.getBytes(idx.bucket, unsafeBytes(pk), false)
+	if err != nil || raw == nil {
+		return err
+	}
+	var old T
+	if err = tx.db.unmarshalFn(raw, &old); err != nil {
+		return err
+	}
+	// values written before the index existed don't have an entry
+	if err = tx.DeleteB(idx.indexBucket, idx.entryKey(idx.key(old), pk)); err == ErrBucketNotFound {
+		err = nil
+	}
+	return err
+}
+
+func (idx *OrderedIndex[T, K]) entryKey(k K, pk string) []byte {
+	return append(append([]byte(nil), idx.encodeK(k)...), pk...)
+}
@@ -0,0 +1,131 @@
+package mbbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+
+	"github.com/alpineiq/oerrs"
+)
+
+const ErrInvalidKey = oerrs.String("invalid composite key")
+
+// EncodeKey encodes parts into an order-preserving composite key, encoded keys sort the same as their tuples.
+// Supported parts are strings, []byte and integers, integers are encoded as 8 byte big endian
+// (with the sign bit flipped for signed ones) so they sort numerically.
+// Each part has its 0x00 bytes escaped as 0x00 0xff and ends with 0x00 0x01.
+func EncodeKey(parts ...any) []byte {
+	return AppendKey(nil, parts...)
+}
+
+// AppendKey is like EncodeKey but appends to dst.
+func AppendKey(dst []byte, parts ...any) []byte {
+	var num [8]byte
+	for _, p := range parts {
+		var b []byte
+		switch p := p.(type) {
+		case string:
+			b = unsafeBytes(p)
+		case []byte:
+			b = p
+		case int:
+			b = encodeInt(num[:], int64(p))
+		case int8:
+			b = encodeInt(num[:], int64(p))
+		case int16:
+			b = encodeInt(num[:], int64(p))
+		case int32:
+			b = encodeInt(num[:], int64(p))
+		case int64:
+			b = encodeInt(num[:], p)
+		case uint:
+			b = encodeUint(num[:], uint64(p))
+		case uint8:
+			b = encodeUint(num[:], uint64(p))
+		case uint16:
+			b = encodeUint(num[:], uint64(p))
+		case uint32:
+			b = encodeUint(num[:], uint64(p))
+		case uint64:
+			b = encodeUint(num[:], p)
+		default:
+			log.Panicf("EncodeKey: unsupported type %T", p)
+		}
+
+		for _, c := range b {
+			if dst = append(dst, c); c == 0 {
+				dst = append(dst, 0xff)
+			}
+		}
+		dst = append(dst, 0, 1)
+	}
+	return dst
+}
+
+// DecodeKey splits a key created by EncodeKey into its unescaped parts,
+// integer parts can be read back with KeyPartInt / KeyPartUint.
+func DecodeKey(key []byte) (parts [][]byte, err error) {
+	var part []byte
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c != 0 {
+			part = append(part, c)
+			continue
+		}
+		if i++; i == len(key) {
+			return nil, ErrInvalidKey
+		}
+		switch key[i] {
+		case 0xff:
+			part = append(part, 0)
+		case 1:
+			parts = append(parts, part)
+			part = nil
+		default:
+			return nil, ErrInvalidKey
+		}
+	}
+	if part != nil {
+		return nil, ErrInvalidKey
+	}
+	return
+}
+
+// KeyPartInt decodes a signed integer part returned by DecodeKey.
+func KeyPartInt(p []byte) (int64, error) {
+	u, err := KeyPartUint(p)
+	return int64(u ^ 1<<63), err
+}
+
+// KeyPartUint decodes an unsigned integer part returned by DecodeKey.
+func KeyPartUint(p []byte) (uint64, error) {
+	if len(p) != 8 {
+		return 0, ErrInvalidKey
+	}
+	return binary.BigEndian.Uint64(p), nil
+}
+
+// ForEachPrefixKey calls fn for every key in the bucket that starts with the given parts, see EncodeKey.
+func (tx *Tx) ForEachPrefixKey(bucket string, fn func(k, v []byte) error, parts ...any) error {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return err
+	}
+	prefix := EncodeKey(parts...)
+	fn = tx.decodeFn(bucket, fn)
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeInt(buf []byte, v int64) []byte {
+	return encodeUint(buf, uint64(v)^1<<63)
+}
+
+func encodeUint(buf []byte, v uint64) []byte {
+	binary.BigEndian.PutUint64(buf, v)
+	return buf
+}
@@ -0,0 +1,81 @@
+package mbbolt
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+)
+
+func TestCompositeKeys(t *testing.T) {
+	// tuples in their logical order
+	tuples := [][]any{
+		{"a", -5},
+		{"a", 0},
+		{"a", 3},
+		{"a", 300},
+		{"a\x00", -1},
+		{"a\x00b", 1},
+		{"ab", 1},
+		{"b", 1},
+		{"b", 1 << 62, "x"},
+	}
+
+	keys := make([][]byte, len(tuples))
+	for i, tp := range tuples {
+		keys[i] = EncodeKey(tp...)
+	}
+	sorted := append([][]byte(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+	for i := range keys {
+		if !bytes.Equal(keys[i], sorted[i]) {
+			t.Fatalf("%d: encoded keys don't sort like their tuples: %v", i, tuples[i])
+		}
+	}
+
+	parts, err := DecodeKey(keys[5])
+	dieIf(t, err)
+	if len(parts) != 2 || string(parts[0]) != "a\x00b" {
+		t.Fatalf("unexpected parts: %q", parts)
+	}
+	if n, err := KeyPartInt(parts[1]); err != nil || n != 1 {
+		t.Fatalf("unexpected int: %v %v", n, err)
+	}
+	if _, err := DecodeKey([]byte("a\x00")); err != ErrInvalidKey {
+		t.Fatalf("expected ErrInvalidKey, got %v", err)
+	}
+
+	db, err := Open(t.TempDir()+"/x.db", nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i, k := range keys {
+			if err := tx.PutBytesB("b", k, []byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	for _, tc := range []struct {
+		parts []any
+		count int
+	}{
+		{[]any{"a"}, 4},
+		{[]any{"a\x00"}, 1},
+		{[]any{"b"}, 2},
+		{[]any{"b", 1}, 1},
+		{[]any{"c"}, 0},
+		{nil, len(keys)},
+	} {
+		var n int
+		dieIf(t, db.View(func(tx *Tx) error {
+			return tx.ForEachPrefixKey("b", func(k, v []byte) error {
+				n++
+				return nil
+			}, tc.parts...)
+		}))
+		if n != tc.count {
+			t.Fatalf("%q: expected %d keys, got %d", tc.parts, tc.count, n)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package mbbolt
+
+import (
+	"fmt"
+
+	"go.etcd.io/bbolt"
+)
+
+// KeyTooLargeError is returned by puts when the key is larger than Options.MaxKeySize.
+type KeyTooLargeError struct {
+	Bucket string
+	Size   int
+	Max    int
+}
+
+func (e *KeyTooLargeError) Error() string {
+	return fmt.Sprintf("mbbolt: key in %s is too large (%d > %d bytes)", e.Bucket, e.Size, e.Max)
+}
+
+// ValueTooLargeError is returned by puts when the value is larger than Options.MaxValueSize.
+type ValueTooLargeError struct {
+	Bucket string
+	Key    string
+	Size   int
+	Max    int
+}
+
+func (e *ValueTooLargeError) Error() string {
+	return fmt.Sprintf("mbbolt: value of %s::%q is too large (%d > %d bytes)", e.Bucket, e.Key, e.Size, e.Max)
+}
+
+func (db *DB) checkSize(bucket string, key, val []byte) error {
+	if max := db.maxKeySize; len(key) > max {
+		return &KeyTooLargeError{Bucket: bucket, Size: len(key), Max: max}
+	}
+	if max := db.maxValueSize; len(val) > max {
+		return &ValueTooLargeError{Bucket: bucket, Key: string(key), Size: len(val), Max: max}
+	}
+	return nil
+}
+
+func sizeLimit(v, def int) int {
+	if v <= 0 || v > def {
+		return def
+	}
+	return v
+}
+
+const (
+	boltMaxKeySize   = bbolt.MaxKeySize
+	boltMaxValueSize = bbolt.MaxValueSize - checksumHeaderLen // leave room for the checksum header
+)
@@ -0,0 +1,73 @@
+package mbbolt
+
+import "time"
+
+// MeteredObserver is called by a metered DBer after every call with the method name, how long it took and its error.
+type MeteredObserver = func(op string, d time.Duration, err error)
+
+// NewMeteredDB wraps d so every DBer method call is timed and reported to observer, it also forwards UseBatch
+// if d supports it, so ConvertDB still disables batching through it.
+func NewMeteredDB(d DBer, observer MeteredObserver) DBer {
+	return &meteredDB{d: d, obs: observer}
+}
+
+type meteredDB struct {
+	d   DBer
+	obs MeteredObserver
+}
+
+var (
+	_ DBer    = (*meteredDB)(nil)
+	_ batcher = (*meteredDB)(nil)
+)
+
+func (m *meteredDB) observe(op string, start time.Time, err error) {
+	m.obs(op, time.Since(start), err)
+}
+
+func (m *meteredDB) CurrentIndex(bucket string) uint64 {
+	defer m.observe("CurrentIndex", time.Now(), nil)
+	return m.d.CurrentIndex(bucket)
+}
+
+func (m *meteredDB) NextIndex(bucket string) (idx uint64, err error) {
+	defer func(start time.Time) { m.observe("NextIndex", start, err) }(time.Now())
+	return m.d.NextIndex(bucket)
+}
+
+func (m *meteredDB) SetNextIndex(bucket string, index uint64) (err error) {
+	defer func(start time.Time) { m.observe("SetNextIndex", start, err) }(time.Now())
+	return m.d.SetNextIndex(bucket, index)
+}
+
+func (m *meteredDB) Buckets() []string {
+	defer m.observe("Buckets", time.Now(), nil)
+	return m.d.Buckets()
+}
+
+func (m *meteredDB) Get(bucket, key string, v any) (err error) {
+	defer func(start time.Time) { m.observe("Get", start, err) }(time.Now())
+	return m.d.Get(bucket, key, v)
+}
+
+func (m *meteredDB) ForEachBytes(bucket string, fn func(k, v []byte) error) (err error) {
+	defer func(start time.Time) { m.observe("ForEachBytes", start, err) }(time.Now())
+	return m.d.ForEachBytes(bucket, fn)
+}
+
+func (m *meteredDB) Put(bucket, key string, v any) (err error) {
+	defer func(start time.Time) { m.observe("Put", start, err) }(time.Now())
+	return m.d.Put(bucket, key, v)
+}
+
+func (m *meteredDB) Delete(bucket, key string) (err error) {
+	defer func(start time.Time) { m.observe("Delete", start, err) }(time.Now())
+	return m.d.Delete(bucket, key)
+}
+
+func (m *meteredDB) UseBatch(v bool) bool {
+	if b, ok := m.d.(batcher); ok {
+		return b.UseBatch(v)
+	}
+	return false
+}
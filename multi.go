@@ -2,13 +2,18 @@ package mbbolt
 
 import (
 	"archive/zip"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"go.etcd.io/bbolt"
@@ -22,6 +27,7 @@ type (
 
 	Bucket  = bbolt.Bucket
 	Cursor  = bbolt.Cursor
+	Stats   = bbolt.Stats
 	TxStats = bbolt.TxStats
 
 	OnSlowUpdateFn func(callers *runtime.Frames, took time.Duration)
@@ -38,19 +44,66 @@ var DefaultOptions = &Options{
 
 	// syscall.MAP_POPULATE on linux 2.6.23+ does sequential read-ahead
 	// which can speed up entire-database read with boltdb.
-	MmapFlags: DefaultMMapFlags,
+	PrefetchOnOpen:  true,
+	PrefetchMaxSize: 1 << 30, // 1GiB
+
+	OpenRetries:    3,
+	OpenRetryDelay: time.Millisecond * 10,
 
 	InitialMmapSize: 1 << 29, // 512MiB
 }
 
+// Workload is a named workload profile used by RecommendedOptions.
+type Workload uint8
+
+const (
+	WorkloadDefault Workload = iota
+	// WorkloadWriteHeavy favors many small concurrent writes, it relies on batching to coalesce commits.
+	WorkloadWriteHeavy
+	// WorkloadReadHeavy favors reads, the file is populated on open and a larger mmap avoids remapping.
+	WorkloadReadHeavy
+	// WorkloadBulkLoad is meant for one-off imports, fsync is disabled so the db must be closed cleanly
+	// (or the data re-imported) after a crash.
+	WorkloadBulkLoad
+)
+
+// RecommendedOptions returns a copy of DefaultOptions tuned for the given workload.
+func RecommendedOptions(workload Workload) *Options {
+	opts := DefaultOptions.Clone()
+	switch workload {
+	case WorkloadWriteHeavy:
+		opts.NoFreelistSync = true
+		opts.FreelistType = bbolt.FreelistMapType
+		opts.MaxBatchSize = 1024
+		opts.MaxBatchDelay = time.Millisecond * 5
+	case WorkloadReadHeavy:
+		opts.PrefetchOnOpen = true
+		opts.PrefetchMaxSize = 0
+		opts.InitialMmapSize = 1 << 30 // 1GiB
+	case WorkloadBulkLoad:
+		opts.NoSync = true
+		opts.NoGrowSync = true
+		opts.NoFreelistSync = true
+		opts.FreelistType = bbolt.FreelistMapType
+		opts.MaxBatchSize = 4096
+	}
+	return opts
+}
+
 type Options struct {
 	// OpenFile is used to open files. It defaults to os.OpenFile. This option
 	// is useful for writing hermetic tests.
 	OpenFile func(string, int, os.FileMode) (*os.File, error)
 
-	// InitDB gets called on initial db open
+	// InitDB gets called every time the db file is opened, right after the marshalers are set
+	// and before InitialBuckets are created, so it can still change options that affect them.
 	InitDB func(db *DB) error
 
+	// OnOpen gets called every time the db file is opened, once it's fully ready (after InitDB and InitialBuckets),
+	// and before it's returned to any MultiDB.Get caller. It can be used to rebuild in-memory indexes or warm caches,
+	// it must not call back into the MultiDB. If it fails the db is closed and Get returns its error.
+	OnOpen func(db *DB) error
+
 	// FreelistType sets the backend freelist type. There are two options. Array which is simple but endures
 	// dramatic performance degradation if database is large and framentation in freelist is common.
 	// The alternative one is using hashmap, it is faster in almost all circumstances
@@ -58,12 +111,22 @@ type Options struct {
 	// The default type is array
 	FreelistType bbolt.FreelistType
 
-	// InitialBuckets will create the given slice of buckets on initial db open
+	// InitialBuckets will create the given slice of buckets on initial db open, after InitDB is called
 	InitialBuckets []string
 
 	// Sets the DB.MmapFlags flag before memory mapping the file.
 	MmapFlags int
 
+	// PrefetchOnOpen adds DefaultMMapFlags (MAP_POPULATE on linux) to MmapFlags,
+	// reading the whole file into the page cache on open.
+	PrefetchOnOpen bool
+
+	// PrefetchMaxSize disables the prefetch for files larger than it, since populating
+	// a huge file that only needs a few pages makes opening it very slow.
+	//
+	// If <=0, there's no limit.
+	PrefetchMaxSize int64
+
 	// InitialMmapSize is the initial mmap size of the database
 	// in bytes. Read transactions won't block write transaction
 	// if the InitialMmapSize is large enough to hold database mmap
@@ -115,8 +178,62 @@ type Options struct {
 	// If <=0, effectively disables batching.
 	MaxBatchDelay time.Duration
 
+	// VerifyChecksums stores a checksum with every written value and validates it on read,
+	// returning a *ChecksumError if it doesn't match.
+	// Values written without it are still readable, and values written with it are unreadable without it.
+	VerifyChecksums bool
+
+	// AutoCreateBuckets makes reads treat missing buckets as empty ones, getting a value returns ErrKeyNotFound
+	// instead of ErrBucketNotFound and iterating is a no-op. Writes always create missing buckets.
+	AutoCreateBuckets bool
+
+	// RawStrings stores string values as their raw bytes instead of marshaling them, and reads them back
+	// the same way into a *string. Strings written without it are quoted by the marshaler, so don't flip it on existing data.
+	RawStrings bool
+
+	// TrackValueSizes keeps a histogram of the sizes of the values written and read, see DB.ValueSizeHistogram.
+	TrackValueSizes bool
+
+	// MaxKeySize and MaxValueSize make puts fail early with a *KeyTooLargeError / *ValueTooLargeError,
+	// if <=0 or larger than what bbolt supports, bbolt's limits are used.
+	MaxKeySize   int
+	MaxValueSize int
+
+	// InsertionOrderBuckets lists the buckets that keep track of the order their keys were inserted in,
+	// see Tx.ForEachInsertionOrder. The order is stored in a "<bucket>__order" bucket.
+	InsertionOrderBuckets []string
+
 	MarshalFn   MarshalFn
 	UnmarshalFn UnmarshalFn
+
+	// FallbackUnmarshalFns are tried in order by TypedDB.GetAuto if UnmarshalFn fails,
+	// if nil, DefaultFallbackUnmarshalFns is used.
+	FallbackUnmarshalFns []UnmarshalFn
+
+	// OpenRetries is how many times opening a db is retried if it fails with one of TransientErrors,
+	// the delay between retries starts at OpenRetryDelay and doubles every time.
+	OpenRetries    int
+	OpenRetryDelay time.Duration
+
+	// TransientErrors are the errors (checked with errors.Is) that are retried by OpenRetries,
+	// if nil, DefaultTransientErrors is used.
+	TransientErrors []error
+
+	// RepairOnOpen checks the freelist of a db before opening it, if it's corrupt (bbolt would panic loading it),
+	// the data is copied into a fresh file that replaces the db. It's what you'd do by hand after an unclean shutdown.
+	RepairOnOpen bool
+
+	// RecoverPanics makes View / Update / Batch (and ViewTimeout) recover from a panicking callback,
+	// roll back the transaction and return a *PanicError with the stack instead.
+	RecoverPanics bool
+
+	// TrackCallers makes Update and Batch record their latency per calling function, see DB.CallerStats.
+	// It costs a stack walk and a global lock per write, so it's off by default.
+	TrackCallers bool
+
+	// BoltOptionsFn is called with the result of BoltOpts, it allows setting any bbolt option
+	// that doesn't have a matching field here.
+	BoltOptionsFn func(*bbolt.Options)
 }
 
 func (opts *Options) Clone() *Options {
@@ -131,7 +248,7 @@ func (opts *Options) BoltOpts() *bbolt.Options {
 	if opts == nil {
 		opts = DefaultOptions
 	}
-	return &bbolt.Options{
+	bo := &bbolt.Options{
 		Timeout:         opts.Timeout,
 		NoGrowSync:      opts.NoGrowSync,
 		NoFreelistSync:  opts.NoFreelistSync,
@@ -144,6 +261,63 @@ func (opts *Options) BoltOpts() *bbolt.Options {
 		OpenFile:        opts.OpenFile,
 		Mlock:           opts.Mlock,
 	}
+	if opts.PrefetchOnOpen {
+		bo.MmapFlags |= DefaultMMapFlags
+	}
+	if opts.BoltOptionsFn != nil {
+		opts.BoltOptionsFn(bo)
+	}
+	return bo
+}
+
+// boltOptsFor returns BoltOpts with the prefetch flag dropped if fp is larger than PrefetchMaxSize.
+func (opts *Options) boltOptsFor(fp string) *bbolt.Options {
+	bo := opts.BoltOpts()
+	if opts == nil {
+		opts = DefaultOptions
+	}
+	if opts.PrefetchMaxSize > 0 && bo.MmapFlags&DefaultMMapFlags != 0 {
+		if st, err := os.Stat(fp); err == nil && st.Size() > opts.PrefetchMaxSize {
+			bo.MmapFlags &^= DefaultMMapFlags
+		}
+	}
+	return bo
+}
+
+// DefaultTransientErrors are the open errors retried if Options.TransientErrors isn't set.
+var DefaultTransientErrors = []error{syscall.EAGAIN, syscall.EINTR, syscall.EMFILE, syscall.ENFILE}
+
+// openBolt opens fp, retrying transient errors according to opts.
+func (opts *Options) openBolt(fp string) (bdb *BBoltDB, err error) {
+	if opts.RepairOnOpen && !opts.ReadOnly {
+		if err = checkFreelist(fp); err != nil {
+			if rerr := opts.repairBolt(fp); rerr != nil {
+				return nil, oerrs.Errorf("%w: %v", err, rerr)
+			}
+		}
+	}
+
+	delay := opts.OpenRetryDelay
+	for i := 0; ; i++ {
+		if bdb, err = bbolt.Open(fp, 0o600, opts.boltOptsFor(fp)); err == nil || i >= opts.OpenRetries || !opts.isTransient(err) {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func (opts *Options) isTransient(err error) bool {
+	errs := opts.TransientErrors
+	if errs == nil {
+		errs = DefaultTransientErrors
+	}
+	for _, e := range errs {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
 }
 
 var all struct {
@@ -159,7 +333,7 @@ func Open(path string, opts *Options) (*DB, error) {
 		opts = DefaultOptions
 	}
 
-	return all.Get(path, opts)
+	return all.Get(absPath(path), opts)
 }
 
 func MustOpen(path string, opts *Options) *DB {
@@ -167,7 +341,15 @@ func MustOpen(path string, opts *Options) *DB {
 		opts = DefaultOptions
 	}
 
-	return all.MustGet(path, opts)
+	return all.MustGet(absPath(path), opts)
+}
+
+// absPath makes sure different spellings of the same path share the same *DB.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
 }
 
 func CloseAll() error {
@@ -195,11 +377,14 @@ func NewMultiDB(prefix, ext string, opts *Options) *MultiDB {
 }
 
 type MultiDB struct {
-	mux    sync.RWMutex
-	m      map[string]*DB
-	opts   *Options
-	prefix string
-	ext    string
+	mux     sync.RWMutex
+	m       map[string]*DB
+	opening map[string]chan struct{} // closed once the in-flight open of that name is done
+	opts    *Options
+	prefix  string
+	ext     string
+
+	watches mdbWatches
 }
 
 func (mdb *MultiDB) MustGet(name string, opts *Options) *DB {
@@ -210,7 +395,9 @@ func (mdb *MultiDB) MustGet(name string, opts *Options) *DB {
 	return db
 }
 
+// Get returns the already opened db or opens it, name is cleaned so "a/../b" and "b" return the same *DB.
 func (mdb *MultiDB) Get(name string, opts *Options) (db *DB, err error) {
+	name = filepath.Clean(name)
 	fp := mdb.getPath(name)
 	os.MkdirAll(filepath.Dir(fp), 0o755)
 
@@ -221,34 +408,40 @@ func (mdb *MultiDB) Get(name string, opts *Options) (db *DB, err error) {
 	}
 	mdb.mux.RUnlock()
 
+	// only one goroutine opens a given file, the others wait for it and pick up its db,
+	// so a lock timeout can only come from another process (or another MultiDB) holding the file.
+	done, db := mdb.startOpen(name)
+	if db != nil {
+		return
+	}
+	defer done()
+	return mdb.open(name, fp, opts)
+}
+
+// open opens fp and adds it to mdb.m as name, the caller must have claimed name with startOpen.
+func (mdb *MultiDB) open(name, fp string, opts *Options) (db *DB, err error) {
 	if opts == nil {
 		opts = mdb.opts
 	}
 
 	var bdb *BBoltDB
-	if bdb, err = bbolt.Open(fp, 0o600, opts.BoltOpts()); err != nil && err != bbolt.ErrTimeout {
-		return
-	}
-
-	if err == bbolt.ErrTimeout {
-		err = nil
-		for db == nil {
-			mdb.mux.RLock()
-			db = mdb.m[name]
-			mdb.mux.RUnlock()
-			time.Sleep(time.Millisecond * 10)
+	if bdb, err = opts.openBolt(fp); err != nil {
+		if err == bbolt.ErrTimeout {
+			err = oerrs.Errorf("%w (%s)", ErrLockedByAnotherProcess, fp)
 		}
 		return
 	}
+	// the file stays locked until it's closed, so a failed open must close it or the next Get times out on the lock
+	defer func() {
+		if err != nil {
+			bdb.Close()
+			db = nil
+		}
+	}()
 
 	mdb.mux.Lock()
 	defer mdb.mux.Unlock()
 
-	// race check
-	if db = mdb.m[name]; db != nil {
-		return
-	}
-
 	if opts.MaxBatchDelay > 0 {
 		bdb.MaxBatchDelay = opts.MaxBatchDelay
 	}
@@ -258,18 +451,44 @@ func (mdb *MultiDB) Get(name string, opts *Options) (db *DB, err error) {
 	}
 
 	db = &DB{
-		b: bdb,
+		path: fp,
+		opts: opts,
+
+		checksums:   opts.VerifyChecksums,
+		autoBuckets: opts.AutoCreateBuckets,
+		rawStrings:  opts.RawStrings,
+
+		recoverPanics: opts.RecoverPanics,
+		trackCallers:  opts.TrackCallers,
+
+		maxKeySize:   sizeLimit(opts.MaxKeySize, boltMaxKeySize),
+		maxValueSize: sizeLimit(opts.MaxValueSize, boltMaxValueSize),
+	}
+	db.h.Store(newBoltHandle(bdb))
+
+	if opts.TrackValueSizes {
+		db.valueSizes = &valueSizes{}
+	}
 
-		marshalFn:   DefaultMarshalFn,
-		unmarshalFn: DefaultUnmarshalFn,
+	for _, bkt := range opts.InsertionOrderBuckets {
+		if db.orderBuckets == nil {
+			db.orderBuckets = map[string]bool{}
+		}
+		db.orderBuckets[bkt] = true
 	}
 
+	m := &marshaler{DefaultMarshalFn, DefaultUnmarshalFn}
 	if opts.MarshalFn != nil {
-		db.marshalFn = opts.MarshalFn
+		m.marshal = opts.MarshalFn
 	}
 
 	if opts.UnmarshalFn != nil {
-		db.unmarshalFn = opts.UnmarshalFn
+		m.unmarshal = opts.UnmarshalFn
+	}
+	db.codec.Store(m)
+
+	if db.fallbackUnmarshalFns = opts.FallbackUnmarshalFns; db.fallbackUnmarshalFns == nil {
+		db.fallbackUnmarshalFns = DefaultFallbackUnmarshalFns
 	}
 
 	if opts.InitDB != nil {
@@ -291,21 +510,61 @@ func (mdb *MultiDB) Get(name string, opts *Options) (db *DB, err error) {
 		}
 	}
 
+	if opts.OnOpen != nil {
+		if err = opts.OnOpen(db); err != nil {
+			return
+		}
+	}
+
 	if mdb.m == nil {
 		mdb.m = map[string]*DB{}
 	}
 
 	mdb.m[name] = db
+	mdb.hookDB(name, db)
 
 	db.onClose = func() {
 		mdb.mux.Lock()
-		delete(mdb.m, name)
+		if mdb.m[name] == db {
+			delete(mdb.m, name)
+		}
 		mdb.mux.Unlock()
+		mdb.unhookDB(db)
 	}
 
 	return
 }
 
+// startOpen marks name as being opened by the caller, who must call done once it's either in mdb.m or failed.
+// If another goroutine is already opening it, startOpen waits for it and returns its db,
+// or retries if that open failed.
+func (mdb *MultiDB) startOpen(name string) (done func(), db *DB) {
+	for {
+		mdb.mux.Lock()
+		if db = mdb.m[name]; db != nil {
+			mdb.mux.Unlock()
+			return nil, db
+		}
+		wait := mdb.opening[name]
+		if wait == nil {
+			ch := make(chan struct{})
+			if mdb.opening == nil {
+				mdb.opening = map[string]chan struct{}{}
+			}
+			mdb.opening[name] = ch
+			mdb.mux.Unlock()
+			return func() {
+				mdb.mux.Lock()
+				delete(mdb.opening, name)
+				mdb.mux.Unlock()
+				close(ch)
+			}, nil
+		}
+		mdb.mux.Unlock()
+		<-wait
+	}
+}
+
 func (mdb *MultiDB) ForEachDB(fn func(name string, db *DB) error) error {
 	mdb.mux.RLock()
 	dbNames := make([]string, 0, len(mdb.m))
@@ -327,11 +586,94 @@ func (mdb *MultiDB) ForEachDB(fn func(name string, db *DB) error) error {
 }
 
 func (mdb *MultiDB) CloseDB(name string) (err error) {
+	name = filepath.Clean(name)
 	mdb.mux.Lock()
-	defer mdb.mux.Unlock()
-	if db := mdb.m[name]; db != nil {
-		err = db.b.Close()
-		delete(mdb.m, name)
+	db := mdb.m[name]
+	delete(mdb.m, name)
+	mdb.mux.Unlock()
+	if db == nil {
+		return
+	}
+	mdb.unhookDB(db)
+	return db.close(false)
+}
+
+// ErrDBExists is returned by MultiDB.Adopt if there's already a db with the same name.
+const ErrDBExists = oerrs.String("db already exists")
+
+// ErrLockedByAnotherProcess is returned by Open / MultiDB.Get when the file lock couldn't be obtained within
+// Options.Timeout because another process (or an unrelated MultiDB in this one) has the file open,
+// bolt doesn't allow even a read-only open while it's held for writing. Callers can back off and retry.
+const ErrLockedByAnotherProcess = oerrs.String("db is locked by another process")
+
+// Adopt validates the bolt file at srcPath, places it where name is stored (renaming it if move is set, copying it otherwise)
+// and opens it with the MultiDB's options.
+// Name is claimed for the whole call, so concurrent Gets wait for the adopted db instead of creating an empty one.
+func (mdb *MultiDB) Adopt(name, srcPath string, move bool) (db *DB, err error) {
+	name = filepath.Clean(name)
+	fp := mdb.getPath(name)
+
+	done, db := mdb.startOpen(name)
+	if db != nil {
+		return nil, ErrDBExists
+	}
+	defer done()
+	if _, err = os.Stat(fp); err == nil {
+		return nil, ErrDBExists
+	}
+
+	if err = checkBoltFile(srcPath); err != nil {
+		return
+	}
+
+	os.MkdirAll(filepath.Dir(fp), 0o755)
+	if move {
+		err = os.Rename(srcPath, fp)
+	} else {
+		err = copyFile(fp, srcPath)
+	}
+	if err != nil {
+		return
+	}
+	return mdb.open(name, fp, nil)
+}
+
+// checkBoltFile returns an error if fp isn't a valid bolt file, without modifying it.
+func checkBoltFile(fp string) error {
+	if err := checkFreelist(fp); err != nil {
+		return err
+	}
+	bdb, err := bbolt.Open(fp, 0o600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return oerrs.Errorf("%s: %w", fp, err)
+	}
+	return bdb.Close()
+}
+
+// copyFile copies src to a temp file next to dst and renames it, so dst never exists half written.
+func copyFile(dst, src string) (err error) {
+	sf, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer sf.Close()
+
+	tmp := dst + ".tmp"
+	df, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(df, sf); err == nil {
+		err = df.Sync()
+	}
+	if err2 := df.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
 	}
 	return
 }
@@ -364,7 +706,40 @@ func (mdb *MultiDB) BackupToDir(dir string, filter func(name string, db *DB) boo
 		}
 		n += n2
 	}
-	return 0, nil
+	return n, nil
+}
+
+// backupStampFile is the file in a backup dir holding the time BackupToDirIncremental last started.
+const backupStampFile = ".mbbolt-backup"
+
+// BackupToDirIncremental is BackupToDir but skips the dbs whose file wasn't modified after since and that already
+// have a backup in dir, it's a cheap file level check so a db that was only read is skipped too.
+// Once done it records the time it started in dir, see LastBackupTime, so passing that as since on the next run
+// only backs up what changed in between.
+func (mdb *MultiDB) BackupToDirIncremental(dir string, since time.Time) (n int64, err error) {
+	start := time.Now()
+	if n, err = mdb.BackupToDir(dir, func(name string, db *DB) bool {
+		st, err := os.Stat(db.Path())
+		if err != nil || st.ModTime().After(since) {
+			return true
+		}
+		_, err = os.Stat(filepath.Join(dir, name+mdb.ext))
+		return err != nil
+	}); err != nil {
+		return
+	}
+	err = os.WriteFile(filepath.Join(dir, backupStampFile), []byte(start.Format(time.RFC3339Nano)), 0o644)
+	return
+}
+
+// LastBackupTime returns the time recorded by the last BackupToDirIncremental to dir, or the zero time if there's none.
+func LastBackupTime(dir string) time.Time {
+	b, err := os.ReadFile(filepath.Join(dir, backupStampFile))
+	if err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, string(b))
+	return t
 }
 
 func (mdb *MultiDB) BackupToFile(fp string, filter func(name string, db *DB) bool) (n int64, err error) {
@@ -420,7 +795,123 @@ func (mdb *MultiDB) Backup(w io.Writer, filter func(name string, db *DB) bool) (
 		}
 		n += n2
 	}
-	return 0, nil
+	return n, nil
+}
+
+// Restore reads a zip written by Backup, every db in it (an entry named name+ext) is written to its path
+// and opened, then the number of restored dbs is returned.
+// Unless overwrite is set nothing is restored if any of the dbs is already open or exists on disk,
+// and the error lists them. Otherwise the open ones are closed and replaced,
+// so they shouldn't be used while they're being restored.
+// Every db is extracted and validated before any of them is replaced, so a bad entry leaves them all untouched.
+// Swapping them in isn't atomic though, if closing, renaming or reopening one fails the error lists the ones
+// that were already replaced.
+func (mdb *MultiDB) Restore(r io.Reader, overwrite bool) (n int, err error) {
+	// zip needs random access, spool it to disk rather than to memory
+	tmp, err := os.CreateTemp("", "mbbolt-restore-*.zip")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return
+	}
+	z, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return
+	}
+
+	names := map[string]*zip.File{}
+	var conflicts []string
+	for _, zf := range z.File {
+		zn := path.Clean(zf.Name)
+		if zf.FileInfo().IsDir() || !strings.HasSuffix(zn, mdb.ext) {
+			continue
+		}
+		if path.IsAbs(zn) || zn == ".." || strings.HasPrefix(zn, "../") {
+			return 0, oerrs.Errorf("restore: invalid entry %q", zf.Name)
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(zn, mdb.ext))
+		names[name] = zf
+
+		mdb.mux.RLock()
+		db := mdb.m[name]
+		mdb.mux.RUnlock()
+		if _, serr := os.Stat(mdb.getPath(name)); db != nil || serr == nil {
+			conflicts = append(conflicts, name)
+		}
+	}
+	if len(conflicts) > 0 && !overwrite {
+		sort.Strings(conflicts)
+		return 0, oerrs.Errorf("restore: %w: %s", ErrDBExists, strings.Join(conflicts, ", "))
+	}
+
+	order := make([]string, 0, len(names))
+	tmps := make(map[string]string, len(names))
+	defer func() {
+		for _, tmp := range tmps {
+			os.Remove(tmp) // no-op once it's renamed
+		}
+	}()
+	for name, zf := range names {
+		tmp := mdb.getPath(name) + ".restore"
+		tmps[name] = tmp
+		if err = extractBoltFile(tmp, zf); err != nil {
+			return 0, oerrs.Errorf("restore %s: %w", zf.Name, err)
+		}
+		order = append(order, name)
+	}
+	sort.Strings(order)
+
+	for _, name := range order {
+		if err = mdb.replaceDB(name, tmps[name]); err != nil {
+			if err = oerrs.Errorf("restore %s: %w", names[name].Name, err); n > 0 {
+				err = oerrs.Errorf("%w (already replaced: %s)", err, strings.Join(order[:n], ", "))
+			}
+			return
+		}
+		n++
+	}
+	return
+}
+
+// extractBoltFile writes zf to fp and checks that it's a valid bolt file.
+func extractBoltFile(fp string, zf *zip.File) (err error) {
+	os.MkdirAll(filepath.Dir(fp), 0o755)
+	rc, err := zf.Open()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	f, err := os.Create(fp)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(f, rc); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return
+	}
+	return checkBoltFile(fp)
+}
+
+// replaceDB closes name if it's open, replaces its file with tmp and opens it again.
+func (mdb *MultiDB) replaceDB(name, tmp string) (err error) {
+	fp := mdb.getPath(name)
+	if err = mdb.CloseDB(name); err != nil {
+		return
+	}
+	if err = os.Rename(tmp, fp); err != nil {
+		return
+	}
+	_, err = mdb.Get(name, nil)
+	return
 }
 
 func (mdb *MultiDB) Close() error {
@@ -434,9 +925,9 @@ func (mdb *MultiDB) Close() error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			db.onClose = nil // we're handling this
-			if err := db.Close(); err != nil {
-				el.Errorf("%s: %v", k, db)
+			mdb.unhookDB(db)
+			if err := db.close(false); err != nil { // we're already holding the lock onClose needs
+				el.Errorf("%s: %v", k, err)
 			}
 		}()
 
@@ -1,9 +1,22 @@
 package mbbolt
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/alpineiq/genh"
+	"github.com/alpineiq/oerrs"
+	"go.etcd.io/bbolt"
 )
 
 func TestMultiRace(t *testing.T) {
@@ -21,3 +34,544 @@ func TestMultiRace(t *testing.T) {
 	wg.Wait()
 	mdb.Close()
 }
+
+func TestPrefetchOnOpen(t *testing.T) {
+	if DefaultMMapFlags == 0 {
+		t.Skip("prefetch isn't supported on this platform")
+	}
+	tmp := t.TempDir()
+	fp := filepath.Join(tmp, "x.db")
+	db, err := Open(fp, nil)
+	dieIf(t, err)
+	val := make([]byte, 1<<20)
+	for i := 0; i < 64; i++ {
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), val))
+	}
+	dieIf(t, db.Close())
+
+	for _, tc := range []struct {
+		prefetch bool
+		maxSize  int64
+		populate bool
+	}{
+		{false, 0, false},
+		{true, 0, true},
+		{true, 1 << 40, true},
+		{true, 1 << 20, false},
+	} {
+		opts := DefaultOptions.Clone()
+		opts.PrefetchOnOpen, opts.PrefetchMaxSize = tc.prefetch, tc.maxSize
+		if populate := opts.boltOptsFor(fp).MmapFlags&DefaultMMapFlags != 0; populate != tc.populate {
+			t.Fatalf("%+v: populate = %v", tc, populate)
+		}
+
+		start := time.Now()
+		db, err := Open(fp, opts)
+		dieIf(t, err)
+		t.Logf("prefetch=%v maxSize=%d: open took %v", tc.prefetch, tc.maxSize, time.Since(start))
+		dieIf(t, db.Close())
+	}
+}
+
+func TestBoltOptionsFn(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.BoltOptionsFn = func(bo *bbolt.Options) {
+		bo.PageSize = 16384
+	}
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), opts)
+	dieIf(t, err)
+	defer db.Close()
+	if ps := db.Raw().Info().PageSize; ps != 16384 {
+		t.Fatalf("expected a page size of 16384, got %d", ps)
+	}
+}
+
+func TestMultiGetTyped(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.MarshalFn, opts.UnmarshalFn = genh.MarshalMsgpack, genh.UnmarshalMsgpack
+	mdb := NewMultiDB(t.TempDir(), ".db", opts)
+	defer mdb.Close()
+
+	db, err := MultiGetTyped[S](mdb, "typed", DefaultOptions.Clone())
+	dieIf(t, err)
+	dieIf(t, db.Put("b", "k", S{X: 42, Y: "answer"}))
+
+	v, err := db.Get("b", "k")
+	dieIf(t, err)
+	if v.X != 42 || v.Y != "answer" {
+		t.Fatalf("unexpected value: %+v", v)
+	}
+
+	raw, err := db.GetBytes("b", "k")
+	dieIf(t, err)
+	var mv S
+	if err := genh.UnmarshalMsgpack(raw, &mv); err != nil || mv != v {
+		t.Fatalf("expected a msgpack value: %v %+v", err, mv)
+	}
+}
+
+func TestWatchBucket(t *testing.T) {
+	mdb := NewMultiDB(t.TempDir(), ".db", nil)
+	defer mdb.Close()
+
+	a := mdb.MustGet("tenantA", nil)
+	ch, cancel := mdb.WatchBucket("users")
+	defer cancel()
+	b := mdb.MustGet("tenantB", nil) // opened after the watch started
+
+	dieIf(t, a.PutBytes("users", "u1", []byte("a")))
+	dieIf(t, a.PutBytes("other", "x", []byte("ignored")))
+	dieIf(t, b.PutBytes("users", "u2", []byte("b")))
+	dieIf(t, b.Delete("users", "u2"))
+
+	exp := []TenantChange{{DB: "tenantA", Key: "u1"}, {DB: "tenantB", Key: "u2"}, {DB: "tenantB", Key: "u2", Deleted: true}}
+	for _, e := range exp {
+		select {
+		case c := <-ch:
+			if c != e {
+				t.Fatalf("expected %+v, got %+v", e, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %+v", e)
+		}
+	}
+
+	cancel()
+	dieIf(t, a.PutBytes("users", "u3", []byte("a")))
+	if _, ok := <-ch; ok {
+		t.Fatal("expected the channel to be closed")
+	}
+}
+
+func TestWatchBucketFull(t *testing.T) {
+	mdb := NewMultiDB(t.TempDir(), ".db", nil)
+	defer mdb.Close()
+
+	a := mdb.MustGet("tenantA", nil)
+	ch, cancel := mdb.WatchBucket("users")
+	defer cancel()
+
+	// nobody reads ch, the commits must not block once it's full
+	const N = 200
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < N; i++ {
+			if err := a.PutBytes("users", strconv.Itoa(i), nil); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		dieIf(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("commits blocked on a full watcher")
+	}
+	if n := int64(len(ch)) + mdb.WatchDropped(); n != N {
+		t.Fatalf("expected %d sent or dropped changes, got %d", N, n)
+	}
+}
+
+func TestOpenRetry(t *testing.T) {
+	var calls int
+	opts := DefaultOptions.Clone()
+	opts.OpenRetryDelay = time.Millisecond
+	opts.OpenFile = func(name string, flag int, perm os.FileMode) (*os.File, error) {
+		if calls++; calls <= 2 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EMFILE}
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	mdb := NewMultiDB(t.TempDir(), ".db", opts)
+	defer mdb.Close()
+
+	_, err := mdb.Get("retry", nil)
+	dieIf(t, err)
+	if calls != 3 {
+		t.Fatalf("expected 3 open calls, got %d", calls)
+	}
+
+	opts.OpenRetries = 0
+	calls = 0
+	if _, err := mdb.Get("noRetry", opts); !errors.Is(err, syscall.EMFILE) {
+		t.Fatalf("expected EMFILE, got %v", err)
+	}
+}
+
+func TestRepairOnOpen(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions.Clone()
+	opts.NoFreelistSync = false // the freelist has to be on disk to be corrupted
+
+	mdb := NewMultiDB(dir, ".db", opts)
+	db, err := mdb.Get("x", nil)
+	dieIf(t, err)
+	for i := 0; i < 100; i++ {
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), []byte("v")))
+	}
+	dieIf(t, mdb.Close())
+
+	corruptFreelist(t, filepath.Join(dir, "x.db"))
+
+	if err := checkFreelist(filepath.Join(dir, "x.db")); !errors.Is(err, ErrCorruptDB) {
+		t.Fatalf("expected ErrCorruptDB, got %v", err)
+	}
+
+	opts.RepairOnOpen = true
+	mdb = NewMultiDB(dir, ".db", opts)
+	db, err = mdb.Get("x", nil)
+	dieIf(t, err)
+	defer mdb.Close()
+	if n, err := db.CountPrefix("b", nil); err != nil || n != 100 {
+		t.Fatalf("expected 100 keys, got %d (%v)", n, err)
+	}
+	dieIf(t, db.PutBytes("b", "new", []byte("v")))
+	dieIf(t, checkFreelist(filepath.Join(dir, "x.db")))
+}
+
+// corruptFreelist clears the page type of the freelist pages both meta pages point to.
+func corruptFreelist(t *testing.T, fp string) {
+	data, err := os.ReadFile(fp)
+	dieIf(t, err)
+	pageSize := int(binary.LittleEndian.Uint32(data[24:]))
+	for _, meta := range []int{0, pageSize} {
+		// page header (16) + magic, version, pageSize, flags (16) + root bucket (16)
+		pgid := int(binary.LittleEndian.Uint64(data[meta+48:]))
+		binary.LittleEndian.PutUint16(data[pgid*pageSize+8:], 0)
+	}
+	dieIf(t, os.WriteFile(fp, data, 0o600))
+}
+
+func TestOpenSamePath(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	wd, err := os.Getwd()
+	dieIf(t, err)
+	dieIf(t, os.Chdir(dir))
+	defer os.Chdir(wd)
+
+	for _, p := range []string{"x.db", "./x.db", dir + "/sub/../x.db"} {
+		db2, err := Open(p, nil)
+		dieIf(t, err)
+		if db2 != db {
+			t.Fatalf("%s opened a different db", p)
+		}
+	}
+
+	mdb := NewMultiDB(dir, ".db", nil)
+	defer mdb.Close()
+	a, err := mdb.Get("y", nil)
+	dieIf(t, err)
+	if b, err := mdb.Get("./sub/../y", nil); err != nil || a != b {
+		t.Fatalf("expected the same db, got %p %p (%v)", a, b, err)
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.db")
+	bdb, err := bbolt.Open(src, 0o600, nil)
+	dieIf(t, err)
+	dieIf(t, bdb.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("b"))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("k"), []byte(`"v"`))
+	}))
+	dieIf(t, bdb.Close())
+
+	mdb := NewMultiDB(filepath.Join(dir, "m"), ".db", nil)
+	defer mdb.Close()
+
+	db, err := mdb.Adopt("copied", src, false)
+	dieIf(t, err)
+	var v string
+	if err := db.Get("b", "k", &v); err != nil || v != "v" {
+		t.Fatalf("unexpected value %q: %v", v, err)
+	}
+	if got, _ := mdb.Get("copied", nil); got != db {
+		t.Fatal("the adopted db isn't registered")
+	}
+	if _, err := mdb.Adopt("copied", src, false); err != ErrDBExists {
+		t.Fatalf("expected ErrDBExists, got %v", err)
+	}
+
+	db, err = mdb.Adopt("moved", src, true)
+	dieIf(t, err)
+	if v, _ := db.GetBytes("b", "k"); string(v) != `"v"` {
+		t.Fatalf("unexpected value %q", v)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatalf("expected the source to be moved, got %v", err)
+	}
+
+	bad := filepath.Join(dir, "bad.db")
+	dieIf(t, os.WriteFile(bad, make([]byte, 8192), 0o600))
+	if _, err := mdb.Adopt("bad", bad, true); err == nil {
+		t.Fatal("expected adopting an invalid file to fail")
+	}
+	if _, err := os.Stat(mdb.getPath("bad")); !os.IsNotExist(err) {
+		t.Fatalf("the invalid file was placed: %v", err)
+	}
+
+	// concurrent adopts of the same name, only one of them may place the file
+	src = filepath.Join(dir, "src2.db")
+	bdb, err = bbolt.Open(src, 0o600, nil)
+	dieIf(t, err)
+	dieIf(t, bdb.Close())
+	var wg sync.WaitGroup
+	var adopted genh.AtomicInt64
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := mdb.Adopt("racy", src, false); err == nil {
+				adopted.Add(1)
+			} else if err != ErrDBExists {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := adopted.Load(); n != 1 {
+		t.Fatalf("expected a single adopt to succeed, got %d", n)
+	}
+}
+
+func TestOnOpen(t *testing.T) {
+	var calls []string
+	opts := DefaultOptions.Clone()
+	opts.InitialBuckets = []string{"a", "b"}
+	opts.InitDB = func(db *DB) error {
+		calls = append(calls, "init:"+strconv.Itoa(len(db.Buckets())))
+		return nil
+	}
+	opts.OnOpen = func(db *DB) error {
+		calls = append(calls, "open:"+strconv.Itoa(len(db.Buckets())))
+		return nil
+	}
+
+	mdb := NewMultiDB(t.TempDir(), ".db", opts)
+	defer mdb.Close()
+	db, err := mdb.Get("x", nil)
+	dieIf(t, err)
+	dieIf(t, db.Close())
+	_, err = mdb.Get("x", nil)
+	dieIf(t, err)
+	if exp := "init:0,open:2,init:2,open:2"; strings.Join(calls, ",") != exp {
+		t.Fatalf("expected %s, got %v", exp, calls)
+	}
+
+	const errOpen = oerrs.String("open failed")
+	fopts := opts.Clone()
+	fopts.OnOpen = func(db *DB) error { return errOpen }
+	if _, err := mdb.Get("y", fopts); err != errOpen {
+		t.Fatalf("expected errOpen, got %v", err)
+	}
+	// the failed open must not keep the file locked
+	fopts.Timeout = time.Millisecond * 100
+	fopts.OnOpen = nil
+	_, err = mdb.Get("y", fopts)
+	dieIf(t, err)
+
+	const errInit = oerrs.String("init failed")
+	fopts.InitDB = func(db *DB) error { return errInit }
+	if _, err := mdb.Get("z", fopts); err != errInit {
+		t.Fatalf("expected errInit, got %v", err)
+	}
+	fopts.InitDB = nil
+	_, err = mdb.Get("z", fopts)
+	dieIf(t, err)
+}
+
+func TestBackupToDirIncremental(t *testing.T) {
+	mdb := NewMultiDB(t.TempDir(), ".db", nil)
+	defer mdb.Close()
+	for _, name := range []string{"a", "b"} {
+		dieIf(t, mdb.MustGet(name, nil).PutBytes("b", "k", []byte("v1")))
+	}
+
+	dir := t.TempDir()
+	if !LastBackupTime(dir).IsZero() {
+		t.Fatal("expected no backup time")
+	}
+	n, err := mdb.BackupToDirIncremental(dir, LastBackupTime(dir))
+	dieIf(t, err)
+	if n == 0 {
+		t.Fatal("expected both dbs to be backed up")
+	}
+	since := LastBackupTime(dir)
+	if since.IsZero() {
+		t.Fatal("backup time wasn't recorded")
+	}
+	stA, err := os.Stat(filepath.Join(dir, "a.db"))
+	dieIf(t, err)
+
+	// file times have a coarse resolution
+	time.Sleep(time.Millisecond * 50)
+	dieIf(t, mdb.MustGet("b", nil).PutBytes("b", "k", []byte("v2")))
+
+	_, err = mdb.BackupToDirIncremental(dir, since)
+	dieIf(t, err)
+	if st, err := os.Stat(filepath.Join(dir, "a.db")); err != nil || !st.ModTime().Equal(stA.ModTime()) {
+		t.Fatalf("unchanged db was backed up again: %v", err)
+	}
+	if !LastBackupTime(dir).After(since) {
+		t.Fatal("backup time wasn't updated")
+	}
+
+	bdb, err := Open(filepath.Join(dir, "b.db"), nil)
+	dieIf(t, err)
+	defer bdb.Close()
+	if v, _ := bdb.GetBytes("b", "k"); string(v) != "v2" {
+		t.Fatalf("modified db wasn't backed up, got %q", v)
+	}
+}
+
+func TestMultiLockedByAnotherProcess(t *testing.T) {
+	dir := t.TempDir()
+	opts := DefaultOptions.Clone()
+	opts.Timeout = time.Millisecond * 50
+	mdb := NewMultiDB(dir, ".db", opts)
+	defer mdb.Close()
+
+	// a second bbolt.Open on the same path stands in for another process
+	other, err := bbolt.Open(filepath.Join(dir, "x.db"), 0o600, nil)
+	dieIf(t, err)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := mdb.Get("x", nil)
+		errCh <- err
+	}()
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrLockedByAnotherProcess) {
+			t.Fatalf("expected ErrLockedByAnotherProcess, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get didn't return while the file was locked")
+	}
+
+	// once the other process is gone, concurrent gets share a single open
+	dieIf(t, other.Close())
+	var wg sync.WaitGroup
+	dbs := make([]*DB, 8)
+	for i := range dbs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dbs[i] = mdb.MustGet("x", nil)
+		}(i)
+	}
+	wg.Wait()
+	for _, db := range dbs[1:] {
+		if db != dbs[0] {
+			t.Fatal("expected the same db")
+		}
+	}
+}
+
+func TestMultiRestore(t *testing.T) {
+	src := NewMultiDB(t.TempDir(), ".db", nil)
+	defer src.Close()
+	names := []string{"a", filepath.Join("sub", "b")}
+	for _, name := range names {
+		dieIf(t, src.MustGet(name, nil).Put("b", "k", name))
+	}
+	var buf bytes.Buffer
+	if n, err := src.Backup(&buf, nil); err != nil || n == 0 {
+		t.Fatalf("backup: %d %v", n, err)
+	}
+	backup := buf.Bytes()
+
+	mdb := NewMultiDB(t.TempDir(), ".db", nil)
+	defer mdb.Close()
+	check := func() {
+		t.Helper()
+		for _, name := range names {
+			var v string
+			dieIf(t, mdb.MustGet(name, nil).Get("b", "k", &v))
+			if v != name {
+				t.Fatalf("%s: unexpected value %q", name, v)
+			}
+		}
+	}
+
+	n, err := mdb.Restore(bytes.NewReader(backup), false)
+	dieIf(t, err)
+	if n != len(names) {
+		t.Fatalf("expected %d dbs, got %d", len(names), n)
+	}
+	check()
+
+	dieIf(t, mdb.MustGet("a", nil).Put("b", "k", "changed"))
+	_, err = mdb.Restore(bytes.NewReader(backup), false)
+	if !errors.Is(err, ErrDBExists) || !strings.Contains(err.Error(), "a, "+names[1]) {
+		t.Fatalf("expected the conflicts, got %v", err)
+	}
+
+	// an invalid entry fails the restore before any db is replaced
+	zr, err := zip.NewReader(bytes.NewReader(backup), int64(len(backup)))
+	dieIf(t, err)
+	var bad bytes.Buffer
+	zw := zip.NewWriter(&bad)
+	for _, zf := range zr.File {
+		dieIf(t, zw.Copy(zf))
+	}
+	w, err := zw.Create("bad.db")
+	dieIf(t, err)
+	_, err = w.Write(make([]byte, 8192))
+	dieIf(t, err)
+	dieIf(t, zw.Close())
+	if _, err = mdb.Restore(&bad, true); err == nil {
+		t.Fatal("expected the invalid entry to fail the restore")
+	}
+	var v string
+	if dieIf(t, mdb.MustGet("a", nil).Get("b", "k", &v)); v != "changed" {
+		t.Fatalf("a was replaced by a failed restore: %q", v)
+	}
+	if _, err := os.Stat(mdb.getPath("bad") + ".restore"); !os.IsNotExist(err) {
+		t.Fatalf("the invalid file was left behind: %v", err)
+	}
+
+	if n, err = mdb.Restore(bytes.NewReader(backup), true); err != nil || n != len(names) {
+		t.Fatalf("overwrite: %d %v", n, err)
+	}
+	check()
+}
+
+func TestMultiCloseDB(t *testing.T) {
+	mdb := NewMultiDB(t.TempDir(), ".db", nil)
+	defer mdb.Close()
+
+	old := mdb.MustGet("x", nil)
+	dieIf(t, old.Put("b", "k", 1))
+	dieIf(t, mdb.CloseDB("x"))
+	// the db is closed through its own Close, so closing it again is a no-op instead of closing bolt twice
+	dieIf(t, old.Close())
+	if err := old.Put("b", "k", 2); err == nil {
+		t.Fatal("expected the closed db to fail")
+	}
+
+	db := mdb.MustGet("x", nil)
+	if db == old {
+		t.Fatal("expected a new db")
+	}
+	// closing the old one again must not touch the new one
+	dieIf(t, old.Close())
+	var v int
+	dieIf(t, db.Get("b", "k", &v))
+	if v != 1 {
+		t.Fatalf("expected 1, got %d", v)
+	}
+	if mdb.MustGet("x", nil) != db {
+		t.Fatal("the new db was dropped from the map")
+	}
+}
@@ -0,0 +1,71 @@
+package mbbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// orderBucketSuffix is appended to a bucket's name to get the bucket holding its insertion order,
+// it maps 's'+seq to the key and 'k'+key to the seq so deletes can clean up after themselves.
+const orderBucketSuffix = "__order"
+
+func (tx *Tx) trackOrder(bucket string, b *Bucket, key []byte, del bool) error {
+	if !tx.db.orderBuckets[bucket] || (b.Get(key) != nil) != del {
+		return nil // not tracked, already exists or deleting a missing key
+	}
+
+	obName := bucket + orderBucketSuffix
+	kk := append([]byte{'k'}, key...)
+	if del {
+		ob := tx.Bucket(obName)
+		if ob == nil {
+			return nil
+		}
+		if seq := ob.Get(kk); seq != nil {
+			if err := ob.Delete(append([]byte{'s'}, seq...)); err != nil {
+				return err
+			}
+		}
+		return ob.Delete(kk)
+	}
+
+	seq, err := tx.NextIndex(obName)
+	if err != nil {
+		return err
+	}
+	sk := binary.BigEndian.AppendUint64([]byte{'s'}, seq)
+	ob := tx.Bucket(obName)
+	if err = ob.Put(sk, key); err != nil {
+		return err
+	}
+	return ob.Put(kk, sk[1:])
+}
+
+// ForEachInsertionOrder calls fn for every key of bucket in the order they were first inserted,
+// the bucket must be listed in Options.InsertionOrderBuckets, keys written before it was are skipped.
+func (tx *Tx) ForEachInsertionOrder(bucket string, fn func(k, v []byte) error) error {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return err
+	}
+	ob := tx.Bucket(bucket + orderBucketSuffix)
+	if ob == nil {
+		return nil
+	}
+	fn = tx.decodeFn(bucket, fn)
+	c := ob.Cursor()
+	for sk, k := c.Seek([]byte{'s'}); sk != nil && bytes.HasPrefix(sk, []byte{'s'}); sk, k = c.Next() {
+		if v := b.Get(k); v != nil {
+			if err := fn(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (db *DB) ForEachInsertionOrder(bucket string, fn func(k, v []byte) error) error {
+	return db.View(func(tx *Tx) error {
+		return tx.ForEachInsertionOrder(bucket, fn)
+	})
+}
@@ -0,0 +1,100 @@
+package mbbolt
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// BPopPollInterval is how often BPop checks its bucket even without a put notification,
+// so a missed one (like a put done directly through the bbolt db) doesn't block it forever.
+var BPopPollInterval = time.Second
+
+// PopFirst removes the first key of bucket and returns it with its value, ErrKeyNotFound if the bucket is empty.
+func (tx *Tx) PopFirst(bucket string) (k, v []byte, err error) {
+	return tx.pop(bucket, true)
+}
+
+// PopLast is like PopFirst but removes the last key.
+func (tx *Tx) PopLast(bucket string) (k, v []byte, err error) {
+	return tx.pop(bucket, false)
+}
+
+func (tx *Tx) pop(bucket string, first bool) (k, v []byte, err error) {
+	b, err := tx.readBucket(bucket)
+	if err != nil {
+		return
+	}
+	if b != nil {
+		c := b.Cursor()
+		if first {
+			k, v = c.First()
+		} else {
+			k, v = c.Last()
+		}
+	}
+	if k == nil {
+		return nil, nil, ErrKeyNotFound
+	}
+
+	k = append([]byte(nil), k...)
+	if v, err = tx.db.decodeValue(bucket, k, v); err != nil {
+		return nil, nil, err
+	}
+	v = append([]byte(nil), v...)
+	if err = tx.del(b, bucket, k); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// PopFirst runs Tx.PopFirst in its own transaction, it allows using a bucket as a durable FIFO queue.
+func (db *DB) PopFirst(bucket string) (k, v []byte, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		k, v, err = tx.PopFirst(bucket)
+		return
+	})
+	return
+}
+
+// PopLast runs Tx.PopLast in its own transaction, it allows using a bucket as a durable LIFO queue.
+func (db *DB) PopLast(bucket string) (k, v []byte, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		k, v, err = tx.PopLast(bucket)
+		return
+	})
+	return
+}
+
+// BPop is a blocking PopFirst, if the bucket is empty (or doesn't exist) it waits for a put to it (see Watch),
+// up to BPopPollInterval, or for ctx to be done, it allows using a bucket as a durable work queue shared by multiple consumers.
+func (db *DB) BPop(ctx context.Context, bucket string) (k, v []byte, err error) {
+	wake := make(chan struct{}, 1)
+	// watch before the first pop so a put between it and the wait isn't missed
+	cancel := db.Watch(func(muts []Mutation) {
+		for _, m := range muts {
+			if m.Bucket == bucket && !m.Delete {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+				return
+			}
+		}
+	})
+	defer cancel()
+
+	t := time.NewTicker(BPopPollInterval)
+	defer t.Stop()
+	for {
+		if k, v, err = db.PopFirst(bucket); err == nil || !(err == ErrKeyNotFound || errors.Is(err, ErrBucketNotFound)) {
+			return
+		}
+		select {
+		case <-wake:
+		case <-t.C:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
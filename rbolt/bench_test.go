@@ -0,0 +1,151 @@
+package rbolt
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alpineiq/genh"
+	"github.com/alpineiq/mbbolt"
+)
+
+const benchDB, benchBucket = "benchDB", "b"
+
+// newBenchServer starts a server without a journal and with NoSync set, so the benchmarks measure the
+// rbolt overhead (encoding, http round trips) rather than fsync.
+func newBenchServer(b *testing.B) (*Server, *Client) {
+	opts := mbbolt.DefaultOptions.Clone()
+	opts.NoSync = true
+	rbs := NewServer(b.TempDir(), opts, WithoutJournal())
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	b.Cleanup(func() { rbs.Close() })
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	b.Cleanup(func() { c.Close() })
+	return rbs, c
+}
+
+func benchFill(b *testing.B, c *Client, n int) {
+	val, _ := genh.MarshalMsgpack(&S{A: "some value", B: 42})
+	if err := c.BulkImport(benchDB, benchBucket, func(yield func(key string, val []byte) bool) {
+		for i := 0; i < n; i++ {
+			if !yield(strconv.Itoa(i), val) {
+				return
+			}
+		}
+	}); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkClientGet(b *testing.B) {
+	_, c := newBenchServer(b)
+	benchFill(b, c, 1000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v S
+		// doNoTx skips the client cache, which would turn every Get after the first into a map lookup
+		if err := c.doNoTx(opGet, benchDB, benchBucket, strconv.Itoa(i%1000), nil, &v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClientPut(b *testing.B) {
+	_, c := newBenchServer(b)
+	v := &S{A: "some value", B: 42}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := c.Put(benchDB, benchBucket, strconv.Itoa(i), v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkClientTx measures Begin + N Puts + Commit, compare ns/op/N with BenchmarkClientPut to get the tx overhead.
+func BenchmarkClientTx(b *testing.B) {
+	for _, n := range []int{1, 10, 100} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			_, c := newBenchServer(b)
+			v := &S{A: "some value", B: 42}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				tx, err := c.Begin(benchDB)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for j := 0; j < n; j++ {
+					if err := tx.Put(benchBucket, strconv.Itoa(j), v); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := tx.Commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkClientForEach(b *testing.B) {
+	const N = 10000
+	_, c := newBenchServer(b)
+	benchFill(b, c, N)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		if err := c.ForEachBytes(benchDB, benchBucket, func(key string, val []byte) error {
+			n++
+			return nil
+		}); err != nil {
+			b.Fatal(err)
+		}
+		if n != N {
+			b.Fatalf("expected %d records, got %d", N, n)
+		}
+	}
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*N), "ns/record")
+}
+
+// BenchmarkClientParallelGet compares concurrent small requests multiplexed over a single h2 connection
+// (the default client) with http/1.1 using a connection per concurrent request.
+func BenchmarkClientParallelGet(b *testing.B) {
+	for _, tc := range []struct {
+		name string
+		c    func() *http.Client
+	}{
+		{"h2", nil},
+		{"h1", func() *http.Client {
+			return &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 256}}
+		}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			_, c := newBenchServer(b)
+			if tc.c != nil {
+				c.c = tc.c()
+			}
+			benchFill(b, c, 1000)
+			var ctr atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var v S
+					key := fmt.Sprint(ctr.Add(1) % 1000)
+					if err := c.doNoTx(opGet, benchDB, benchBucket, key, nil, &v); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
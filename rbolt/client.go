@@ -2,8 +2,10 @@ package rbolt
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strings"
 	"time"
@@ -15,13 +17,19 @@ import (
 	"github.com/alpineiq/otk"
 )
 
+// ErrTxExpired is returned by Tx methods once the server rolled back the transaction (see Server.MaxUnusedLock),
+// none of its writes were applied and the whole transaction should be retried.
+const ErrTxExpired = oerrs.String("rbolt: transaction expired")
+
 func NewClient(addr, auth string) *Client {
 	if !strings.HasSuffix(addr, "/") {
 		addr += "/"
 	}
 	return &Client{
-		c:    gserv.H2Client(),
-		addr: addr,
+		c:     gserv.H2Client(),
+		locks: &genh.LMap[string, *Tx]{},
+		m:     &genh.LMap[string, *bucketKeyVal]{},
+		addr:  addr,
 
 		RetryCount: 100,
 		RetrySleep: time.Millisecond * 100,
@@ -33,9 +41,10 @@ type (
 	bucketKeyVal = genh.LMultiMap[string, string, any]
 	Client       struct {
 		c     *http.Client
-		locks genh.LMap[string, *Tx]
-		m     genh.LMap[string, *bucketKeyVal]
+		locks *genh.LMap[string, *Tx]
+		m     *genh.LMap[string, *bucketKeyVal]
 		addr  string
+		ctx   context.Context
 
 		RetryCount int
 		RetrySleep time.Duration
@@ -43,6 +52,14 @@ type (
 	}
 )
 
+// WithContext returns a client sharing c's connections, cache and transactions whose requests use ctx,
+// they're canceled with it and send its TraceParent, if any, in TraceHeader.
+func (c *Client) WithContext(ctx context.Context) *Client {
+	cp := *c
+	cp.ctx = ctx
+	return &cp
+}
+
 func (c *Client) Close() error {
 	var el oerrs.ErrorList
 	c.locks.ForEach(func(k string, tx *Tx) bool {
@@ -64,7 +81,26 @@ func (c *Client) doNoTx(op op, db, bucket, key string, value, out any) (err erro
 	return c.doReq("POST", "noTx/"+db, &srvReq{Op: op, Bucket: bucket, Key: key, Value: value}, out)
 }
 
-func (c *Client) doReq(method, url string, body *srvReq, out any) (err error) {
+// newReq creates a request bound to the client's context, with the auth and trace headers set.
+func (c *Client) newReq(method, url string, body io.Reader) (*http.Request, error) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.AuthKey != "" {
+		req.Header.Set("Authorization", c.AuthKey)
+	}
+	if tp := TraceParent(ctx); tp != "" {
+		req.Header.Set(TraceHeader, tp)
+	}
+	return req, nil
+}
+
+func (c *Client) doReq(method, url string, body any, out any) (err error) {
 	var resp *http.Response
 	var bodyBytes []byte
 	if bodyBytes, err = genh.MarshalMsgpack(body); err != nil {
@@ -73,13 +109,16 @@ func (c *Client) doReq(method, url string, body *srvReq, out any) (err error) {
 
 	retry := c.RetryCount
 	for {
-		req, _ := http.NewRequest(method, c.addr+url, bytes.NewReader(bodyBytes))
-		if c.AuthKey != "" {
-			req.Header.Set("Authorization", c.AuthKey)
+		req, err := c.newReq(method, c.addr+url, bytes.NewReader(bodyBytes))
+		if err != nil {
+			return err
 		}
 		if resp, err = c.c.Do(req); err == nil {
 			break
 		}
+		if err := req.Context().Err(); err != nil {
+			return err
+		}
 		if retry--; retry < 1 {
 			return oerrs.ErrorCallerf(2, "failed after %d retires: %w", c.RetryCount, err)
 		}
@@ -88,14 +127,8 @@ func (c *Client) doReq(method, url string, body *srvReq, out any) (err error) {
 
 	// log.Println(method, url, string(body))
 	if resp.StatusCode != http.StatusOK {
-		if resp.StatusCode == http.StatusUnauthorized {
-			return oerrs.Errorf("unauthorized")
-		}
-		var r gserv.Error
-		if err := genh.DecodeMsgpack(resp.Body, &r); err != nil {
-			return oerrs.Errorf("error decoding response for %s %s (%v): %v", method, url, resp.StatusCode, err)
-		}
-		return r
+		defer resp.Body.Close()
+		return respError(method, url, resp)
 	}
 
 	if out, ok := out.(*decCloser); ok {
@@ -111,6 +144,76 @@ func (c *Client) doReq(method, url string, body *srvReq, out any) (err error) {
 	return genh.DecodeMsgpack(resp.Body, out)
 }
 
+func respError(method, url string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return oerrs.Errorf("unauthorized")
+	}
+	var r gserv.Error
+	if err := genh.DecodeMsgpack(resp.Body, &r); err != nil {
+		return oerrs.Errorf("error decoding response for %s %s (%v): %v", method, url, resp.StatusCode, err)
+	}
+	return r
+}
+
+// BulkImport streams the key/value pairs yielded by r to the server, which applies them in chunks of BulkChunkSize,
+// r can be an iter.Seq2[string, []byte], the format matches ForEachBytes so a bucket can be piped between servers.
+// The request isn't retried, and the chunks applied before an error are kept.
+func (c *Client) BulkImport(db, bucket string, r func(yield func(key string, val []byte) bool)) (err error) {
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		enc := genh.NewMsgpackEncoder(pw)
+		r(func(key string, val []byte) bool {
+			err = enc.Encode([2][]byte{otk.UnsafeBytes(key), val})
+			return err == nil
+		})
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	// the router matches on the unescaped path, so the db goes in the catch-all like the other routes and the bucket in the query
+	q := url.Values{"bucket": {bucket}}
+	url := c.addr + "bulk/" + db + "?" + q.Encode()
+	req, err := c.newReq(http.MethodPut, url, pr)
+	if err != nil {
+		return
+	}
+	resp, err := c.c.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return respError(http.MethodPut, url, resp)
+	}
+	c.cache(db).Delete(bucket)
+	return
+}
+
+// ForEachBytes is like ForEach but passes the raw stored values.
+func (c *Client) ForEachBytes(db, bucket string, fn func(key string, val []byte) error) error {
+	var dec decCloser
+	if err := c.doNoTx(opForEach, db, bucket, "", nil, &dec); err != nil {
+		return err
+	}
+	defer dec.Close()
+	for {
+		var kv [2][]byte
+		if err := dec.Decode(&kv); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if len(kv[0]) == 0 {
+			continue
+		}
+		if err := fn(otk.UnsafeString(kv[0]), kv[1]); err != nil {
+			return err
+		}
+	}
+}
+
 func (c *Client) cache(db string) *bucketKeyVal {
 	return c.m.MustGet(db, func() *bucketKeyVal {
 		return &bucketKeyVal{}
@@ -161,8 +264,8 @@ func (c *Client) Update(db string, fn func(tx *Tx) error) error {
 		return err
 	}
 	if err := fn(tx); err != nil {
-		if err2 := tx.Rollback(); err != nil {
-			err = oerrs.Errorf("%v: %w", err, err2)
+		if err2 := tx.Rollback(); err2 != nil {
+			err = oerrs.Errorf("%w (rollback: %v)", err, err2)
 		}
 		return err
 	}
@@ -178,30 +281,64 @@ func (c *Client) Begin(db string) (*Tx, error) {
 	return tx, nil
 }
 
+// Transactions returns the transactions currently held by the server, requires the server's AdminAuthKey.
+func (c *Client) Transactions() (out []TxInfo, err error) {
+	err = c.doReq("GET", "tx", nil, &out)
+	return
+}
+
+// ForceRollback rolls back the transaction held on db immediately, requires the server's AdminAuthKey.
+func (c *Client) ForceRollback(db string) error {
+	return c.doReq("DELETE", "tx/"+db, nil, nil)
+}
+
 type Tx struct {
 	c      *Client
 	db     string
 	prefix string
 
 	updates []func()
+	expired bool
+}
+
+func (tx *Tx) do(op op, bucket, key string, value, out any) error {
+	if tx.expired {
+		return ErrTxExpired
+	}
+	return tx.checkExpired(tx.c.doTx(op, tx.db, bucket, key, value, out))
+}
+
+// checkExpired returns ErrTxExpired if the server doesn't have our tx anymore,
+// and drops the tx along with its pending cache updates.
+func (tx *Tx) checkExpired(err error) error {
+	if e, ok := err.(gserv.Error); !ok || e.Code != http.StatusNotFound {
+		return err
+	}
+	tx.expired, tx.updates = true, nil
+	tx.c.locks.Update(func(m map[string]*Tx) {
+		if m[tx.db] == tx {
+			delete(m, tx.db)
+		}
+	})
+	return ErrTxExpired
 }
 
 func (tx *Tx) NextIndex(bucket string) (id uint64, err error) {
-	err = tx.c.doTx(opSeq, tx.db, bucket, "", nil, &id)
+	err = tx.do(opSeq, bucket, "", nil, &id)
 	return
 }
 
 func (tx *Tx) SetNextIndex(bucket string, id uint64) (err error) {
-	err = tx.c.doTx(opSetSeq, tx.db, bucket, "", id, nil)
+	err = tx.do(opSetSeq, bucket, "", id, nil)
 	return
 }
 
 func (tx *Tx) Get(bucket, key string, v any) (err error) {
-	return tx.c.doTx(opGet, tx.db, bucket, key, nil, v)
+	return tx.do(opGet, bucket, key, nil, v)
 }
 
 func (tx *Tx) Put(bucket, key string, v any) (err error) {
-	if err = tx.c.doTx(opPut, tx.db, bucket, key, v, nil); err == nil {
+	if err = tx.do(opPut, bucket, key, v, nil); err == nil {
 		tx.updates = append(tx.updates, func() {
 			tx.c.cache(tx.db).Set(bucket, key, v)
 		})
@@ -210,7 +347,7 @@ func (tx *Tx) Put(bucket, key string, v any) (err error) {
 }
 
 func (tx *Tx) Delete(bucket, key string) (err error) {
-	if err = tx.c.doTx(opDel, tx.db, bucket, key, nil, nil); err == nil {
+	if err = tx.do(opDel, bucket, key, nil, nil); err == nil {
 		tx.updates = append(tx.updates, func() {
 			tx.c.cache(tx.db).DeleteChild(bucket, key)
 		})
@@ -219,6 +356,9 @@ func (tx *Tx) Delete(bucket, key string) (err error) {
 }
 
 func (tx *Tx) Commit() error {
+	if tx.expired {
+		return ErrTxExpired
+	}
 	gotLock := false
 	tx.c.locks.Update(func(m map[string]*Tx) {
 		if gotLock = m[tx.db] == tx; gotLock {
@@ -229,7 +369,7 @@ func (tx *Tx) Commit() error {
 		return oerrs.Errorf("no lock for %s", tx.db)
 	}
 	if err := tx.c.doReq("DELETE", "tx/commit/"+tx.db, nil, nil); err != nil {
-		return err
+		return tx.checkExpired(err)
 	}
 	for _, fn := range tx.updates {
 		fn()
@@ -237,7 +377,11 @@ func (tx *Tx) Commit() error {
 	return nil
 }
 
+// Rollback rolls back the transaction, it's a no-op if it already expired.
 func (tx *Tx) Rollback() error {
+	if tx.expired {
+		return nil
+	}
 	gotLock := false
 	tx.c.locks.Update(func(m map[string]*Tx) {
 		if gotLock = m[tx.db] == tx; gotLock {
@@ -248,6 +392,9 @@ func (tx *Tx) Rollback() error {
 		return oerrs.Errorf("no lock for %s", tx.db)
 	}
 	if err := tx.c.doReq("DELETE", "tx/rollback/"+tx.db, nil, nil); err != nil {
+		if tx.checkExpired(err) == ErrTxExpired {
+			return nil
+		}
 		return err
 	}
 	return nil
@@ -264,8 +411,17 @@ func Get[T any](c *Client, db, bucket, key string) (v T, err error) {
 }
 
 func ForEach[T any](c *Client, db, bucket string, fn func(key string, v T) error) error {
+	return forEachFilter(c, db, bucket, nil, fn)
+}
+
+// ForEachFilter is like ForEach but only the records matching f are sent by the server.
+func ForEachFilter[T any](c *Client, db, bucket string, f KeyFilter, fn func(key string, v T) error) error {
+	return forEachFilter(c, db, bucket, &f, fn)
+}
+
+func forEachFilter[T any](c *Client, db, bucket string, f *KeyFilter, fn func(key string, v T) error) error {
 	var dec decCloser
-	if err := c.doNoTx(opForEach, db, bucket, "", nil, &dec); err != nil {
+	if err := c.doReq("POST", "noTx/"+db, &srvReq{Op: opForEach, Bucket: bucket, Filter: f}, &dec); err != nil {
 		return err
 	}
 	defer dec.Close()
@@ -273,8 +429,20 @@ func ForEach[T any](c *Client, db, bucket string, fn func(key string, v T) error
 }
 
 func ForEachTx[T any](tx *Tx, bucket string, fn func(key string, v T) error) error {
+	return forEachTxFilter(tx, bucket, nil, fn)
+}
+
+// ForEachTxFilter is like ForEachTx but only the records matching f are sent by the server.
+func ForEachTxFilter[T any](tx *Tx, bucket string, f KeyFilter, fn func(key string, v T) error) error {
+	return forEachTxFilter(tx, bucket, &f, fn)
+}
+
+func forEachTxFilter[T any](tx *Tx, bucket string, f *KeyFilter, fn func(key string, v T) error) error {
+	if tx.expired {
+		return ErrTxExpired
+	}
 	var dec decCloser
-	if err := tx.c.doTx(opForEach, tx.db, bucket, "", nil, &dec); err != nil {
+	if err := tx.checkExpired(tx.c.doReq("POST", "tx/"+tx.db, &srvReq{Op: opForEach, Bucket: bucket, Filter: f}, &dec)); err != nil {
 		return err
 	}
 	defer dec.Close()
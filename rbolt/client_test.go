@@ -7,9 +7,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
 	"strconv"
 	"testing"
 	"time"
+
+	"github.com/alpineiq/genh"
+	"github.com/alpineiq/mbbolt"
 )
 
 func init() {
@@ -254,3 +260,429 @@ func TestClient(t *testing.T) {
 		t.Logf("total %d entries", cnt)
 	})
 }
+
+func TestServerTxAdmin(t *testing.T) {
+	const dbName = "adminDB"
+	rbs := NewServer(t.TempDir(), nil)
+	rbs.AuthKey, rbs.AdminAuthKey = "user", "admin"
+	defer rbs.Close()
+	go rbs.Run(context.Background(), ":0")
+
+	time.Sleep(time.Millisecond * 100)
+	url := "http://" + rbs.s.Addrs()[0]
+
+	c := NewClient(url, rbs.AuthKey)
+	defer c.Close()
+	admin := NewClient(url, rbs.AdminAuthKey)
+	defer admin.Close()
+
+	tx, err := c.Begin(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put("b", "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	forbidden := func(err error) bool {
+		var se interface{ Status() int }
+		return errors.As(err, &se) && se.Status() == http.StatusForbidden
+	}
+	if _, err := c.Transactions(); !forbidden(err) {
+		t.Fatalf("expected a forbidden error, got %v", err)
+	}
+	if err := c.ForceRollback(dbName); !forbidden(err) {
+		t.Fatalf("expected a forbidden error, got %v", err)
+	}
+
+	txs, err := admin.Transactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txs) != 1 || txs[0].DB != dbName || txs[0].Age <= 0 || txs[0].LastUsed.IsZero() {
+		t.Fatalf("unexpected txs: %+v", txs)
+	}
+
+	if err := admin.ForceRollback(dbName); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.ForceRollback(dbName); err == nil {
+		t.Fatal("expected a not found error")
+	}
+	if err := tx.Put("b", "k", "v"); err == nil {
+		t.Fatal("expected an error after the forced rollback")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Update(dbName, func(tx *Tx) error {
+			return tx.Put("b", "k2", "v")
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("db is still locked")
+	}
+
+	var v string
+	if err := c.Get(dbName, "b", "k", &v); err == nil {
+		t.Fatal("rolled back value shouldn't exist", v)
+	}
+}
+
+func TestServerTxAdminDisabled(t *testing.T) {
+	rbs := NewServer(t.TempDir(), nil)
+	rbs.AuthKey = "user"
+	defer rbs.Close()
+	go rbs.Run(context.Background(), ":0")
+
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], rbs.AuthKey)
+	defer c.Close()
+
+	// without an AdminAuthKey nobody is an admin, not even AuthKey clients
+	var se interface{ Status() int }
+	if _, err := c.Transactions(); !errors.As(err, &se) || se.Status() != http.StatusForbidden {
+		t.Fatalf("expected a forbidden error, got %v", err)
+	}
+	if err := c.ForceRollback("db"); !errors.As(err, &se) || se.Status() != http.StatusForbidden {
+		t.Fatalf("expected a forbidden error, got %v", err)
+	}
+}
+
+func TestClientTxExpired(t *testing.T) {
+	const dbName = "expiredDB"
+	rbs := NewServer(t.TempDir(), nil)
+	defer rbs.Close()
+	rbs.MaxUnusedLock = time.Millisecond * 100
+	go rbs.Run(context.Background(), ":0")
+
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	err := c.Update(dbName, func(tx *Tx) error {
+		if err := tx.Put("b", "k", "v"); err != nil {
+			return err
+		}
+		time.Sleep(rbs.MaxUnusedLock * 4)
+		if err := tx.Put("b", "k2", "v"); err != ErrTxExpired {
+			t.Errorf("expected ErrTxExpired, got %v", err)
+		}
+		if err := tx.Commit(); err != ErrTxExpired {
+			t.Errorf("expected ErrTxExpired, got %v", err)
+		}
+		return ErrTxExpired
+	})
+	if !errors.Is(err, ErrTxExpired) {
+		t.Fatalf("expected ErrTxExpired, got %v", err)
+	}
+
+	var v string
+	if err := c.Get(dbName, "b", "k", &v); err == nil {
+		t.Fatal("the expired tx's write shouldn't exist", v)
+	}
+
+	if err := c.Update(dbName, func(tx *Tx) error {
+		return tx.Put("b", "k", "v")
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBulkImport(t *testing.T) {
+	const dbName, bucket = "tenant/bulkDB", "b/c d"
+	newClient := func() *Client {
+		rbs := NewServer(t.TempDir(), nil)
+		t.Cleanup(func() { rbs.Close() })
+		go rbs.Run(context.Background(), ":0")
+		time.Sleep(time.Millisecond * 100)
+		c := NewClient("http://"+rbs.s.Addrs()[0], "")
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	src, dst := newClient(), newClient()
+
+	const n = BulkChunkSize*2 + 10
+	for i := 0; i < n; i++ {
+		if err := src.Put(dbName, bucket, fmt.Sprintf("%05d", i), &S{A: strconv.Itoa(i), B: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var ferr error
+	if err := dst.BulkImport(dbName, bucket, func(yield func(string, []byte) bool) {
+		ferr = src.ForEachBytes(dbName, bucket, func(key string, val []byte) error {
+			if !yield(key, val) {
+				return io.EOF
+			}
+			return nil
+		})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+
+	cnt := 0
+	if err := ForEach(dst, dbName, bucket, func(key string, s *S) error {
+		if key != fmt.Sprintf("%05d", s.B) || s.A != strconv.Itoa(int(s.B)) {
+			return fmt.Errorf("unexpected value for %s: %+v", key, s)
+		}
+		cnt++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cnt != n {
+		t.Fatalf("expected %d keys, got %d", n, cnt)
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	const dbName = "replDB"
+	opts := mbbolt.DefaultOptions.Clone()
+	opts.MarshalFn, opts.UnmarshalFn = genh.MarshalMsgpack, genh.UnmarshalMsgpack // what the rbolt client expects
+	primary, err := mbbolt.Open(t.TempDir()+"/primary.db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rbs := NewServer(t.TempDir(), nil)
+	defer rbs.Close()
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	src, done := primary.ReplicationSource(), make(chan error, 1)
+	go func() { done <- NewReplicator(c, dbName).Run(context.Background(), src) }()
+
+	for i := 0; i < 10; i++ {
+		if err := primary.Put("b", strconv.Itoa(i), &S{B: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := primary.Delete("b", "3"); err != nil {
+		t.Fatal(err)
+	}
+	primary.Close() // closes the source and stops the replicator once everything was sent
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var s S
+	if err := c.Get(dbName, "b", "3", &s); err == nil {
+		t.Fatal("deleted key was replicated")
+	}
+	if err := c.Get(dbName, "b", "9", &s); err != nil || s.B != 9 {
+		t.Fatalf("unexpected value %+v: %v", s, err)
+	}
+}
+
+func TestChunkedForEach(t *testing.T) {
+	const dbName, bucket = "chunkedDB", "b"
+	rbs := NewServer(t.TempDir(), nil)
+	defer rbs.Close()
+	rbs.ForEachChunkSize = 7
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := c.Put(dbName, bucket, fmt.Sprintf("%03d", i), &S{B: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	if err := ForEach(c, dbName, bucket, func(key string, s *S) error {
+		if key != fmt.Sprintf("%03d", n) || s.B != int64(n) {
+			return fmt.Errorf("unexpected %s: %+v", key, s)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 100 {
+		t.Fatalf("expected 100 keys, got %d", n)
+	}
+}
+
+func TestWithoutJournal(t *testing.T) {
+	const dbName = "noJournalDB"
+	dir := t.TempDir()
+	rbs := NewServer(dir, nil, WithoutJournal())
+	defer rbs.Close()
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	if err := c.Put(dbName, "b", "k", &S{B: 42}); err != nil {
+		t.Fatal(err)
+	}
+	var s S
+	if err := c.Get(dbName, "b", "k", &s); err != nil || s.B != 42 {
+		t.Fatalf("unexpected %+v (%v)", s, err)
+	}
+
+	tx, err := c.Begin(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Put("b", "k2", &S{B: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "logs")); !os.IsNotExist(err) {
+		t.Fatalf("expected no journal, got %v", err)
+	}
+}
+
+func TestReadPoolMaxAge(t *testing.T) {
+	const dbName = "poolDB"
+	rbs := NewServer(t.TempDir(), nil, WithoutJournal())
+	rbs.ReadPoolMaxAge = time.Millisecond * 20
+	defer rbs.Close()
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	for i := int64(1); i <= 3; i++ {
+		if err := c.Put(dbName, "b", "k", &S{B: i}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(rbs.ReadPoolMaxAge)
+		var s S
+		if err := c.Get(dbName, "b", "k", &s); err != nil || s.B != i {
+			t.Fatalf("expected %d, got %+v (%v)", i, s, err)
+		}
+	}
+}
+
+func TestClientLocalCodec(t *testing.T) {
+	const dbName = "codecDB"
+	dir := t.TempDir()
+	rbs := NewServer(dir, nil, WithoutJournal())
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	if err := c.Put(dbName, "b", "k", &S{B: 42}); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := rbs.mdb.Get(dbName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s S
+	if err := db.Get("b", "k", &s); err != nil || s.B != 42 {
+		t.Fatalf("unexpected %+v (%v)", s, err)
+	}
+	if err := rbs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same file opened directly with msgpack
+	opts := mbbolt.DefaultOptions.Clone()
+	opts.MarshalFn, opts.UnmarshalFn = genh.MarshalMsgpack, genh.UnmarshalMsgpack
+	ldb, err := mbbolt.Open(filepath.Join(dir, dbName+".db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ldb.Close()
+	s = S{}
+	if err := ldb.Get("b", "k", &s); err != nil || s.B != 42 {
+		t.Fatalf("unexpected %+v (%v)", s, err)
+	}
+}
+
+func TestForEachFilter(t *testing.T) {
+	const dbName, bucket = "filterDB", "b"
+	rbs := NewServer(t.TempDir(), nil, WithoutJournal())
+	defer rbs.Close()
+	rbs.ForEachChunkSize = 7
+	go rbs.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	c := NewClient("http://"+rbs.s.Addrs()[0], "")
+	defer c.Close()
+
+	for _, p := range []string{"a", "b", "c"} {
+		for i := 0; i < 20; i++ {
+			if err := c.Put(dbName, bucket, fmt.Sprintf("%s%02d", p, i), &S{B: int64(i)}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	f := KeyFilter{Prefix: "b", Start: "b05", End: "b15"}
+	var dec decCloser
+	if err := c.doReq("POST", "noTx/"+dbName, &srvReq{Op: opForEach, Bucket: bucket, Filter: &f}, &dec); err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+	for {
+		var kv [2][]byte
+		if err := dec.Decode(&kv); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		sent++
+	}
+	dec.Close()
+	if sent != 10 {
+		t.Fatalf("expected the server to send 10 records, got %d", sent)
+	}
+
+	var keys []string
+	if err := ForEachFilter(c, dbName, bucket, f, func(key string, s *S) error {
+		keys = append(keys, key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 10 || keys[0] != "b05" || keys[9] != "b14" {
+		t.Fatalf("unexpected keys: %v", keys)
+	}
+
+	tx, err := c.Begin(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	n := 0
+	if err := ForEachTxFilter(tx, bucket, KeyFilter{Prefix: "c"}, func(key string, s *S) error {
+		if key[0] != 'c' {
+			return fmt.Errorf("unexpected key %s", key)
+		}
+		n++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 {
+		t.Fatalf("expected 20 keys, got %d", n)
+	}
+
+	// a start past the prefix can't match anything
+	if err := ForEachTxFilter(tx, bucket, KeyFilter{Prefix: "a", Start: "b"}, func(key string, s *S) error {
+		return fmt.Errorf("unexpected key %s", key)
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
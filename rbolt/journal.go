@@ -1,6 +1,9 @@
 package rbolt
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"io"
 	"log"
@@ -10,8 +13,12 @@ import (
 	"time"
 
 	"github.com/alpineiq/genh"
+	"github.com/alpineiq/oerrs"
+	"github.com/vmihailenco/msgpack/v5"
 )
 
+const ErrJournalTampered = oerrs.String("journal hash chain is broken")
+
 type journalEntry struct {
 	TS     int64  `json:"ts,omitempty"`
 	Op     string `json:"op,omitempty"`
@@ -20,6 +27,14 @@ type journalEntry struct {
 	Key    string `json:"key,omitempty"`
 	Error  string `json:"error,omitempty"`
 	Value  any    `json:"value,omitempty"`
+
+	// TraceID is the trace id of the TraceHeader the request came with.
+	TraceID string `json:"traceID,omitempty"`
+
+	// PrevHash is the Hash of the previous entry in the same file, Hash covers the entry itself including PrevHash,
+	// together they form a chain where any modified, removed or reordered entry is detected by VerifyJournal.
+	PrevHash string `json:"prevHash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
 }
 
 type journal struct {
@@ -27,10 +42,12 @@ type journal struct {
 	fileFmt string
 	useJSON bool
 
-	mux sync.Mutex
-	fn  string
-	f   *os.File
-	enc interface {
+	mux    sync.Mutex
+	fn     string
+	f      *os.File
+	last   string // Hash of the last entry written to f
+	broken string // a file whose chain doesn't verify, it's never appended to
+	enc    interface {
 		Encode(v any) error
 	}
 }
@@ -54,6 +71,9 @@ func (j *journal) writer() (_ io.Writer, err error) {
 	if j.fn == nfn {
 		return j.f, nil
 	}
+	if j.broken == nfn {
+		return nil, oerrs.Errorf("journal %q: %w", nfn, ErrJournalTampered)
+	}
 
 	if j.f != nil {
 		if err = j.f.Close(); err != nil {
@@ -73,6 +93,20 @@ func (j *journal) writer() (_ io.Writer, err error) {
 		return nil, err
 	}
 
+	// continue the chain of an existing file, a torn last entry (e.g. after a crash) is cut off,
+	// but a file whose chain doesn't verify is left as is and never appended to.
+	j.last = ""
+	if off, _ := j.f.Seek(0, io.SeekCurrent); off > 0 {
+		if err = j.resume(off); err != nil {
+			j.f.Close()
+			j.f, j.fn = nil, ""
+			if oerrs.Is(err, ErrJournalTampered) {
+				j.broken = nfn
+			}
+			return nil, oerrs.Errorf("journal %q: %w", fp, err)
+		}
+	}
+
 	if j.useJSON {
 		j.enc = json.NewEncoder(j.f)
 	} else {
@@ -81,6 +115,38 @@ func (j *journal) writer() (_ io.Writer, err error) {
 	return j.f, err
 }
 
+// resume verifies the chain of j.f, whose size is size, so new entries continue it.
+// If the last entry can't be decoded it's cut off, but a broken chain is returned as an error.
+func (j *journal) resume(size int64) (err error) {
+	if _, err = j.f.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	last, good, err := walkJournal(j.f)
+	if err == nil {
+		j.last = last
+		_, err = j.f.Seek(0, io.SeekEnd)
+		return
+	}
+	if oerrs.Is(err, ErrJournalTampered) {
+		return
+	}
+
+	log.Printf("journal %q: %v, truncating the last %d bytes", j.f.Name(), err, size-good)
+	if err = j.f.Truncate(good); err != nil {
+		return
+	}
+	if _, err = j.f.Seek(good, io.SeekStart); err != nil {
+		return
+	}
+	if good > 0 && j.useJSON { // good is right after the last entry's closing brace
+		if _, err = j.f.WriteString("\n"); err != nil {
+			return
+		}
+	}
+	j.last = last
+	return
+}
+
 func (j *journal) Write(v *journalEntry, err error) error {
 	v.TS = time.Now().Unix()
 	if err != nil {
@@ -94,7 +160,114 @@ func (j *journal) Write(v *journalEntry, err error) error {
 	}
 	// js, _ := json.Marshal(v)
 	// log.Println(string(js))
-	return j.enc.Encode(v)
+	v.PrevHash, v.Hash = j.last, ""
+	if v.Hash, err = hashEntry(v, j.useJSON); err != nil {
+		return err
+	}
+	if err = j.enc.Encode(v); err == nil {
+		j.last = v.Hash
+	}
+	return err
+}
+
+func hashEntry(v *journalEntry, useJSON bool) (string, error) {
+	var b []byte
+	var err error
+	if useJSON {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = genh.MarshalMsgpack(v)
+	}
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:]), nil
+}
+
+// VerifyJournal reads a journal file (json or msgpack) and checks its hash chain,
+// it returns an error wrapping ErrJournalTampered with the index of the first entry that doesn't match.
+// Each file has its own chain, so removing whole entries from the end of a file can't be detected.
+func VerifyJournal(r io.Reader) error {
+	_, _, err := walkJournal(r)
+	return err
+}
+
+// walkJournal verifies the chain of the entries in r and returns the Hash of the last valid one and the offset right
+// after it. Errors other than ErrJournalTampered come from an entry that couldn't be decoded.
+func walkJournal(r io.Reader) (last string, good int64, err error) {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	c, err := br.Peek(1)
+	if err == io.EOF {
+		return "", 0, nil
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	// decode the values as raw bytes so they hash exactly like they were written
+	useJSON := c[0] == '{'
+	var decode func(e *journalEntry) error
+	var offset func() int64
+	if useJSON {
+		dec := json.NewDecoder(br)
+		offset = dec.InputOffset
+		decode = func(e *journalEntry) error {
+			var raw json.RawMessage
+			e.Value = &raw
+			err := dec.Decode(e)
+			if len(raw) == 0 {
+				e.Value = nil
+			}
+			return err
+		}
+	} else {
+		// the decoder reads straight from br, so whatever br has buffered hasn't been decoded yet
+		dec := genh.NewMsgpackDecoder(br)
+		offset = func() int64 { return cr.n - int64(br.Buffered()) }
+		decode = func(e *journalEntry) error {
+			var raw msgpack.RawMessage
+			e.Value = &raw
+			err := dec.Decode(e)
+			if len(raw) == 0 {
+				e.Value = nil
+			}
+			return err
+		}
+	}
+
+	for i := 0; ; i++ {
+		var e journalEntry
+		if err = decode(&e); err != nil {
+			if err == io.EOF {
+				return last, good, nil
+			}
+			return last, good, oerrs.Errorf("entry %d: %w", i, err)
+		}
+		hash := e.Hash
+		e.Hash = ""
+		if e.PrevHash != last {
+			return last, good, oerrs.Errorf("entry %d: %w (prevHash mismatch)", i, ErrJournalTampered)
+		}
+		if h, err := hashEntry(&e, useJSON); err != nil {
+			return last, good, err
+		} else if h != hash {
+			return last, good, oerrs.Errorf("entry %d: %w (hash mismatch)", i, ErrJournalTampered)
+		}
+		last, good = hash, offset()
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.r.Read(p)
+	cr.n += int64(n)
+	return
 }
 
 func (j *journal) Close() error {
@@ -0,0 +1,121 @@
+package rbolt
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJournalHashChain(t *testing.T) {
+	for _, useJSON := range []bool{true, false} {
+		t.Run(strconv.FormatBool(useJSON), func(t *testing.T) {
+			dir := t.TempDir()
+			write := func(from, to int) {
+				j := newJournal(dir, "journal", useJSON)
+				defer j.Close()
+				for i := from; i < to; i++ {
+					var err error
+					if i%3 == 0 {
+						err = errors.New("failed")
+					}
+					if err := j.Write(&journalEntry{Op: "Put", DB: "db", Bucket: "b", Key: strconv.Itoa(i), Value: []byte("v" + strconv.Itoa(i))}, err); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			// reopening the file has to continue the chain
+			write(0, 5)
+			write(5, 10)
+
+			ext := ".msgp"
+			if useJSON {
+				ext = ".json"
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "journal"+ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyJournal(bytes.NewReader(data)); err != nil {
+				t.Fatalf("intact journal: %v", err)
+			}
+
+			// change the key of the 5th entry
+			idx := bytes.Index(data, []byte("v4"))
+			if idx == -1 && !useJSON {
+				t.Fatal("can't find entry 4")
+			}
+			if useJSON {
+				lines := strings.Split(string(data), "\n")
+				lines[4] = strings.Replace(lines[4], `"key":"4"`, `"key":"x"`, 1)
+				data = []byte(strings.Join(lines, "\n"))
+			} else {
+				data[idx+1] = '5'
+			}
+			err = VerifyJournal(bytes.NewReader(data))
+			if !errors.Is(err, ErrJournalTampered) || !strings.Contains(err.Error(), "entry 4:") {
+				t.Fatalf("expected a break at entry 4, got %v", err)
+			}
+		})
+	}
+}
+
+func TestJournalResume(t *testing.T) {
+	for _, useJSON := range []bool{true, false} {
+		t.Run(strconv.FormatBool(useJSON), func(t *testing.T) {
+			dir := t.TempDir()
+			fp := filepath.Join(dir, "journal.msgp")
+			torn := []byte{0x85, 0xa2, 't'} // a map header and half a key
+			if useJSON {
+				fp, torn = filepath.Join(dir, "journal.json"), []byte(`{"ts":1,"op":`)
+			}
+			write := func(from, to int) error {
+				j := newJournal(dir, "journal", useJSON)
+				defer j.Close()
+				for i := from; i < to; i++ {
+					if err := j.Write(&journalEntry{Op: "Put", DB: "db", Key: strconv.Itoa(i)}, nil); err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			if err := write(0, 5); err != nil {
+				t.Fatal(err)
+			}
+
+			// a torn last entry is cut off and the chain continues
+			f, err := os.OpenFile(fp, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(torn)
+			f.Close()
+			if err := write(5, 10); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(fp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyJournal(bytes.NewReader(data)); err != nil {
+				t.Fatalf("journal with a truncated tail: %v", err)
+			}
+
+			// a broken chain is never appended to
+			idx := bytes.LastIndex(data, []byte("Put"))
+			data[idx] = 'X'
+			if err := os.WriteFile(fp, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := write(10, 11); !errors.Is(err, ErrJournalTampered) {
+				t.Fatalf("expected ErrJournalTampered, got %v", err)
+			}
+			if after, _ := os.ReadFile(fp); !bytes.Equal(after, data) {
+				t.Fatal("a tampered journal was modified")
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package rbolt
 
-import "strconv"
+import (
+	"bytes"
+	"strconv"
+)
 
 func _() {
 	// An "invalid array index" compiler error signifies that the constant values have changed.
@@ -42,4 +45,33 @@ type srvReq struct {
 	Bucket string `json:"b"`
 	Key    string `json:"k"`
 	Value  any    `json:"v"`
+
+	Filter *KeyFilter `json:"f,omitempty"`
+}
+
+// KeyFilter limits the records a ForEach streams back, it's applied on the server so the rest never leave it.
+// Every set field has to match: keys starting with Prefix, >= Start and < End.
+type KeyFilter struct {
+	Prefix string `json:"p,omitempty"`
+	Start  string `json:"s,omitempty"`
+	End    string `json:"e,omitempty"`
+}
+
+// seek returns the first key that can match f.
+func (f *KeyFilter) seek() []byte {
+	if f == nil {
+		return nil
+	}
+	if f.Start > f.Prefix {
+		return []byte(f.Start)
+	}
+	return []byte(f.Prefix)
+}
+
+// past reports whether key, and so every key after it, is out of f, key must be >= f.seek().
+func (f *KeyFilter) past(key []byte) bool {
+	if f == nil {
+		return false
+	}
+	return f.Prefix != "" && !bytes.HasPrefix(key, []byte(f.Prefix)) || f.End != "" && string(key) >= f.End
 }
@@ -0,0 +1,49 @@
+package rbolt
+
+import (
+	"context"
+
+	"github.com/alpineiq/mbbolt"
+)
+
+// NewReplicator returns a Replicator that applies mutations to db on the server c is connected to.
+func NewReplicator(c *Client, db string) *Replicator {
+	return &Replicator{c: c, db: db}
+}
+
+// Replicator ships the mutations of a primary db (see mbbolt.DB.ReplicationSource) to a follower rbolt server.
+// Replication is asynchronous, the follower is eventually consistent with the primary.
+type Replicator struct {
+	c  *Client
+	db string
+}
+
+// Run sends every batch of mutations received from src until src is closed, ctx is done or sending fails,
+// the requests use ctx so they carry its TraceParent.
+func (r *Replicator) Run(ctx context.Context, src <-chan []mbbolt.Mutation) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case muts, ok := <-src:
+			if !ok {
+				return nil
+			}
+			if err := r.c.WithContext(ctx).Replicate(r.db, muts); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Replicate applies muts to db in a single transaction on the server.
+func (c *Client) Replicate(db string, muts []mbbolt.Mutation) error {
+	if err := c.doReq("POST", "replicate/"+db, muts, nil); err != nil {
+		return err
+	}
+	cache := c.cache(db)
+	for _, m := range muts {
+		cache.DeleteChild(m.Bucket, string(m.Key))
+	}
+	return nil
+}
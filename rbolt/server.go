@@ -2,8 +2,10 @@ package rbolt
 
 import (
 	"context"
+	"io"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,24 +26,75 @@ var (
 
 const Version = 202203022
 
-func NewServer(dbPath string, dbOpts *mbbolt.Options) *Server {
+// errFilterDone stops a ForEach once the keys are past its KeyFilter.
+const errFilterDone = oerrs.String("filter done")
+
+// BulkChunkSize is the number of records applied per transaction by the bulk import endpoint.
+const BulkChunkSize = 1000
+
+// ServerOption configures a Server created by NewServer.
+type ServerOption func(s *Server)
+
+// WithoutJournal disables the journal of every operation that's written to dbPath/logs by default.
+func WithoutJournal() ServerOption {
+	return func(s *Server) { s.j = nil }
+}
+
+// NewServer creates a server for the dbs in dbPath, values are stored as msgpack (the client's wire format),
+// so unless dbOpts sets a marshaler, the dbs use msgpack and can be read directly with DB.Get.
+func NewServer(dbPath string, dbOpts *mbbolt.Options, opts ...ServerOption) *Server {
+	if dbOpts == nil || dbOpts.MarshalFn == nil {
+		dbOpts = dbOpts.Clone()
+		dbOpts.MarshalFn, dbOpts.UnmarshalFn = genh.MarshalMsgpack, genh.UnmarshalMsgpack
+	}
 	srv := &Server{
 		s:   gserv.New(gserv.WriteTimeout(time.Minute*10), gserv.ReadTimeout(time.Minute*10), gserv.SetCatchPanics(true)),
 		mdb: mbbolt.NewMultiDB(dbPath, ".db", dbOpts),
 		j:   newJournal(dbPath, "logs/2006/01/02", true),
 
-		MaxUnusedLock: time.Minute,
+		MaxUnusedLock:    time.Minute,
+		ForEachChunkSize: 1000,
+	}
+	for _, opt := range opts {
+		opt(srv)
 	}
 	return srv.init()
 }
 
+// journal writes the entry to the journal if it's enabled, tagged with the trace id of the request.
+// It returns err, or the journal's error if err is nil and JournalFailsRequest is set.
+func (s *Server) journal(ctx *gserv.Context, je *journalEntry, err error) error {
+	if s.j == nil {
+		return err
+	}
+	je.TraceID = traceID(TraceParent(ctx.Req.Context()))
+	jerr := s.j.Write(je, err)
+	if jerr == nil {
+		return err
+	}
+	jerr = oerrs.Errorf("journal: %w", jerr)
+	s.stats.JournalErrors.Add(1)
+	if s.OnJournalError != nil {
+		s.OnJournalError(jerr)
+	} else {
+		lg.Printf("%s (%s): %v", je.Op, je.DB, jerr)
+	}
+	if err == nil && s.JournalFailsRequest {
+		return jerr
+	}
+	return err
+}
+
 func (s *Server) Close() error {
 	var el oerrs.ErrorList
 	el.PushIf(s.s.Close())
-	s.s.Close()
 	if s.j != nil {
 		el.PushIf(s.j.Close())
 	}
+	s.pools.ForEach(func(_ string, p *mbbolt.ReadPool) bool {
+		el.PushIf(p.Close())
+		return true
+	})
 	el.PushIf(s.mdb.Close())
 	return el.Err()
 }
@@ -55,14 +108,26 @@ type stats struct {
 	Deletes     genh.AtomicInt64 `json:"deletes"`
 	Commits     genh.AtomicInt64 `json:"commits"`
 	Rollbacks   genh.AtomicInt64 `json:"rollbacks"`
+	Forced      genh.AtomicInt64 `json:"forcedRollbacks"`
+
+	JournalErrors genh.AtomicInt64 `json:"journalErrors"`
 }
 
 type serverTx struct {
 	sync.Mutex
-	last atomic.Int64
+	started time.Time
+	last    atomic.Int64
+	done    bool // guarded by the mutex, set once the tx is committed or rolled back
 	*mbbolt.Tx
 }
 
+// TxInfo describes a transaction currently held by the server.
+type TxInfo struct {
+	DB       string        `json:"db"`
+	Age      time.Duration `json:"age"`
+	LastUsed time.Time     `json:"lastUsed"`
+}
+
 type (
 	Server struct {
 		s   *gserv.Server
@@ -71,19 +136,43 @@ type (
 
 		mux   sync.Mutex
 		lock  genh.LMap[string, *serverTx]
+		pools genh.LMap[string, *mbbolt.ReadPool]
 		stats stats
 
 		MaxUnusedLock time.Duration
 		AuthKey       string
+
+		// ForEachChunkSize is the number of keys read per transaction by non-tx ForEach requests.
+		ForEachChunkSize int
+		// ReadPoolMaxAge makes non-tx gets reuse read transactions (see mbbolt.ReadPool) if set,
+		// it's faster under a high read load but reads can miss the writes of the last ReadPoolMaxAge.
+		// While reads keep coming there's always a pooled transaction open, so mbbolt.DB.CompactInPlace
+		// fails with ErrTxActive, and commits that grow the file wait up to about ReadPoolMaxAge.
+		// It must be set before the server starts.
+		ReadPoolMaxAge time.Duration
+		// AdminAuthKey is required for the admin endpoints (listing and force-rolling back transactions),
+		// they're disabled if it isn't set. It's also accepted in place of AuthKey.
+		AdminAuthKey string
+
+		// OnJournalError is called with every failed journal write, they're logged if it's nil.
+		// Either way they're counted in the stats' journalErrors.
+		OnJournalError func(err error)
+		// JournalFailsRequest makes requests whose journal entry can't be written fail with a 500,
+		// by default the journal is best-effort. The operation itself has already been applied by then.
+		JournalFailsRequest bool
 	}
 )
 
 func (s *Server) init() *Server {
 	s.s.Use(func(ctx *gserv.Context) gserv.Response {
-		if s.AuthKey != "" && ctx.Req.Header.Get("Authorization") != s.AuthKey {
+		if auth := ctx.Req.Header.Get("Authorization"); s.AuthKey != "" && auth != s.AuthKey && (s.AdminAuthKey == "" || auth != s.AdminAuthKey) {
 			ctx.EncodeCodec(gserv.MsgpCodec{}, http.StatusUnauthorized, "Unauthorized")
 			return nil
 		}
+		// keep the trace in the request's context so it reaches the journal and anything called with that context
+		if tp := ctx.Req.Header.Get(TraceHeader); tp != "" {
+			ctx.Req = ctx.Req.WithContext(WithTraceParent(ctx.Req.Context(), tp))
+		}
 		clearHeaders(ctx)
 		return nil
 	})
@@ -91,6 +180,9 @@ func (s *Server) init() *Server {
 	gserv.MsgpGet(s.s, "/stats", s.getStats, false)
 	gserv.JSONGet(s.s, "/stats.json", s.getStats, false)
 
+	gserv.MsgpGet(s.s, "/tx", s.txList, false)
+	gserv.MsgpDelete(s.s, "/tx/*db", s.txForceRollback, false)
+
 	gserv.MsgpPost(s.s, "/tx/begin/*db", s.txBegin, false)
 	gserv.MsgpDelete(s.s, "/tx/commit/*db", s.txCommit, false)
 	gserv.MsgpDelete(s.s, "/tx/rollback/*db", s.txRollback, false)
@@ -98,6 +190,9 @@ func (s *Server) init() *Server {
 
 	gserv.MsgpPost(s.s, "/noTx/*db", s.handleNoTx, false)
 
+	s.s.PUT("/bulk/*db", s.bulkImport)
+	gserv.MsgpPost(s.s, "/replicate/*db", s.replicate, false)
+
 	return s
 }
 
@@ -122,26 +217,75 @@ func (s *Server) txBegin(ctx *gserv.Context, req any) (string, error) {
 	if err != nil {
 		return "", gserv.NewError(http.StatusInternalServerError, err)
 	}
-	s.j.Write(&journalEntry{Op: "txBegin", DB: dbName}, err)
+	if err = s.journal(ctx, &journalEntry{Op: "txBegin", DB: dbName}, nil); err != nil {
+		tx.Rollback()
+		return "", gserv.NewError(http.StatusInternalServerError, err)
+	}
+
+	s.holdTx(dbName, tx)
+	return "OK", nil
+}
 
-	tts := &serverTx{Tx: tx}
+func (s *Server) holdTx(dbName string, tx *mbbolt.Tx) {
+	tts := &serverTx{Tx: tx, started: time.Now()}
 	tts.last.Store(time.Now().UnixNano())
 	s.lock.Set(dbName, tts)
 	s.stats.Locks.Add(1)
 	s.stats.ActiveLocks.Add(1)
-	go s.checkLock(dbName)
-	return "OK", nil
+	go s.checkLock(dbName, tts)
 }
 
 func (s *Server) txCommit(ctx *gserv.Context) (string, error) {
-	return s.unlock(ctx.Param("db"), true)
+	return s.unlock(ctx, true)
 }
 
 func (s *Server) txRollback(ctx *gserv.Context) (string, error) {
-	return s.unlock(ctx.Param("db"), false)
+	return s.unlock(ctx, false)
+}
+
+func (s *Server) txList(ctx *gserv.Context) ([]TxInfo, error) {
+	if !s.isAdmin(ctx) {
+		return nil, gserv.ErrForbidden
+	}
+	var out []TxInfo
+	s.lock.ForEach(func(dbName string, tx *serverTx) bool {
+		last := time.Unix(0, tx.last.Load())
+		out = append(out, TxInfo{DB: dbName, Age: time.Since(tx.started), LastUsed: last})
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool { return out[i].DB < out[j].DB })
+	return out, nil
+}
+
+func (s *Server) txForceRollback(ctx *gserv.Context) (string, error) {
+	if !s.isAdmin(ctx) {
+		return "", gserv.ErrForbidden
+	}
+	dbName := ctx.Param("db")
+	if dbName == "" {
+		dbName = "default"
+	}
+	err := s.withTx(dbName, true, func(tx *mbbolt.Tx) error {
+		return tx.Rollback()
+	})
+	if err == gserv.ErrNotFound {
+		return "", err
+	}
+	s.stats.Forced.Add(1)
+	err = s.journal(ctx, &journalEntry{Op: "txForceRollback", DB: dbName}, err)
+	if err != nil {
+		return "", gserv.NewError(http.StatusInternalServerError, err)
+	}
+	lg.Printf("force rolled back lock: %s", dbName)
+	return "OK", nil
 }
 
-func (s *Server) unlock(dbName string, commit bool) (string, error) {
+func (s *Server) isAdmin(ctx *gserv.Context) bool {
+	return s.AdminAuthKey != "" && ctx.Req.Header.Get("Authorization") == s.AdminAuthKey
+}
+
+func (s *Server) unlock(ctx *gserv.Context, commit bool) (string, error) {
+	dbName := ctx.Param("db")
 	if dbName == "" {
 		dbName = "default"
 	}
@@ -159,7 +303,10 @@ func (s *Server) unlock(dbName string, commit bool) (string, error) {
 		s.stats.Rollbacks.Add(1)
 		je.Op = "txRollback"
 	}
-	s.j.Write(je, err)
+	err = s.journal(ctx, je, err)
+	if err == gserv.ErrNotFound { // the tx expired, let the client know
+		return "", err
+	}
 	if err != nil {
 		return "", gserv.NewError(http.StatusInternalServerError, err)
 	}
@@ -167,20 +314,34 @@ func (s *Server) unlock(dbName string, commit bool) (string, error) {
 	return "OK", nil
 }
 
-func (s *Server) checkLock(dbName string) {
-	for tx := s.lock.Get(dbName); tx != nil; tx = s.lock.Get(dbName) {
-		if time.Duration(time.Now().UnixNano()-tx.last.Load()) > s.MaxUnusedLock {
-			tx.Lock()
-			lg.Printf("deleted stale lock: %s", dbName)
-			tx.Rollback()
-			s.lock.Delete(dbName)
-			s.stats.Timeouts.Add(1)
-			tx.Unlock()
-			break
-		}
-		time.Sleep(time.Second)
+func (s *Server) checkLock(dbName string, tx *serverTx) {
+	defer s.stats.ActiveLocks.Add(-1)
+	every := s.MaxUnusedLock / 2
+	if every > time.Second || every <= 0 {
+		every = time.Second
+	}
+	for !s.expireLock(dbName, tx) {
+		time.Sleep(every)
 	}
-	s.stats.ActiveLocks.Add(-1)
+}
+
+// expireLock rolls back tx if it's been unused for longer than MaxUnusedLock,
+// the check is done while holding the tx lock so a request can't use it in between.
+func (s *Server) expireLock(dbName string, tx *serverTx) (done bool) {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.done {
+		return true
+	}
+	if time.Duration(time.Now().UnixNano()-tx.last.Load()) <= s.MaxUnusedLock {
+		return false
+	}
+	lg.Printf("deleted stale lock: %s", dbName)
+	tx.Rollback()
+	tx.done = true
+	s.releaseTx(dbName, tx)
+	s.stats.Timeouts.Add(1)
+	return true
 }
 
 func (s *Server) withTx(dbName string, rm bool, fn func(tx *mbbolt.Tx) error) error {
@@ -193,14 +354,28 @@ func (s *Server) withTx(dbName string, rm bool, fn func(tx *mbbolt.Tx) error) er
 	}
 	tx.Lock()
 	defer tx.Unlock()
+	if tx.done { // expired or released while we were waiting for the lock
+		return gserv.ErrNotFound
+	}
 	if rm {
-		s.lock.Delete(dbName)
+		tx.done = true
+		s.releaseTx(dbName, tx)
 	}
 
 	tx.last.Store(time.Now().UnixNano())
+	defer tx.last.Store(time.Now().UnixNano())
 	return fn(tx.Tx)
 }
 
+// releaseTx removes tx from the held locks, unless it was already replaced by a newer one.
+func (s *Server) releaseTx(dbName string, tx *serverTx) {
+	s.lock.Update(func(m map[string]*serverTx) {
+		if m[dbName] == tx {
+			delete(m, dbName)
+		}
+	})
+}
+
 func (s *Server) handleTx(ctx *gserv.Context, req *srvReq) (out []byte, err error) {
 	dbName := ctx.Param("db")
 	if req.Op == opPut {
@@ -213,19 +388,26 @@ func (s *Server) handleTx(ctx *gserv.Context, req *srvReq) (out []byte, err erro
 	err = s.withTx(dbName, false, func(tx *mbbolt.Tx) (err error) {
 		switch req.Op {
 		case opGet:
-			if out = tx.GetBytes(req.Bucket, req.Key, true); len(out) == 0 {
-				out, err = nil, oerrs.Errorf("key not found: %s::%s", req.Bucket, req.Key)
+			if out, err = tx.GetBytesErr(req.Bucket, req.Key, true); out == nil && err == nil {
+				err = oerrs.Errorf("key not found: %s::%s", req.Bucket, req.Key)
 			}
 			return err
 		case opPut:
 			return tx.PutBytes(req.Bucket, req.Key, out)
 		case opForEach:
 			enc := genh.NewMsgpackEncoder(ctx)
-			return tx.ForEachBytes(req.Bucket, func(key, val []byte) error {
+			err = tx.ForEachBytesFrom(req.Bucket, req.Filter.seek(), func(key, val []byte) error {
+				if req.Filter.past(key) {
+					return errFilterDone
+				}
 				err := enc.Encode([2][]byte{key, val})
 				ctx.Flush()
 				return err
 			})
+			if err == errFilterDone {
+				err = nil
+			}
+			return err
 		case opSeq:
 			seq, err := tx.NextIndex(req.Bucket)
 			if err == nil {
@@ -243,7 +425,10 @@ func (s *Server) handleTx(ctx *gserv.Context, req *srvReq) (out []byte, err erro
 		return
 	})
 	je := &journalEntry{Op: "tx" + req.Op.String(), DB: dbName, Bucket: req.Bucket, Key: req.Key, Value: out}
-	s.j.Write(je, err)
+	err = s.journal(ctx, je, err)
+	if err == gserv.ErrNotFound {
+		return nil, err
+	}
 	if err != nil {
 		return nil, gserv.NewError(http.StatusInternalServerError, err)
 	}
@@ -261,7 +446,18 @@ func (s *Server) handleNoTx(ctx *gserv.Context, req *srvReq) (out []byte, err er
 	}
 	switch req.Op {
 	case opGet:
-		if out, err = db.GetBytes(req.Bucket, req.Key); len(out) == 0 {
+		if s.ReadPoolMaxAge > 0 {
+			err = s.readPool(dbName, db).View(func(tx *mbbolt.Tx) error {
+				var err error
+				if out, err = tx.GetBytesErr(req.Bucket, req.Key, true); out == nil && err == nil {
+					err = mbbolt.ErrKeyNotFound
+				}
+				return err
+			})
+		} else {
+			out, err = db.GetBytes(req.Bucket, req.Key)
+		}
+		if err == mbbolt.ErrKeyNotFound {
 			out, err = nil, oerrs.Errorf("key not found: %s::%s", req.Bucket, req.Key)
 		}
 	case opPut:
@@ -272,12 +468,19 @@ func (s *Server) handleNoTx(ctx *gserv.Context, req *srvReq) (out []byte, err er
 		}
 		err = db.PutBytes(req.Bucket, req.Key, out)
 	case opForEach:
+		// use short read transactions so a slow client doesn't pin the db
 		enc := genh.NewMsgpackEncoder(ctx)
-		err = db.ForEachBytes(req.Bucket, func(key, val []byte) error {
+		err = db.ChunkedViewFrom(req.Bucket, req.Filter.seek(), s.ForEachChunkSize, func(key, val []byte) error {
+			if req.Filter.past(key) {
+				return errFilterDone
+			}
 			err := enc.Encode([2][]byte{key, val})
 			ctx.Flush()
 			return err
 		})
+		if err == errFilterDone {
+			err = nil
+		}
 	case opSeq:
 		err = db.Update(func(tx *mbbolt.Tx) error {
 			seq, err2 := tx.NextIndex(req.Bucket)
@@ -297,10 +500,76 @@ func (s *Server) handleNoTx(ctx *gserv.Context, req *srvReq) (out []byte, err er
 	}
 
 	je := &journalEntry{Op: req.Op.String(), DB: dbName, Bucket: req.Bucket, Key: req.Key, Value: out}
-	s.j.Write(je, err)
+	err = s.journal(ctx, je, err)
 	return
 }
 
+func (s *Server) readPool(dbName string, db *mbbolt.DB) *mbbolt.ReadPool {
+	return s.pools.MustGet(dbName, func() *mbbolt.ReadPool {
+		return db.NewReadPool(s.ReadPoolMaxAge)
+	})
+}
+
+// bulkImport reads a stream of [2][]byte{key, val} records (the same format ForEach returns)
+// and applies them in transactions of BulkChunkSize records.
+func (s *Server) bulkImport(ctx *gserv.Context) gserv.Response {
+	dbName, bucket := ctx.Param("db"), ctx.Query("bucket")
+	n, err := s.applyBulk(dbName, bucket, ctx.Req.Body)
+	err = s.journal(ctx, &journalEntry{Op: "bulkImport", DB: dbName, Bucket: bucket, Value: n}, err)
+	if err != nil {
+		ctx.EncodeCodec(gserv.MsgpCodec{}, http.StatusInternalServerError, gserv.NewError(http.StatusInternalServerError, err))
+		return nil
+	}
+	ctx.EncodeCodec(gserv.MsgpCodec{}, http.StatusOK, n)
+	return nil
+}
+
+func (s *Server) applyBulk(dbName, bucket string, r io.Reader) (n int, err error) {
+	db, err := s.mdb.Get(dbName, nil)
+	if err != nil {
+		return
+	}
+
+	var derr error
+	dec := genh.NewMsgpackDecoder(r)
+	n, err = db.BulkLoad(bucket, func(yield func(k, v []byte) bool) {
+		for {
+			var kv [2][]byte
+			if derr = dec.Decode(&kv); derr != nil {
+				if derr == io.EOF {
+					derr = nil
+				}
+				return
+			}
+			if len(kv[0]) > 0 && !yield(kv[0], kv[1]) {
+				return
+			}
+		}
+	}, BulkChunkSize)
+	if err == nil {
+		err = derr
+	}
+	s.stats.Puts.Add(int64(n))
+	return
+}
+
+// replicate applies mutations shipped by a Replicator.
+func (s *Server) replicate(ctx *gserv.Context, muts []mbbolt.Mutation) (string, error) {
+	dbName := ctx.Param("db")
+	if dbName == "" {
+		dbName = "default"
+	}
+	db, err := s.mdb.Get(dbName, nil)
+	if err == nil {
+		err = db.ApplyReplication(muts)
+	}
+	err = s.journal(ctx, &journalEntry{Op: "replicate", DB: dbName, Value: len(muts)}, err)
+	if err != nil {
+		return "", gserv.NewError(http.StatusInternalServerError, err)
+	}
+	return "OK", nil
+}
+
 func splitPath(p string) (out []string) {
 	p = strings.TrimPrefix(strings.TrimSuffix(p, "/"), "/")
 	return strings.Split(p, "/")
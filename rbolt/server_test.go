@@ -0,0 +1,156 @@
+package rbolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alpineiq/gserv"
+	"github.com/alpineiq/mbbolt"
+)
+
+func TestServerTxExpiryRace(t *testing.T) {
+	const dbName = "raceDB"
+	s := NewServer(t.TempDir(), nil)
+	defer s.Close()
+	s.MaxUnusedLock = time.Millisecond * 20
+
+	db, err := s.mdb.Get(dbName, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.holdTx(dbName, tx)
+
+	var (
+		wg   sync.WaitGroup
+		used atomic.Int64
+	)
+	stop := time.Now().Add(time.Millisecond * 500)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(stop) {
+				if err := s.withTx(dbName, false, func(tx *mbbolt.Tx) error {
+					if tx.DB() == nil {
+						t.Error("used a rolled back tx")
+					}
+					return tx.PutBytes("b", "k", []byte("v"))
+				}); err != nil {
+					t.Errorf("tx expired while in use: %v", err)
+					return
+				}
+				used.Add(1)
+				time.Sleep(time.Millisecond * 5)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if s.stats.Timeouts.Load() != 0 {
+		t.Fatal("an actively used tx was rolled back")
+	}
+
+	time.Sleep(s.MaxUnusedLock * 3)
+	if err := s.withTx(dbName, false, func(tx *mbbolt.Tx) error { return nil }); err != gserv.ErrNotFound {
+		t.Fatalf("expected the tx to expire, got %v", err)
+	}
+	if s.stats.Timeouts.Load() != 1 || s.stats.ActiveLocks.Load() != 0 {
+		t.Fatalf("unexpected stats: %+v", &s.stats)
+	}
+	t.Logf("used the tx %d times before it expired", used.Load())
+}
+
+func TestTraceJournal(t *testing.T) {
+	const (
+		tp  = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		tid = "4bf92f3577b34da6a3ce929d0e0e4736"
+	)
+	dir := t.TempDir()
+	s := NewServer(dir, nil)
+	go s.Run(context.Background(), ":0")
+	time.Sleep(time.Millisecond * 100)
+	defer s.Close()
+	c := NewClient("http://"+s.s.Addrs()[0], "")
+	defer c.Close()
+
+	tc := c.WithContext(WithTraceParent(context.Background(), tp))
+	if err := tc.Put("db", "b", "traced", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Update("db", func(tx *Tx) error { return tx.Put("b", "tracedTx", 2) }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Put("db", "b", "untraced", 3); err != nil {
+		t.Fatal(err)
+	}
+
+	s.j.mux.Lock()
+	data, err := os.ReadFile(filepath.Join(dir, s.j.fn))
+	s.j.mux.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyJournal(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var je journalEntry
+		if err := dec.Decode(&je); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		got[je.Op+":"+je.Key] = je.TraceID
+	}
+	exp := map[string]string{"Put:traced": tid, "txBegin:": tid, "txPut:tracedTx": tid, "txCommit:": tid, "Put:untraced": ""}
+	for k, v := range exp {
+		if tv, ok := got[k]; !ok || tv != v {
+			t.Fatalf("%s: expected trace id %q, got %q (%v)", k, v, tv, got)
+		}
+	}
+}
+
+func TestJournalErrors(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		dir := t.TempDir()
+		// the journal goes in dir/logs, a file there fails every write like a read-only directory would,
+		// but unlike one it also does as root
+		if err := os.WriteFile(filepath.Join(dir, "logs"), nil, 0o400); err != nil {
+			t.Fatal(err)
+		}
+		s := NewServer(dir, nil)
+		var called atomic.Int64
+		s.OnJournalError = func(err error) { called.Add(1) }
+		s.JournalFailsRequest = strict
+		go s.Run(context.Background(), ":0")
+		time.Sleep(time.Millisecond * 100)
+		c := NewClient("http://"+s.s.Addrs()[0], "")
+
+		err := c.Put("db", "b", "k", 1)
+		if strict && err == nil {
+			t.Fatal("expected the put to fail")
+		} else if !strict && err != nil {
+			t.Fatal(err)
+		}
+		if n := s.stats.JournalErrors.Load(); n < 1 || called.Load() != n {
+			t.Fatalf("strict: %v: expected the errors to be counted and reported, got %d / %d", strict, n, called.Load())
+		}
+		c.Close()
+		s.Close()
+	}
+}
@@ -0,0 +1,31 @@
+package rbolt
+
+import (
+	"context"
+	"strings"
+)
+
+// TraceHeader is the W3C trace context header sent by the client and recorded by the server in its journal.
+const TraceHeader = "traceparent"
+
+type traceKey struct{}
+
+// WithTraceParent returns a copy of ctx carrying tp, a W3C traceparent ("00-<trace id>-<parent id>-<flags>").
+// The requests of a client using ctx (see Client.WithContext) send it in TraceHeader.
+func WithTraceParent(ctx context.Context, tp string) context.Context {
+	return context.WithValue(ctx, traceKey{}, tp)
+}
+
+// TraceParent returns the traceparent carried by ctx, on the server it's the one the request came with.
+func TraceParent(ctx context.Context) string {
+	tp, _ := ctx.Value(traceKey{}).(string)
+	return tp
+}
+
+// traceID returns the trace id part of tp, or tp as is if it isn't in the W3C format.
+func traceID(tp string) string {
+	if parts := strings.Split(tp, "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	return tp
+}
@@ -0,0 +1,146 @@
+package mbbolt
+
+import (
+	"sync"
+	"time"
+)
+
+// ReadPool reuses read transactions across View calls to skip the cost of beginning / rolling back one per read,
+// in exchange reads can be up to maxAge behind the latest commit.
+// Every tx is only used by one View at a time, idle ones older than maxAge are rolled back in the background,
+// checked every maxAge/4, so none lives much longer than maxAge.
+// Open read transactions block the db from growing its mmap (a commit that needs to waits for them) and make
+// CompactInPlace fail with ErrTxActive, so keep maxAge short and Close the pool before the db.
+type ReadPool struct {
+	db     *DB
+	maxAge time.Duration
+
+	mux    sync.Mutex
+	idle   []pooledTx
+	closed bool
+	stop   chan struct{}
+}
+
+type pooledTx struct {
+	tx      *Tx
+	created time.Time
+}
+
+// NewReadPool returns a ReadPool whose transactions are refreshed every maxAge.
+func (db *DB) NewReadPool(maxAge time.Duration) *ReadPool {
+	p := &ReadPool{db: db, maxAge: maxAge, stop: make(chan struct{})}
+	go p.expireLoop()
+	return p
+}
+
+// View is like DB.View with a possibly reused (and up to maxAge old) transaction.
+func (p *ReadPool) View(fn func(*Tx) error) error {
+	ptx, err := p.get()
+	if err != nil {
+		return err
+	}
+	defer p.put(ptx)
+	return fn(ptx.tx)
+}
+
+func (p *ReadPool) get() (pooledTx, error) {
+	now := time.Now()
+	var expired []pooledTx
+	p.mux.Lock()
+	for len(p.idle) > 0 {
+		ptx := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if now.Sub(ptx.created) < p.maxAge {
+			p.mux.Unlock()
+			if len(expired) > 0 {
+				// don't wait while holding ptx, a commit waiting for it could be what blocks the rollbacks
+				go rollbackAll(expired)
+			}
+			return ptx, nil
+		}
+		expired = append(expired, ptx)
+	}
+	p.mux.Unlock()
+	rollbackAll(expired)
+
+	tx, err := p.db.Begin(false)
+	return pooledTx{tx, now}, err
+}
+
+func (p *ReadPool) put(ptx pooledTx) {
+	p.mux.Lock()
+	if p.closed || time.Since(ptx.created) >= p.maxAge {
+		p.mux.Unlock()
+		ptx.tx.Rollback()
+		return
+	}
+	p.idle = append(p.idle, ptx)
+	p.mux.Unlock()
+}
+
+func (p *ReadPool) expireLoop() {
+	every := p.maxAge / 4
+	if every <= 0 {
+		every = time.Millisecond
+	}
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.expire(false)
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// expire rolls back the idle transactions that are too old, or all of them if all is set.
+func (p *ReadPool) expire(all bool) {
+	var expired []pooledTx
+	p.mux.Lock()
+	idle := p.idle[:0]
+	for _, ptx := range p.idle {
+		if all || time.Since(ptx.created) >= p.maxAge {
+			expired = append(expired, ptx)
+			continue
+		}
+		idle = append(idle, ptx)
+	}
+	p.idle = idle
+	p.mux.Unlock()
+	rollbackAll(expired)
+}
+
+// rollbackAll rolls back txs concurrently, outside of the pool's lock.
+// While a commit waits to remap the file, a Rollback releases its read lock then blocks on bbolt's meta lock
+// (held by a Begin waiting for the remap), so rolling them back one at a time would never release the rest.
+func rollbackAll(txs []pooledTx) {
+	if len(txs) == 1 {
+		txs[0].tx.Rollback()
+		return
+	}
+	var wg sync.WaitGroup
+	for _, ptx := range txs {
+		wg.Add(1)
+		go func(tx *Tx) {
+			defer wg.Done()
+			tx.Rollback()
+		}(ptx.tx)
+	}
+	wg.Wait()
+}
+
+// Close rolls back the idle transactions, the ones in use are rolled back when their View returns.
+func (p *ReadPool) Close() error {
+	p.mux.Lock()
+	if p.closed {
+		p.mux.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mux.Unlock()
+	close(p.stop)
+	p.expire(true)
+	return nil
+}
@@ -0,0 +1,115 @@
+package mbbolt
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"os"
+
+	"github.com/alpineiq/oerrs"
+	"go.etcd.io/bbolt"
+)
+
+// ErrCorruptDB is returned by the freelist check of Options.RepairOnOpen if the repair fails.
+const ErrCorruptDB = oerrs.String("corrupt db")
+
+// repairTxMaxSize is the max size of the transactions used to copy the data into the repaired db.
+const repairTxMaxSize = 64 << 20
+
+// bbolt's on disk layout, see page and meta in go.etcd.io/bbolt, the db is in the native byte order
+// which is little endian on every platform we run on.
+const (
+	boltPageHeaderSize = 16
+	boltMetaFreelist   = boltPageHeaderSize + 32
+	boltMetaPgid       = boltMetaFreelist + 8
+	boltMetaTxid       = boltMetaPgid + 8
+	boltMetaChecksum   = boltMetaTxid + 8
+	boltFreelistFlag   = 0x10
+	boltNoFreelist     = ^uint64(0)
+)
+
+// checkFreelist reads the current meta page of fp and returns ErrCorruptDB if the freelist page it points to isn't one,
+// bbolt panics while loading it so it has to be checked before opening the db.
+func checkFreelist(fp string) error {
+	f, err := os.Open(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	var meta [2][boltMetaChecksum + 8]byte
+	if _, err := f.ReadAt(meta[0][:], 0); err != nil {
+		return nil // new or truncated file, let bbolt deal with it
+	}
+	pageSize := int64(binary.LittleEndian.Uint32(meta[0][boltPageHeaderSize+8:]))
+	if pageSize == 0 {
+		return nil
+	}
+	if _, err := f.ReadAt(meta[1][:], pageSize); err != nil {
+		return nil
+	}
+
+	var cur []byte
+	for i := range meta {
+		m := meta[i][:]
+		h := fnv.New64a()
+		h.Write(m[boltPageHeaderSize:boltMetaChecksum])
+		if h.Sum64() != binary.LittleEndian.Uint64(m[boltMetaChecksum:]) {
+			continue
+		}
+		if cur == nil || binary.LittleEndian.Uint64(m[boltMetaTxid:]) > binary.LittleEndian.Uint64(cur[boltMetaTxid:]) {
+			cur = m
+		}
+	}
+	if cur == nil {
+		return nil // bbolt returns ErrChecksum / ErrInvalid itself
+	}
+
+	fl := binary.LittleEndian.Uint64(cur[boltMetaFreelist:])
+	if fl == boltNoFreelist {
+		return nil
+	}
+	if fl < 2 || fl >= binary.LittleEndian.Uint64(cur[boltMetaPgid:]) {
+		return oerrs.Errorf("%s: %w (freelist page %d out of range)", fp, ErrCorruptDB, fl)
+	}
+	var hdr [boltPageHeaderSize]byte
+	if _, err := f.ReadAt(hdr[:], int64(fl)*pageSize); err != nil {
+		return oerrs.Errorf("%s: %w (%v)", fp, ErrCorruptDB, err)
+	}
+	if binary.LittleEndian.Uint16(hdr[8:])&boltFreelistFlag == 0 {
+		return oerrs.Errorf("%s: %w (invalid freelist page %d)", fp, ErrCorruptDB, fl)
+	}
+	return nil
+}
+
+// repairBolt copies everything from fp into a fresh file and replaces fp with it,
+// opening the db read-only skips loading the freelist, and the copy gets a new one.
+func (opts *Options) repairBolt(fp string) (err error) {
+	bo := opts.boltOptsFor(fp)
+	bo.ReadOnly = true
+	src, err := bbolt.Open(fp, 0o600, bo)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	tmp := fp + ".repair"
+	os.Remove(tmp)
+	dst, err := bbolt.Open(tmp, 0o600, opts.BoltOpts())
+	if err != nil {
+		return
+	}
+
+	if err = bbolt.Compact(dst, src, repairTxMaxSize); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return oerrs.Errorf("repair %s: %w", fp, err)
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, fp)
+}
@@ -0,0 +1,153 @@
+package mbbolt
+
+import "errors"
+
+// Mutation is a single committed write, see DB.ReplicationSource.
+type Mutation struct {
+	Bucket string `json:"bucket" msgpack:"bucket"`
+	Key    []byte `json:"key" msgpack:"key"`
+	Value  []byte `json:"value,omitempty" msgpack:"value,omitempty"`
+	Delete bool   `json:"delete,omitempty" msgpack:"delete,omitempty"`
+}
+
+// ReplicationSource enables recording mutations and returns a channel that receives the mutations of every
+// committed write transaction, in commit order.
+// The channel must be drained, commits block while it's full, and it's closed when the db is closed.
+// Transactions that commit concurrently are sent by whichever of them publishes first, so a commit may return
+// before its own mutations were sent.
+// Only key puts / deletes are recorded, bucket deletes and sequence changes aren't.
+func (db *DB) ReplicationSource() <-chan []Mutation {
+	db.replOnce.Do(func() {
+		db.repl = make(chan []Mutation, 1024)
+		db.replOn.Store(true)
+	})
+	return db.repl
+}
+
+// ApplyReplication applies mutations received from a primary's ReplicationSource in a single transaction.
+func (db *DB) ApplyReplication(muts []Mutation) error {
+	return db.Update(func(tx *Tx) error {
+		for _, m := range muts {
+			if m.Delete {
+				if err := tx.DeleteB(m.Bucket, m.Key); err != nil && !errors.Is(err, ErrBucketNotFound) {
+					return err
+				}
+				continue
+			}
+			if err := tx.PutBytesB(m.Bucket, m.Key, m.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// record queues a mutation to be sent to the replication source and watchers once the tx is committed.
+func (tx *Tx) record(bucket string, key, val []byte, del bool) {
+	if (!tx.db.replOn.Load() && tx.db.watchers.Len() == 0) || !tx.Writable() {
+		return
+	}
+	if tx.muts == nil {
+		t := tx.db.queuePublish(tx.BBoltTx)
+		if tx.tickets != nil {
+			*tx.tickets = append(*tx.tickets, t)
+		}
+		tx.OnCommit(func() { tx.db.publish(t, tx.muts) })
+	}
+	m := Mutation{Bucket: bucket, Key: append([]byte(nil), key...), Delete: del}
+	if !del {
+		m.Value = append([]byte(nil), val...)
+	}
+	tx.muts = append(tx.muts, m)
+}
+
+// replTicket is a tx's place in the publish queue, bbolt runs commit handlers after releasing the writer lock,
+// so commits can reach publish out of order.
+type replTicket struct {
+	btx  *BBoltTx
+	id   int
+	muts []Mutation
+	done bool
+}
+
+// queuePublish reserves btx's place in the publish queue, it's called with the writer lock held,
+// so every queued tx except btx has either committed or rolled back by now.
+// Committed txs have lower ids, rolled back ones left theirs to btx so they're dropped, the ones that weren't
+// followed by another recording tx are dropped by dropTickets once the call that ran them returns.
+func (db *DB) queuePublish(btx *BBoltTx) *replTicket {
+	t := &replTicket{btx: btx, id: btx.ID()}
+	db.replMux.Lock()
+	defer db.replMux.Unlock()
+	q := db.replQueue[:0]
+	for _, p := range db.replQueue {
+		if p.btx == btx || p.id < t.id {
+			q = append(q, p)
+		}
+	}
+	db.replQueue = append(q, t)
+	return t
+}
+
+// publish marks t as committed and sends every committed tx at the head of the queue, in order.
+// Only one goroutine sends at a time, the others leave their muts to it, so a watcher can still write to the db.
+func (db *DB) publish(t *replTicket, muts []Mutation) {
+	db.replMux.Lock()
+	t.muts, t.done = muts, true
+	db.flushRepl()
+}
+
+// dropTickets removes the tickets of txs that ended without committing, it's called once the Update / Batch call
+// or the Begin'd tx that queued them is done, commit handlers have already run by then.
+func (db *DB) dropTickets(tickets []*replTicket) {
+	if len(tickets) == 0 {
+		return
+	}
+	db.replMux.Lock()
+	for _, t := range tickets {
+		if t.done {
+			continue
+		}
+		for i, p := range db.replQueue {
+			if p == t {
+				db.replQueue = append(db.replQueue[:i], db.replQueue[i+1:]...)
+				break
+			}
+		}
+	}
+	db.flushRepl()
+}
+
+// flushRepl sends every committed tx at the head of the queue, it's called with replMux locked and unlocks it.
+func (db *DB) flushRepl() {
+	if db.replFlushing {
+		db.replMux.Unlock()
+		return
+	}
+	db.replFlushing = true
+	for len(db.replQueue) > 0 && db.replQueue[0].done {
+		t := db.replQueue[0]
+		db.replQueue[0] = nil
+		db.replQueue = db.replQueue[1:]
+		db.replMux.Unlock()
+		db.send(t.muts)
+		db.replMux.Lock()
+	}
+	db.replFlushing = false
+	db.replMux.Unlock()
+}
+
+func (db *DB) send(muts []Mutation) {
+	db.watchers.ForEach(func(_ int64, fn func([]Mutation)) bool {
+		fn(muts)
+		return true
+	})
+	if db.replOn.Load() {
+		db.repl <- muts
+	}
+}
+
+func (db *DB) closeRepl() {
+	if db.replOn.Load() {
+		close(db.repl)
+	}
+}
@@ -0,0 +1,92 @@
+package mbbolt
+
+import (
+	"errors"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// NewRetryingDB wraps d so Get, Put, Delete, NextIndex and SetNextIndex are retried up to attempts times in total
+// while they fail with a transient error (bbolt.ErrTimeout, ErrViewTimeout or one of DefaultTransientErrors),
+// other errors are returned right away. backoff returns how long to wait before the given retry (starting at 1),
+// nil retries immediately. ForEachBytes isn't retried since fn would see the same keys again.
+func NewRetryingDB(d DBer, attempts int, backoff func(retry int) time.Duration) DBer {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &retryingDB{d: d, attempts: attempts, backoff: backoff}
+}
+
+type retryingDB struct {
+	d        DBer
+	attempts int
+	backoff  func(int) time.Duration
+}
+
+var (
+	_ DBer    = (*retryingDB)(nil)
+	_ batcher = (*retryingDB)(nil)
+)
+
+func (r *retryingDB) retry(fn func() error) (err error) {
+	for i := 0; ; i++ {
+		if err = fn(); err == nil || i+1 >= r.attempts || !isRetryable(err) {
+			return
+		}
+		if r.backoff != nil {
+			time.Sleep(r.backoff(i + 1))
+		}
+	}
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, bbolt.ErrTimeout) || errors.Is(err, ErrViewTimeout) {
+		return true
+	}
+	for _, e := range DefaultTransientErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *retryingDB) CurrentIndex(bucket string) uint64 { return r.d.CurrentIndex(bucket) }
+
+func (r *retryingDB) NextIndex(bucket string) (idx uint64, err error) {
+	err = r.retry(func() (err error) {
+		idx, err = r.d.NextIndex(bucket)
+		return
+	})
+	return
+}
+
+func (r *retryingDB) SetNextIndex(bucket string, index uint64) error {
+	return r.retry(func() error { return r.d.SetNextIndex(bucket, index) })
+}
+
+func (r *retryingDB) Buckets() []string { return r.d.Buckets() }
+
+func (r *retryingDB) Get(bucket, key string, v any) error {
+	return r.retry(func() error { return r.d.Get(bucket, key, v) })
+}
+
+func (r *retryingDB) ForEachBytes(bucket string, fn func(k, v []byte) error) error {
+	return r.d.ForEachBytes(bucket, fn)
+}
+
+func (r *retryingDB) Put(bucket, key string, v any) error {
+	return r.retry(func() error { return r.d.Put(bucket, key, v) })
+}
+
+func (r *retryingDB) Delete(bucket, key string) error {
+	return r.retry(func() error { return r.d.Delete(bucket, key) })
+}
+
+func (r *retryingDB) UseBatch(v bool) bool {
+	if b, ok := r.d.(batcher); ok {
+		return b.UseBatch(v)
+	}
+	return false
+}
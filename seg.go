@@ -5,12 +5,17 @@ import (
 	"hash/fnv"
 	"io"
 	"log"
+	"runtime"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/alpineiq/genh"
-	"github.com/alpineiq/otk"
+	"github.com/alpineiq/oerrs"
 )
 
+const ErrInvalidSegment = oerrs.String("invalid segment")
+
 func DefaultSegmentByKey(key string) uint64 {
 	h := fnv.New64()
 	io.WriteString(h, key)
@@ -70,19 +75,43 @@ func (s *SegDB) Get(bucket, key string, v any) error {
 	return s.db(key).Get(bucket, key, v)
 }
 
+// ForEachBytes calls fn for every key in bucket in every segment, segments without the bucket are skipped.
 func (s *SegDB) ForEachBytes(bucket string, fn func(k, v []byte) error) error {
 	for _, db := range s.dbs {
-		if err := db.ForEachBytes(bucket, fn); err != nil {
+		if err := db.View(func(tx *Tx) error {
+			if tx.Bucket(bucket) == nil {
+				return nil
+			}
+			return tx.ForEachBytes(bucket, fn)
+		}); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// GetFrom is Get from a specific segment, bypassing SegmentFn, it's meant for resharding and repairing misplaced keys.
+func (s *SegDB) GetFrom(segment int, bucket, key string, v any) error {
+	db, err := s.segment(segment)
+	if err != nil {
+		return err
+	}
+	return db.Get(bucket, key, v)
+}
+
 func (s *SegDB) Put(bucket, key string, v any) error {
 	return s.db(key).Put(bucket, key, v)
 }
 
+// PutIn is Put into a specific segment, bypassing SegmentFn, see GetFrom.
+func (s *SegDB) PutIn(segment int, bucket, key string, v any) error {
+	db, err := s.segment(segment)
+	if err != nil {
+		return err
+	}
+	return db.Put(bucket, key, v)
+}
+
 func (s *SegDB) Delete(bucket, key string) error {
 	return s.db(key).Delete(bucket, key)
 }
@@ -105,12 +134,45 @@ func (s *SegDB) CurrentIndex(bucket string) (idx uint64) {
 	return
 }
 
+// Buckets returns the sorted union of the buckets of every segment, the segments are read concurrently
+// and a name is only copied the first time it's seen, since most segments usually have the same buckets.
 func (s *SegDB) Buckets() []string {
-	var set otk.Set
-	for _, db := range s.dbs {
-		set = set.Add(db.Buckets()...)
+	var (
+		mux  sync.Mutex
+		seen = map[string]struct{}{}
+		wg   sync.WaitGroup
+		next atomic.Int64
+	)
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(s.dbs) {
+		workers = len(s.dbs)
+	}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := int(next.Add(1) - 1); i < len(s.dbs); i = int(next.Add(1) - 1) {
+				s.dbs[i].View(func(tx *Tx) error {
+					return tx.ForEach(func(name []byte, _ *Bucket) error {
+						mux.Lock()
+						if _, ok := seen[string(name)]; !ok {
+							seen[string(name)] = struct{}{}
+						}
+						mux.Unlock()
+						return nil
+					})
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	out := make([]string, 0, len(seen))
+	for name := range seen {
+		out = append(out, name)
 	}
-	return set.SortedKeys()
+	sort.Strings(out)
+	return out
 }
 
 func (s *SegDB) Backup(w io.Writer) (int64, error) {
@@ -127,3 +189,10 @@ func (s *SegDB) UseBatch(v bool) (old bool) {
 func (s *SegDB) db(key string) *DB {
 	return s.dbs[s.SegmentFn(key)%uint64(len(s.dbs))]
 }
+
+func (s *SegDB) segment(i int) (*DB, error) {
+	if i < 0 || i >= len(s.dbs) {
+		return nil, ErrInvalidSegment
+	}
+	return s.dbs[i], nil
+}
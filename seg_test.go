@@ -2,6 +2,7 @@ package mbbolt
 
 import (
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -24,4 +25,67 @@ func TestSegDB(t *testing.T) {
 			}
 		}
 	})
+	t.Run("SparseBucket", func(t *testing.T) {
+		seg := NewSegDB(t.TempDir(), ".db", nil, 32)
+		defer seg.Close()
+		seg.SegmentFn = func(key string) uint64 {
+			n, _ := strconv.Atoi(key)
+			return uint64(n%3) * 10 // only segments 0, 10 and 20
+		}
+		for i := 0; i < 30; i++ {
+			if err := seg.Put("sparse", strconv.Itoa(i), i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		seen := map[string]bool{}
+		if err := seg.ForEachBytes("sparse", func(k, v []byte) error {
+			seen[string(k)] = true
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if len(seen) != 30 {
+			t.Fatalf("expected 30 keys, got %d", len(seen))
+		}
+	})
+	t.Run("Buckets", func(t *testing.T) {
+		seg := NewSegDB(t.TempDir(), ".db", nil, 16)
+		defer seg.Close()
+		// every segment has "common" plus one of seg0-seg4
+		for i := range seg.dbs {
+			for _, bkt := range []string{"common", "seg" + strconv.Itoa(i%5)} {
+				if err := seg.PutIn(i, bkt, "k", i); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		exp := "common,seg0,seg1,seg2,seg3,seg4"
+		if got := strings.Join(seg.Buckets(), ","); got != exp {
+			t.Fatalf("expected %s, got %s", exp, got)
+		}
+	})
+	t.Run("PutInGetFrom", func(t *testing.T) {
+		seg := NewSegDB(t.TempDir(), ".db", nil, 4)
+		defer seg.Close()
+		key := "k"
+		other := int(DefaultSegmentByKey(key)%4+1) % 4
+		if err := seg.PutIn(other, "b", key, 42); err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		if err := seg.GetFrom(other, "b", key, &v); err != nil || v != 42 {
+			t.Fatalf("unexpected %v (%v)", v, err)
+		}
+		if err := seg.Get("b", key, &v); err == nil {
+			t.Fatal("expected the key to be missing from its hashed segment")
+		}
+		for _, i := range []int{-1, 4} {
+			if err := seg.PutIn(i, "b", key, 1); err != ErrInvalidSegment {
+				t.Fatalf("%d: expected ErrInvalidSegment, got %v", i, err)
+			}
+			if err := seg.GetFrom(i, "b", key, &v); err != ErrInvalidSegment {
+				t.Fatalf("%d: expected ErrInvalidSegment, got %v", i, err)
+			}
+		}
+	})
 }
@@ -0,0 +1,175 @@
+package mbbolt
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+type (
+	// FragReport is an estimate of how much of the db file is wasted.
+	FragReport struct {
+		Size      int64 `json:"size"`
+		PageSize  int   `json:"pageSize"`
+		FreePages int   `json:"freePages"`
+		FreeBytes int64 `json:"freeBytes"`
+
+		// Wasted is the free pages plus the unused space in allocated leaf / branch pages.
+		Wasted int64 `json:"wasted"`
+		// Ratio is Wasted / Size.
+		Ratio float64 `json:"ratio"`
+
+		Buckets []BucketFrag `json:"buckets"`
+	}
+
+	BucketFrag struct {
+		Name  string `json:"name"`
+		Keys  int    `json:"keys"`
+		Alloc int64  `json:"alloc"`
+		InUse int64  `json:"inUse"`
+		// Utilization is InUse / Alloc, inlined buckets are always 1.
+		Utilization float64 `json:"utilization"`
+	}
+
+	// BucketInfo describes a top level bucket, see SchemaReport.
+	BucketInfo struct {
+		Name string `json:"name"`
+		// Keys includes the names of nested buckets, but not their keys.
+		Keys     int    `json:"keys"`
+		Sequence uint64 `json:"sequence"`
+		// Bytes is the space used by the bucket's pages, nested buckets included.
+		Bytes int64 `json:"bytes"`
+	}
+)
+
+// FragmentationReport reads the freelist and the stats of every top level bucket to estimate how fragmented the db is,
+// it doesn't modify anything and can be used to decide if compacting is worth it.
+func (db *DB) FragmentationReport() (r FragReport, err error) {
+	bdb := db.Raw()
+	st := bdb.Stats()
+	r.PageSize = bdb.Info().PageSize
+	r.FreePages = st.FreePageN + st.PendingPageN
+	r.FreeBytes = int64(r.FreePages) * int64(r.PageSize)
+
+	err = db.View(func(tx *Tx) error {
+		r.Size = tx.Size()
+		return tx.ForEach(func(name []byte, b *Bucket) error {
+			bs := b.Stats()
+			bf := BucketFrag{
+				Name:  string(name),
+				Keys:  bs.KeyN,
+				Alloc: int64(bs.LeafAlloc + bs.BranchAlloc),
+				InUse: int64(bs.LeafInuse + bs.BranchInuse),
+			}
+			if bf.Utilization = 1; bf.Alloc > 0 {
+				bf.Utilization = float64(bf.InUse) / float64(bf.Alloc)
+			}
+			r.Wasted += bf.Alloc - bf.InUse
+			r.Buckets = append(r.Buckets, bf)
+			return nil
+		})
+	})
+
+	r.Wasted += r.FreeBytes
+	if r.Size > 0 {
+		r.Ratio = float64(r.Wasted) / float64(r.Size)
+	}
+	return
+}
+
+// SchemaReport returns the name, key count, sequence and size of every top level bucket, all read in one transaction.
+func (db *DB) SchemaReport() (out []BucketInfo, err error) {
+	err = db.View(func(tx *Tx) error {
+		return tx.ForEach(func(name []byte, b *Bucket) error {
+			bs := b.Stats()
+			bi := BucketInfo{
+				Name:     string(name),
+				Keys:     bs.KeyN,
+				Sequence: b.Sequence(),
+				Bytes:    int64(bs.BranchInuse + bs.LeafInuse + bs.InlineBucketInuse),
+			}
+			if bs.BucketN > 1 { // KeyN counts the keys of nested buckets too
+				bi.Keys = 0
+				c := b.Cursor()
+				for k, _ := c.First(); k != nil; k, _ = c.Next() {
+					bi.Keys++
+				}
+			}
+			out = append(out, bi)
+			return nil
+		})
+	})
+	return
+}
+
+// StatsDelta returns a func that returns the bbolt stats accumulated since its previous call (or since StatsDelta
+// for the first one), for emitting rates periodically. The freelist fields and OpenTxN are current values, not deltas.
+// The counters start over when the file is reopened (CompactInPlace, OpenFollower), the delta then covers the new handle only.
+func (db *DB) StatsDelta() func() Stats {
+	var mux sync.Mutex
+	bdb := db.Raw()
+	last := bdb.Stats()
+	return func() Stats {
+		mux.Lock()
+		defer mux.Unlock()
+		cur := db.Raw()
+		st := cur.Stats()
+		if cur != bdb {
+			bdb, last = cur, Stats{}
+		}
+		d := st.Sub(&last)
+		d.OpenTxN = st.OpenTxN
+		last = st
+		return d
+	}
+}
+
+// valueSizeBounds are the exclusive upper bounds of the value size histogram buckets, the last bucket has no limit.
+var valueSizeBounds = [...]int64{256, 1 << 10, 16 << 10, 256 << 10, 1 << 20}
+
+type (
+	// Histogram is the number of values written and read by size, see Options.TrackValueSizes.
+	Histogram []HistogramBucket
+
+	HistogramBucket struct {
+		// Max is the exclusive upper bound of the bucket, it's -1 for the last one.
+		Max     int64 `json:"max"`
+		Written int64 `json:"written"`
+		Read    int64 `json:"read"`
+	}
+
+	valueSizes struct {
+		written, read [len(valueSizeBounds) + 1]atomic.Int64
+	}
+)
+
+func (vs *valueSizes) add(read bool, size int) {
+	if vs == nil {
+		return
+	}
+	i := 0
+	for i < len(valueSizeBounds) && int64(size) >= valueSizeBounds[i] {
+		i++
+	}
+	if read {
+		vs.read[i].Add(1)
+	} else {
+		vs.written[i].Add(1)
+	}
+}
+
+// ValueSizeHistogram returns the sizes of the values written and read since the db was opened,
+// it's nil unless Options.TrackValueSizes is set.
+func (db *DB) ValueSizeHistogram() (h Histogram) {
+	vs := db.valueSizes
+	if vs == nil {
+		return
+	}
+	h = make(Histogram, len(vs.written))
+	for i := range h {
+		h[i] = HistogramBucket{Max: -1, Written: vs.written[i].Load(), Read: vs.read[i].Load()}
+		if i < len(valueSizeBounds) {
+			h[i].Max = valueSizeBounds[i]
+		}
+	}
+	return
+}
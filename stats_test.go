@@ -0,0 +1,172 @@
+package mbbolt
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestFragmentationReport(t *testing.T) {
+	const N = 10000
+	tmp := t.TempDir()
+	fresh, err := Open(filepath.Join(tmp, "fresh.db"), nil)
+	dieIf(t, err)
+	defer fresh.Close()
+	frag, err := Open(filepath.Join(tmp, "frag.db"), nil)
+	dieIf(t, err)
+	defer frag.Close()
+
+	for _, db := range []*DB{fresh, frag} {
+		dieIf(t, db.Update(func(tx *Tx) error {
+			for i := 0; i < N; i++ {
+				if err := tx.PutBytes("b", benchKey(uint64(i)), benchVal); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+	}
+
+	dieIf(t, frag.Update(func(tx *Tx) error {
+		for i := 0; i < N; i++ {
+			if i%10 == 0 {
+				continue
+			}
+			if err := tx.Delete("b", benchKey(uint64(i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+
+	fr, err := fresh.FragmentationReport()
+	dieIf(t, err)
+	dr, err := frag.FragmentationReport()
+	dieIf(t, err)
+	t.Logf("fresh: %+v", fr)
+	t.Logf("frag: %+v", dr)
+
+	if len(fr.Buckets) != 1 || fr.Buckets[0].Name != "b" || fr.Buckets[0].Keys != N {
+		t.Fatalf("unexpected buckets: %+v", fr.Buckets)
+	}
+	if dr.Buckets[0].Keys != N/10 {
+		t.Fatalf("unexpected buckets: %+v", dr.Buckets)
+	}
+	if dr.Ratio <= fr.Ratio || dr.FreePages <= fr.FreePages {
+		t.Fatalf("expected frag.db to be more fragmented: %v <= %v", dr.Ratio, fr.Ratio)
+	}
+}
+
+func TestValueSizeHistogram(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.TrackValueSizes = true
+	db, err := Open(t.TempDir()+"/x.db", opts)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i, size := range []int{10, 255, 256, 2000, 2 << 20} {
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), make([]byte, size)))
+	}
+	_, err = db.GetBytes("b", "3")
+	dieIf(t, err)
+
+	h := db.ValueSizeHistogram()
+	written := []int64{2, 1, 1, 0, 0, 1}
+	for i, b := range h {
+		if b.Written != written[i] {
+			t.Fatalf("bucket %d: expected %d writes, got %+v", i, written[i], h)
+		}
+	}
+	if h[2].Read != 1 || h[len(h)-1].Max != -1 {
+		t.Fatalf("unexpected histogram: %+v", h)
+	}
+}
+
+func TestStatsDelta(t *testing.T) {
+	const N = 10
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.PutBytes("b", "k", benchVal))
+
+	delta := db.StatsDelta()
+	for i := 0; i < N; i++ {
+		dieIf(t, db.View(func(tx *Tx) error { return nil }))
+		dieIf(t, db.PutBytes("b", strconv.Itoa(i), benchVal))
+	}
+	if d := delta(); d.TxN != N || d.TxStats.Write < N {
+		t.Fatalf("expected %d read txs and at least %d writes, got %d and %d", N, N, d.TxN, d.TxStats.Write)
+	}
+	if d := delta(); d.TxN != 0 || d.TxStats.Write != 0 {
+		t.Fatalf("expected the baseline to be reset: %+v", d)
+	}
+
+	// the counters of the reopened file start from 0
+	dieIf(t, db.CompactInPlace())
+	dieIf(t, db.View(func(tx *Tx) error { return nil }))
+	if d := delta(); d.TxN < 1 || d.TxN >= N {
+		t.Fatalf("expected the delta to only cover the reopened file, got %d read txs", d.TxN)
+	}
+}
+
+func TestSchemaReport(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	exp := []BucketInfo{{Name: "a", Keys: 100}, {Name: "b", Keys: 3}, {Name: "empty"}, {Name: "nested", Keys: 2}}
+	dieIf(t, db.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			if _, err := tx.NextIndex("a"); err != nil {
+				return err
+			}
+			if err := tx.PutValue("a", strconv.Itoa(i), i); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < 3; i++ {
+			if err := tx.PutValue("b", strconv.Itoa(i), i); err != nil {
+				return err
+			}
+		}
+		if err := tx.SetNextIndex("b", 41); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists("empty"); err != nil {
+			return err
+		}
+		nb, err := tx.CreateBucketIfNotExists("nested")
+		if err != nil {
+			return err
+		}
+		child, err := nb.CreateBucket([]byte("child"))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			if err := child.Put([]byte(strconv.Itoa(i)), []byte("v")); err != nil {
+				return err
+			}
+		}
+		return nb.Put([]byte("k"), []byte("v"))
+	}))
+	exp[0].Sequence, exp[1].Sequence = db.CurrentIndex("a"), db.CurrentIndex("b")
+
+	r, err := db.SchemaReport()
+	dieIf(t, err)
+	if len(r) != len(exp) {
+		t.Fatalf("expected %d buckets, got %+v", len(exp), r)
+	}
+	for i, bi := range r {
+		if bi.Bytes <= 0 && bi.Name != "empty" {
+			t.Fatalf("%s: expected a size, got %d", bi.Name, bi.Bytes)
+		}
+		bi.Bytes = 0
+		if bi != exp[i] {
+			t.Fatalf("expected %+v, got %+v", exp[i], bi)
+		}
+	}
+	if exp[0].Sequence != 100 || exp[1].Sequence != 41 {
+		t.Fatalf("unexpected sequences: %d %d", exp[0].Sequence, exp[1].Sequence)
+	}
+}
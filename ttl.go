@@ -0,0 +1,166 @@
+package mbbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// expiryBucketSuffix is appended to a bucket's name to get the bucket holding its expiries,
+// it maps 'k'+key to the expiry (unix nano) and 't'+expiry+key to nothing so the reaper can scan them by time.
+const expiryBucketSuffix = "__exp"
+
+// isInternalBucket returns true for the companion buckets used for the insertion order and expiries.
+func isInternalBucket(name string) bool {
+	return strings.HasSuffix(name, orderBucketSuffix) || strings.HasSuffix(name, expiryBucketSuffix) || name == reencodeBucket
+}
+
+// SetExpiry sets the time key expires at, it's deleted by ReapExpired once it's due, a zero at clears it.
+// The value itself isn't touched, and overwriting it keeps the expiry, deleting it clears it.
+func (tx *Tx) SetExpiry(bucket, key string, at time.Time) error {
+	if at.IsZero() {
+		return tx.ClearExpiry(bucket, key)
+	}
+	if b := tx.Bucket(bucket); b == nil || b.Get(unsafeBytes(key)) == nil {
+		return ErrKeyNotFound
+	}
+	eb, err := tx.CreateBucketIfNotExists(bucket + expiryBucketSuffix)
+	if err != nil {
+		return err
+	}
+	tx.writes++
+	if err = clearExpiry(eb, unsafeBytes(key)); err != nil {
+		return err
+	}
+	tk := binary.BigEndian.AppendUint64([]byte{'t'}, uint64(at.UnixNano()))
+	if err = eb.Put(append(tk, key...), nil); err != nil {
+		return err
+	}
+	return eb.Put(append([]byte{'k'}, key...), tk[1:])
+}
+
+// ClearExpiry removes the expiry of key, if it has one.
+func (tx *Tx) ClearExpiry(bucket, key string) error {
+	if eb := tx.Bucket(bucket + expiryBucketSuffix); eb != nil {
+		tx.writes++
+		return clearExpiry(eb, unsafeBytes(key))
+	}
+	return nil
+}
+
+// Expiry returns the time key expires at, ok is false if it doesn't have one.
+func (tx *Tx) Expiry(bucket, key string) (at time.Time, ok bool) {
+	if eb := tx.Bucket(bucket + expiryBucketSuffix); eb != nil {
+		if ts := eb.Get(append([]byte{'k'}, key...)); ts != nil {
+			return time.Unix(0, int64(binary.BigEndian.Uint64(ts))), true
+		}
+	}
+	return
+}
+
+// ReapExpired deletes the keys of bucket that expire at or before now, along with their expiries.
+func (tx *Tx) ReapExpired(bucket string, now time.Time) (n int, err error) {
+	eb := tx.Bucket(bucket + expiryBucketSuffix)
+	b := tx.Bucket(bucket)
+	if eb == nil || b == nil {
+		return
+	}
+
+	// collect first, bbolt doesn't allow modifying a bucket while iterating it
+	var keys [][]byte
+	end := binary.BigEndian.AppendUint64([]byte{'t'}, uint64(now.UnixNano()))
+	c := eb.Cursor()
+	for tk, _ := c.Seek([]byte{'t'}); tk != nil && tk[0] == 't' && bytes.Compare(tk[:9], end) <= 0; tk, _ = c.Next() {
+		keys = append(keys, append([]byte(nil), tk[9:]...))
+	}
+	for _, k := range keys {
+		if b.Get(k) == nil {
+			err = clearExpiry(eb, k)
+		} else if err = tx.del(b, bucket, k); err == nil {
+			n++
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// clearExpiry is called by Tx.del so a deleted then recreated key doesn't inherit the old expiry.
+func (tx *Tx) clearExpiry(bucket string, key []byte) error {
+	if eb := tx.Bucket(bucket + expiryBucketSuffix); eb != nil {
+		return clearExpiry(eb, key)
+	}
+	return nil
+}
+
+func clearExpiry(eb *Bucket, key []byte) error {
+	kk := append([]byte{'k'}, key...)
+	ts := eb.Get(kk)
+	if ts == nil {
+		return nil
+	}
+	if err := eb.Delete(append(append([]byte{'t'}, ts...), key...)); err != nil {
+		return err
+	}
+	return eb.Delete(kk)
+}
+
+func (db *DB) SetExpiry(bucket, key string, at time.Time) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.SetExpiry(bucket, key, at)
+	})
+}
+
+func (db *DB) ClearExpiry(bucket, key string) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.ClearExpiry(bucket, key)
+	})
+}
+
+func (db *DB) Expiry(bucket, key string) (at time.Time, ok bool) {
+	db.View(func(tx *Tx) error {
+		at, ok = tx.Expiry(bucket, key)
+		return nil
+	})
+	return
+}
+
+// ReapExpired runs Tx.ReapExpired with the current time in its own transaction.
+func (db *DB) ReapExpired(bucket string) (n int, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		n, err = tx.ReapExpired(bucket, time.Now())
+		return
+	})
+	return
+}
+
+// StartReaper calls ReapExpired for every bucket every interval until the returned func is called or the db is closed.
+func (db *DB) StartReaper(interval time.Duration, buckets ...string) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+			if db.closed.Load() {
+				return
+			}
+			for _, bkt := range buckets {
+				if _, err := db.ReapExpired(bkt); err != nil && err != ErrReadOnly {
+					log.Printf("mbbolt: reap %s/%s: %v", db.path, bkt, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
@@ -1,6 +1,7 @@
 package mbbolt
 
 import (
+	"bytes"
 	"log"
 	"math/big"
 )
@@ -13,18 +14,74 @@ type (
 type Tx struct {
 	*BBoltTx
 	db *DB
+
+	memo    map[bucketKey]any // see TypedTx.WithCache
+	muts    []Mutation        // see DB.ReplicationSource
+	tickets *[]*replTicket    // publish tickets of the Update / Batch call or Begin'd tx, see dropTickets
+
+	writes int // see DB.BatchIsolated
+
+	h       *boltHandle // set by DB.Begin, released by untrack
+	tracked bool        // started by DB.Begin and counted by DB.OpenTxCount until it's closed
+}
+
+type bucketKey struct{ bucket, key string }
+
+// Commit commits a tx started with DB.Begin.
+func (tx *Tx) Commit() error {
+	defer tx.untrack()
+	return tx.BBoltTx.Commit()
+}
+
+// Rollback rolls back a tx started with DB.Begin.
+func (tx *Tx) Rollback() error {
+	defer tx.untrack()
+	return tx.BBoltTx.Rollback()
+}
+
+func (tx *Tx) untrack() {
+	if tx.tracked {
+		tx.tracked = false
+		tx.db.openTxs(tx.Writable()).Add(-1)
+		tx.db.release(tx.h)
+		if tx.tickets != nil {
+			tx.db.dropTickets(*tx.tickets)
+		}
+	}
+}
+
+// invalidate drops the cached decoded value of key if TypedTx.WithCache was used.
+func (tx *Tx) invalidate(bucket string, key []byte) {
+	if tx.memo != nil {
+		delete(tx.memo, bucketKey{bucket, string(key)})
+	}
 }
 
 func (tx *Tx) CreateBucketIfNotExists(bucket string) (*Bucket, error) {
-	return tx.BBoltTx.CreateBucketIfNotExists(unsafeBytes(bucket))
+	exists := tx.BBoltTx.Bucket(unsafeBytes(bucket)) != nil
+	b, err := tx.BBoltTx.CreateBucketIfNotExists(unsafeBytes(bucket))
+	if err == nil {
+		if !exists {
+			tx.writes++
+		}
+	}
+	return b, err
 }
 
 func (tx *Tx) Bucket(bucket string) *Bucket {
 	return tx.BBoltTx.Bucket(unsafeBytes(bucket))
 }
 
+// readBucket returns a nil bucket and a nil error if the bucket doesn't exist and AutoCreateBuckets is set.
+func (tx *Tx) readBucket(bucket string) (*Bucket, error) {
+	if b := tx.Bucket(bucket); b != nil || tx.db.autoBuckets {
+		return b, nil
+	}
+	return nil, ErrBucketNotFound
+}
+
 func (tx *Tx) MustBucket(bucket string) *Bucket {
-	if b := tx.BBoltTx.Bucket(unsafeBytes(bucket)); b != nil {
+	if b := tx.Bucket(bucket); b != nil {
 		return b
 	}
 
@@ -36,22 +93,124 @@ func (tx *Tx) MustBucket(bucket string) *Bucket {
 }
 
 func (tx *Tx) GetBytes(bucket, key string, clone bool) (out []byte) {
+	return tx.GetBytesB(bucket, unsafeBytes(key), clone)
+}
+
+// GetBytesB is GetBytes with a binary key.
+// If checksums are enabled and the value is corrupt, it returns nil, use GetBytesErr to tell it from a missing key.
+func (tx *Tx) GetBytesB(bucket string, key []byte, clone bool) (out []byte) {
+	out, _ = tx.getBytes(bucket, key, clone)
+	return
+}
+
+// GetBytesErr is GetBytes but returns a *ChecksumError if checksums are enabled and the value is corrupt,
+// a missing key returns nil without an error.
+func (tx *Tx) GetBytesErr(bucket, key string, clone bool) ([]byte, error) {
+	return tx.getBytes(bucket, unsafeBytes(key), clone)
+}
+
+func (tx *Tx) getBytes(bucket string, key []byte, clone bool) (out []byte, err error) {
 	if b := tx.Bucket(bucket); b != nil {
-		if out = b.Get(unsafeBytes(key)); clone {
-			out = append([]byte(nil), out...)
+		if out, err = tx.db.decodeValue(bucket, key, b.Get(key)); out != nil {
+			tx.db.valueSizes.add(true, len(out))
 		}
+		if clone && out != nil && err == nil {
+			out = append(make([]byte, 0, len(out)), out...)
+		}
+		return
+	}
+	return
+}
+
+// GetMulti resolves the bucket once and returns the values of keys in order, missing (or corrupt) keys are nil.
+// If clone is false, the returned slices point into the mmap and are only valid until the tx is closed,
+// and must not be modified.
+func (tx *Tx) GetMulti(bucket string, keys []string, clone bool) (out [][]byte) {
+	out, _ = tx.GetMultiErr(bucket, keys, clone)
+	return
+}
+
+// GetMultiErr is GetMulti but also returns the *ChecksumError of every corrupt value at its key's index,
+// errs is nil if none of them is.
+func (tx *Tx) GetMultiErr(bucket string, keys []string, clone bool) (out [][]byte, errs []error) {
+	out = make([][]byte, len(keys))
+	b := tx.Bucket(bucket)
+	if b == nil {
 		return
 	}
+	for i, key := range keys {
+		v, err := tx.db.decodeValue(bucket, unsafeBytes(key), b.Get(unsafeBytes(key)))
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(keys))
+			}
+			errs[i] = err
+			continue
+		}
+		if clone && v != nil {
+			v = append([]byte(nil), v...)
+		}
+		out[i] = v
+	}
 	return
 }
 
 func (tx *Tx) PutBytes(bucket, key string, val []byte) error {
+	return tx.PutBytesB(bucket, unsafeBytes(key), val)
+}
+
+// PutBytesB is PutBytes with a binary key.
+func (tx *Tx) PutBytesB(bucket string, key, val []byte) error {
+	if err := tx.db.checkSize(bucket, key, val); err != nil {
+		return err
+	}
 	if b := tx.MustBucket(bucket); b != nil {
-		return b.Put(unsafeBytes(key), val)
+		return tx.put(b, bucket, key, val)
 	}
 	return ErrBucketNotFound
 }
 
+// put is the common path of every write, it keeps the caches, the insertion order and the replication log in sync.
+func (tx *Tx) put(b *Bucket, bucket string, key, val []byte) error {
+	tx.invalidate(bucket, key)
+	if err := tx.trackOrder(bucket, b, key, false); err != nil {
+		return err
+	}
+	if err := b.Put(key, tx.db.encodeValue(val)); err != nil {
+		return err
+	}
+	tx.writes++
+	tx.db.valueSizes.add(false, len(val))
+	tx.db.bloomAdd(bucket, key)
+	tx.record(bucket, key, val, false)
+	return nil
+}
+
+func (tx *Tx) del(b *Bucket, bucket string, key []byte) error {
+	tx.invalidate(bucket, key)
+	if err := tx.trackOrder(bucket, b, key, true); err != nil {
+		return err
+	}
+	if err := tx.clearExpiry(bucket, key); err != nil {
+		return err
+	}
+	if err := b.Delete(key); err != nil {
+		return err
+	}
+	tx.writes++
+	tx.record(bucket, key, nil, true)
+	return nil
+}
+
+// GetSet stores newVal and returns a copy of the previous value, nil if key didn't exist.
+func (tx *Tx) GetSet(bucket, key string, newVal []byte) (old []byte, err error) {
+	if old, err = tx.getBytes(bucket, unsafeBytes(key), true); err != nil {
+		return
+	}
+	err = tx.PutBytes(bucket, key, newVal)
+	return
+}
+
 func (tx *Tx) GetValue(bucket, key string, out any) error {
 	return tx.GetAny(bucket, key, out, tx.db.unmarshalFn)
 }
@@ -61,16 +220,24 @@ func (tx *Tx) PutValue(bucket, key string, val any) error {
 }
 
 func (tx *Tx) Delete(bucket, key string) error {
+	return tx.DeleteB(bucket, unsafeBytes(key))
+}
+
+// DeleteB is Delete with a binary key.
+func (tx *Tx) DeleteB(bucket string, key []byte) error {
 	if b := tx.Bucket(bucket); b != nil {
-		return b.Delete(unsafeBytes(key))
+		return tx.del(b, bucket, key)
 	}
 	return ErrBucketNotFound
 }
 
 func (tx *Tx) DeleteBucket(bucket string) error {
+	tx.writes++
+	tx.bloomDropBucket(bucket)
 	return tx.BBoltTx.DeleteBucket([]byte(bucket))
 }
 
+// GetAny unmarshals the value of key into out, or returns ErrKeyNotFound if the key doesn't exist.
 func (tx *Tx) GetAny(bucket, key string, out any, unmarshalFn UnmarshalFn) error {
 	return tx.getAny(false, bucket, key, out, unmarshalFn)
 }
@@ -81,18 +248,30 @@ func (tx *Tx) getAny(createBucket bool, bucket, key string, out any, unmarshalFn
 		if b, err = tx.CreateBucketIfNotExists(bucket); err != nil {
 			return
 		}
-	} else {
-		if b = tx.Bucket(bucket); b == nil {
-			return ErrBucketNotFound
-		}
+	} else if b, err = tx.readBucket(bucket); err != nil {
+		return
 	}
 
-	val := b.Get(unsafeBytes(key))
+	var val []byte
+	if b != nil {
+		val = b.Get(unsafeBytes(key))
+	}
+	if val == nil {
+		return ErrKeyNotFound
+	}
+	if val, err = tx.db.decodeValue(bucket, unsafeBytes(key), val); err != nil {
+		return
+	}
+	if val != nil {
+		tx.db.valueSizes.add(true, len(val))
+	}
+	if s, ok := out.(*string); ok && tx.db.rawStrings {
+		*s = string(val)
+		return nil
+	}
 	switch out := out.(type) {
 	case *[]byte:
 		*out = append([]byte(nil), val...)
-	// case *string:
-	// 	*out = string(val)
 	default:
 		if unmarshalFn == nil {
 			unmarshalFn = DefaultUnmarshalFn
@@ -103,28 +282,178 @@ func (tx *Tx) getAny(createBucket bool, bucket, key string, out any, unmarshalFn
 }
 
 func (tx *Tx) PutAny(bucket, key string, val any, marshalFn MarshalFn) error {
-	switch val := val.(type) {
-	case []byte:
-		return tx.PutBytes(bucket, key, val)
-	// case string:
-	// 	return tx.PutBytes(bucket, key, unsafeBytes(val))
-	default:
+	_, err := tx.putAny(bucket, key, val, marshalFn)
+	return err
+}
+
+// PutValueBytes is PutValue that also returns the marshaled value, so it can be journaled or hashed without marshaling again.
+// It's the value as GetBytes returns it, without the checksum stored with it if Options.VerifyChecksums is set,
+// and nil if the put failed. The returned slice must not be modified if val was a []byte or a raw string.
+func (tx *Tx) PutValueBytes(bucket, key string, val any) ([]byte, error) {
+	return tx.putAny(bucket, key, val, tx.db.marshalFn)
+}
+
+func (tx *Tx) putAny(bucket, key string, val any, marshalFn MarshalFn) (b []byte, err error) {
+	if s, ok := val.(string); ok && tx.db.rawStrings {
+		b = unsafeBytes(s)
+	} else if v, ok := val.([]byte); ok {
+		b = v
+	} else {
 		if marshalFn == nil {
 			marshalFn = DefaultMarshalFn
 		}
-		b, err := marshalFn(val)
-		if err != nil {
-			return err
+		if b, err = marshalFn(val); err != nil {
+			return nil, err
 		}
-		return tx.PutBytes(bucket, key, b)
 	}
+	if err = tx.PutBytes(bucket, key, b); err != nil {
+		return nil, err
+	}
+	return
 }
 
 func (tx *Tx) ForEachBytes(bucket string, fn func(k, v []byte) error) error {
-	if b := tx.Bucket(bucket); b != nil {
-		return b.ForEach(fn)
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return err
 	}
-	return ErrBucketNotFound
+	return b.ForEach(tx.decodeFn(bucket, fn))
+}
+
+// ForEachBytesFrom is ForEachBytes starting at the first key >= start.
+func (tx *Tx) ForEachBytesFrom(bucket string, start []byte, fn func(k, v []byte) error) error {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return err
+	}
+	fn = tx.decodeFn(bucket, fn)
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForEachBytesTransform is ForEachBytes with every value passed through transform before fn (e.g. to decompress it),
+// transform gets a copy of the value in a buffer reused between keys so it's allowed to modify it in place and return it.
+// Neither the buffer nor transform's result can be used after fn returns. Nested buckets are passed to fn as is.
+func (tx *Tx) ForEachBytesTransform(bucket string, transform func(v []byte) ([]byte, error), fn func(k, v []byte) error) error {
+	var buf []byte
+	return tx.ForEachBytes(bucket, func(k, v []byte) (err error) {
+		if v != nil {
+			buf = append(buf[:0], v...)
+			if v, err = transform(buf); err != nil {
+				return
+			}
+		}
+		return fn(k, v)
+	})
+}
+
+// ForEachBytesReverse is ForEachBytes in descending key order, fn's error stops the walk and is returned as-is.
+func (tx *Tx) ForEachBytesReverse(bucket string, fn func(k, v []byte) error) error {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return err
+	}
+	fn = tx.decodeFn(bucket, fn)
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeFn wraps fn to strip / verify the values' checksums if they're enabled.
+func (tx *Tx) decodeFn(bucket string, fn func(k, v []byte) error) func(k, v []byte) error {
+	if !tx.db.checksums {
+		return fn
+	}
+	return func(k, v []byte) (err error) {
+		if v, err = tx.db.decodeValue(bucket, k, v); err != nil {
+			return
+		}
+		return fn(k, v)
+	}
+}
+
+// DeleteWhere deletes every key of bucket for which pred returns true and returns how many were deleted,
+// the keys are collected first and deleted after the walk since deleting through a bbolt cursor skips keys.
+func (tx *Tx) DeleteWhere(bucket string, pred func(k, v []byte) bool) (n int, err error) {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return
+	}
+	var keys [][]byte
+	if err = b.ForEach(tx.decodeFn(bucket, func(k, v []byte) error {
+		if v != nil && pred(k, v) {
+			keys = append(keys, append([]byte(nil), k...))
+		}
+		return nil
+	})); err != nil {
+		return
+	}
+	for _, k := range keys {
+		if err = tx.del(b, bucket, k); err != nil {
+			return
+		}
+		n++
+	}
+	return
+}
+
+// CountKeys returns the number of keys in bucket, including the names of nested buckets.
+// It uses Bucket.Stats, which only walks the pages, unless the bucket has nested buckets (their keys would be counted)
+// or the tx is writable (the stats don't see its uncommitted writes), then it counts with a cursor.
+func (tx *Tx) CountKeys(bucket string) (n int, err error) {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return
+	}
+	if !tx.Writable() {
+		if st := b.Stats(); st.BucketN == 1 {
+			return st.KeyN, nil
+		}
+	}
+	return tx.CountPrefix(bucket, nil)
+}
+
+// CountPrefix returns the number of keys in the bucket that start with prefix without reading their values.
+func (tx *Tx) CountPrefix(bucket string, prefix []byte) (n int, err error) {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return
+	}
+	c := b.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		n++
+	}
+	return
+}
+
+// RangePrefix calls fn for every key of bucket that starts with prefix, in order, stopping at the first one that doesn't.
+// Unlike Range, the values are decoded (see Options.VerifyChecksums) and a missing bucket returns ErrBucketNotFound.
+func (tx *Tx) RangePrefix(bucket string, prefix []byte, fn func(c *Cursor, k, v []byte) error) (err error) {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return
+	}
+	c := b.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		if v != nil {
+			if v, err = tx.db.decodeValue(bucket, k, v); err != nil {
+				return
+			}
+		}
+		if err = fn(c, k, v); err != nil {
+			return
+		}
+	}
+	return
 }
 
 func (tx *Tx) Range(bucket string, start []byte, fn func(cursor *Cursor, k, v []byte) error, forward bool) (err error) {
@@ -149,7 +478,10 @@ func (tx *Tx) Range(bucket string, start []byte, fn func(cursor *Cursor, k, v []
 // this is a workaround seting values inside a foreach loop which isn't allowed.
 func (tx *Tx) ForEachUpdate(bucket string, fn func(k, v []byte, setValue func(k, nv []byte)) (err error)) (err error) {
 	var updateTable map[string][]byte
-	b := tx.Bucket(bucket)
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return
+	}
 
 	setValue := func(k, v []byte) {
 		if updateTable == nil {
@@ -158,18 +490,18 @@ func (tx *Tx) ForEachUpdate(bucket string, fn func(k, v []byte, setValue func(k,
 		updateTable[string(k)] = v
 	}
 
-	if err = b.ForEach(func(k, v []byte) error {
+	if err = b.ForEach(tx.decodeFn(bucket, func(k, v []byte) error {
 		return fn(k, v, setValue)
-	}); err != nil {
+	})); err != nil {
 		return
 	}
 
 	for k, v := range updateTable {
 		kb := unsafeBytes(k)
 		if v == nil {
-			err = b.Delete(kb)
-		} else {
-			err = b.Put(kb, v)
+			err = tx.del(b, bucket, kb)
+		} else if err = tx.db.checkSize(bucket, kb, v); err == nil {
+			err = tx.put(b, bucket, kb, v)
 		}
 		if err != nil {
 			return
@@ -180,10 +512,33 @@ func (tx *Tx) ForEachUpdate(bucket string, fn func(k, v []byte, setValue func(k,
 }
 
 func (tx *Tx) SetNextIndex(bucket string, idx uint64) error {
+	tx.writes++
 	return tx.MustBucket(bucket).SetSequence(idx)
 }
 
+// SetNextIndexIfHigher sets the sequence of bucket to seq only if it's higher than the current one,
+// so merging sequences from different sources can never rewind a counter.
+func (tx *Tx) SetNextIndexIfHigher(bucket string, seq uint64) (set bool, err error) {
+	b := tx.MustBucket(bucket)
+	if seq <= b.Sequence() {
+		return false, nil
+	}
+	tx.writes++
+	return true, b.SetSequence(seq)
+}
+
+// SetNextIndexIfLower sets the sequence of bucket to seq only if it's lower than the current one.
+func (tx *Tx) SetNextIndexIfLower(bucket string, seq uint64) (set bool, err error) {
+	b := tx.MustBucket(bucket)
+	if seq >= b.Sequence() {
+		return false, nil
+	}
+	tx.writes++
+	return true, b.SetSequence(seq)
+}
+
 func (tx *Tx) NextIndex(bucket string) (uint64, error) {
+	tx.writes++
 	return tx.MustBucket(bucket).NextSequence()
 }
 
@@ -212,9 +567,9 @@ func GetAny[T any](db *DB, bucket, key string, unmarshalFn UnmarshalFn) (out T,
 }
 
 func ForEachTx[T any](tx *Tx, bucket string, fn func(key []byte, val T) error, filterFn func(k, v []byte) bool, unmarshalFn UnmarshalFn) error {
-	b := tx.Bucket(bucket)
+	b, err := tx.readBucket(bucket)
 	if b == nil {
-		return ErrBucketNotFound
+		return err
 	}
 
 	if unmarshalFn == nil {
@@ -224,7 +579,7 @@ func ForEachTx[T any](tx *Tx, bucket string, fn func(key []byte, val T) error, f
 	if filterFn == nil {
 		filterFn = filterOk
 	}
-	return b.ForEach(func(k, v []byte) (err error) {
+	return b.ForEach(tx.decodeFn(bucket, func(k, v []byte) (err error) {
 		if !filterFn(k, v) {
 			return
 		}
@@ -233,7 +588,7 @@ func ForEachTx[T any](tx *Tx, bucket string, fn func(key []byte, val T) error, f
 			return
 		}
 		return fn(k, val)
-	})
+	}))
 }
 
 // func getTx(tx *Tx, bucket string, id string, clone bool) (out []byte) {
@@ -1,5 +1,13 @@
 package mbbolt
 
+import (
+	"bytes"
+	"sort"
+
+	"github.com/alpineiq/genh"
+	"github.com/alpineiq/oerrs"
+)
+
 type TxBase interface {
 	GetBytes(bucket, key string, clone bool) (out []byte)
 	ForEachBytes(bucket string, fn func(k, v []byte) error) error
@@ -20,6 +28,15 @@ func OpenMultiTDB[T any](m *MultiDB, path string, opts *Options) (db TypedDB[T],
 	return
 }
 
+// MultiGetTyped is like OpenMultiTDB, but if opts doesn't set a marshaler, the MultiDB's marshaler is used.
+func MultiGetTyped[T any](m *MultiDB, name string, opts *Options) (TypedDB[T], error) {
+	if opts != nil && opts.MarshalFn == nil && m.opts.MarshalFn != nil {
+		opts = opts.Clone()
+		opts.MarshalFn, opts.UnmarshalFn = m.opts.MarshalFn, m.opts.UnmarshalFn
+	}
+	return OpenMultiTDB[T](m, name, opts)
+}
+
 func DBToTyped[T any](db *DB) TypedDB[T] { return TypedDB[T]{db} }
 
 type TypedDB[T any] struct {
@@ -33,19 +50,180 @@ func (db TypedDB[T]) ForEach(bucket string, fn func(key string, v T) error) erro
 	})
 }
 
+// ForEachReverse runs TypedTx.ForEachReverse in its own transaction.
+func (db TypedDB[T]) ForEachReverse(bucket string, fn func(key string, v T) error) error {
+	return db.View(func(tx *Tx) error {
+		return TypedTx[T]{tx}.ForEachReverse(bucket, fn)
+	})
+}
+
+// ForEachUpdate is Tx.ForEachUpdate with the values decoded and encoded, setting a nil value deletes the key.
+func (db TypedDB[T]) ForEachUpdate(bucket string, fn func(k string, v T, setValue func(k string, nv *T)) error) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.ForEachUpdate(bucket, func(k, v []byte, setBytes func(k, nv []byte)) (err error) {
+			var tv T
+			if err = db.unmarshalFn(v, &tv); err != nil {
+				return
+			}
+			setValue := func(k string, nv *T) {
+				if nv == nil {
+					setBytes([]byte(k), nil)
+					return
+				}
+				b, merr := db.marshalFn(*nv)
+				if merr != nil {
+					if err == nil {
+						err = merr
+					}
+					return
+				}
+				setBytes([]byte(k), b)
+			}
+			if ferr := fn(string(k), tv, setValue); ferr != nil {
+				return ferr
+			}
+			return
+		})
+	})
+}
+
 func (db TypedDB[T]) Get(bucket, key string) (v T, err error) {
 	err = db.GetAny(bucket, key, &v, db.unmarshalFn)
 	return
 }
 
+// GetWith is Get using unmarshal instead of the db's unmarshaler, e.g. to read values stored in a legacy format,
+// a nil unmarshal uses the db's.
+func (db TypedDB[T]) GetWith(bucket, key string, unmarshal UnmarshalFn) (v T, err error) {
+	if unmarshal == nil {
+		unmarshal = db.unmarshalFn
+	}
+	err = db.GetAny(bucket, key, &v, unmarshal)
+	return
+}
+
+// GetAuto is like Get, but if the db's unmarshaler fails it tries the fallback ones (see Options.FallbackUnmarshalFns),
+// which allows reading buckets with mixed encodings while migrating between them.
+func (db TypedDB[T]) GetAuto(bucket, key string) (v T, err error) {
+	var b []byte
+	if err = db.GetAny(bucket, key, &b, nil); err != nil {
+		return
+	}
+	if err = db.unmarshalFn(b, &v); err == nil {
+		return
+	}
+	for _, fn := range db.fallbackUnmarshalFns {
+		var fv T
+		if fn(b, &fv) == nil {
+			return fv, nil
+		}
+	}
+	return
+}
+
 func (db TypedDB[T]) Put(bucket, key string, val T) error {
 	return db.PutAny(bucket, key, val, db.marshalFn)
 }
 
+// PutWith is Put using marshal instead of the db's marshaler, a nil marshal uses the db's.
+func (db TypedDB[T]) PutWith(bucket, key string, val T, marshal MarshalFn) error {
+	if marshal == nil {
+		marshal = db.marshalFn
+	}
+	return db.PutAny(bucket, key, val, marshal)
+}
+
+// PutAll writes every entry of m in a single transaction. All the values are marshaled before it starts,
+// so if any of them fails nothing is written and the transaction isn't even opened.
+func (db TypedDB[T]) PutAll(bucket string, m map[string]T) error {
+	kvs := make([]KV[[]byte], 0, len(m))
+	for k, v := range m {
+		b, err := db.marshalAny(v, db.marshalFn)
+		if err != nil {
+			return oerrs.Errorf("%s: %w", k, err)
+		}
+		if err = db.checkSize(bucket, unsafeBytes(k), b); err != nil {
+			return err
+		}
+		kvs = append(kvs, KV[[]byte]{k, b})
+	}
+	// sorted keys make for fewer page splits
+	sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+
+	fn := func(tx *Tx) error {
+		b, err := tx.CreateBucketIfNotExists(bucket)
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if err = tx.put(b, bucket, unsafeBytes(kv.Key), kv.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if !db.useBatch.Load() {
+		return db.Update(fn)
+	}
+	return db.Batch(fn)
+}
+
+// Upsert runs TypedTx.Upsert in its own transaction.
+func (db TypedDB[T]) Upsert(bucket, key string, update func(old T, existed bool) T) error {
+	return db.Update(func(tx *Tx) error {
+		return TypedTx[T]{tx}.Upsert(bucket, key, update)
+	})
+}
+
+// GetSet runs TypedTx.GetSet in its own transaction.
+func (db TypedDB[T]) GetSet(bucket, key string, val T) (old T, err error) {
+	err = db.Update(func(tx *Tx) (err error) {
+		old, err = TypedTx[T]{tx}.GetSet(bucket, key, val)
+		return
+	})
+	return
+}
+
+// RangeScan decodes the values of the keys matching opts, if opts.Limit is reached next is set to the key
+// to use as opts.Start to get the next page, otherwise it's nil.
+func (db TypedDB[T]) RangeScan(bucket string, opts RangeOptions) (out []KV[T], next []byte, err error) {
+	err = db.View(func(tx *Tx) error {
+		out, next, err = TypedTx[T]{tx}.RangeScan(bucket, opts)
+		return err
+	})
+	return
+}
+
+type (
+	// RangeOptions controls RangeScan, Start is inclusive and End is exclusive,
+	// when Reverse is set the scan goes from Start down to End.
+	RangeOptions struct {
+		Start   []byte
+		End     []byte
+		Prefix  []byte
+		Limit   int
+		Reverse bool
+	}
+
+	KV[T any] struct {
+		Key   string
+		Value T
+	}
+)
+
 type TypedTx[T any] struct {
 	*Tx
 }
 
+// WithCache enables caching decoded values for the lifetime of the transaction,
+// a key's cached value is dropped when it's written or deleted through the tx.
+func (tx TypedTx[T]) WithCache() TypedTx[T] {
+	if tx.memo == nil {
+		tx.memo = map[bucketKey]any{}
+	}
+	return tx
+}
+
 func (tx TypedTx[T]) ForEach(bucket string, fn func(key string, v T) error) error {
 	return tx.ForEachBytes(bucket, func(k, v []byte) (err error) {
 		var tv T
@@ -56,8 +234,32 @@ func (tx TypedTx[T]) ForEach(bucket string, fn func(key string, v T) error) erro
 	})
 }
 
+// ForEachReverse is ForEach in descending key order, e.g. newest first for zero-padded timestamp keys.
+func (tx TypedTx[T]) ForEachReverse(bucket string, fn func(key string, v T) error) error {
+	return tx.ForEachBytesReverse(bucket, func(k, v []byte) (err error) {
+		var tv T
+		if err = tx.db.unmarshalFn(v, &tv); err != nil {
+			return err
+		}
+		return fn(string(k), tv)
+	})
+}
+
+// Get returns the decoded value of key, if the tx was created WithCache, it's only decoded once.
+// Use clone if T is a pointer or contains slices/maps/pointers that will be modified.
 func (tx TypedTx[T]) Get(bucket, key string) (v T, err error) {
-	err = tx.Tx.GetValue(bucket, key, &v)
+	if tx.memo == nil {
+		err = tx.Tx.GetValue(bucket, key, &v)
+		return
+	}
+
+	bk := bucketKey{bucket, key}
+	if v, ok := tx.memo[bk].(T); ok {
+		return genh.Clone(v, false), nil
+	}
+	if err = tx.Tx.GetValue(bucket, key, &v); err == nil {
+		tx.memo[bk] = genh.Clone(v, false)
+	}
 	return
 }
 
@@ -65,9 +267,132 @@ func (tx TypedTx[T]) Put(bucket, key string, v T) error {
 	return tx.Tx.PutValue(bucket, key, v)
 }
 
+// Upsert calls update with the current value of key (existed is false if it doesn't exist) and stores the result.
+func (tx TypedTx[T]) Upsert(bucket, key string, update func(old T, existed bool) T) error {
+	raw, err := tx.getBytes(bucket, unsafeBytes(key), false)
+	if err != nil {
+		return err
+	}
+	var old T
+	if raw != nil {
+		if old, err = tx.Get(bucket, key); err != nil {
+			return err
+		}
+	}
+	return tx.Put(bucket, key, update(old, raw != nil))
+}
+
+// GetSet stores val and returns the previous value, the zero value if key didn't exist.
+func (tx TypedTx[T]) GetSet(bucket, key string, val T) (old T, err error) {
+	raw, err := tx.getBytes(bucket, unsafeBytes(key), false)
+	if err != nil {
+		return
+	}
+	if raw == nil {
+		return old, tx.Put(bucket, key, val)
+	}
+	if old, err = tx.Get(bucket, key); err != nil {
+		return
+	}
+	err = tx.Put(bucket, key, val)
+	return
+}
+
 func (tx TypedTx[T]) MustGet(bucket, key string, def T) (v T) {
 	if err := tx.Tx.getAny(true, bucket, key, &v, tx.db.unmarshalFn); err != nil {
 		return def
 	}
 	return
 }
+
+func (tx TypedTx[T]) RangeScan(bucket string, opts RangeOptions) (out []KV[T], next []byte, err error) {
+	b, err := tx.readBucket(bucket)
+	if b == nil {
+		return nil, nil, err
+	}
+
+	c := b.Cursor()
+	k, v := opts.seek(c)
+	for ; k != nil && opts.inRange(k); k, v = opts.step(c) {
+		if opts.Limit > 0 && len(out) == opts.Limit {
+			next = append([]byte(nil), k...)
+			break
+		}
+		kv := KV[T]{Key: string(k)}
+		if v, err = tx.db.decodeValue(bucket, k, v); err != nil {
+			return
+		}
+		if err = tx.db.unmarshalFn(v, &kv.Value); err != nil {
+			return
+		}
+		out = append(out, kv)
+	}
+	return
+}
+
+func (opts *RangeOptions) seek(c *Cursor) (k, v []byte) {
+	if !opts.Reverse {
+		start := opts.Start
+		if opts.Prefix != nil && bytes.Compare(start, opts.Prefix) < 0 {
+			start = opts.Prefix
+		}
+		if start == nil {
+			return c.First()
+		}
+		return c.Seek(start)
+	}
+
+	// start is inclusive unless it comes from the prefix
+	start, inclusive := opts.Start, opts.Start != nil
+	if opts.Prefix != nil {
+		if end := prefixEnd(opts.Prefix); start == nil || (end != nil && bytes.Compare(start, end) >= 0) {
+			start, inclusive = end, false
+		}
+	}
+
+	if start == nil {
+		return c.Last()
+	}
+
+	if k, v = c.Seek(start); k == nil {
+		return c.Last()
+	}
+
+	if !inclusive || !bytes.Equal(k, start) {
+		return c.Prev()
+	}
+	return
+}
+
+func (opts *RangeOptions) step(c *Cursor) (k, v []byte) {
+	if opts.Reverse {
+		return c.Prev()
+	}
+	return c.Next()
+}
+
+func (opts *RangeOptions) inRange(k []byte) bool {
+	if opts.Prefix != nil && !bytes.HasPrefix(k, opts.Prefix) {
+		return false
+	}
+	if opts.End == nil {
+		return true
+	}
+	if opts.Reverse {
+		return bytes.Compare(k, opts.End) > 0
+	}
+	return bytes.Compare(k, opts.End) < 0
+}
+
+// prefixEnd returns the smallest key that's larger than all the keys with the given prefix,
+// or nil if there isn't one (the prefix is all 0xff).
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
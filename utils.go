@@ -2,8 +2,10 @@ package mbbolt
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"log"
 	"runtime"
 	"strings"
 	"sync"
@@ -11,6 +13,7 @@ import (
 	"unsafe"
 
 	"github.com/alpineiq/genh"
+	"github.com/alpineiq/oerrs"
 )
 
 type DBer interface {
@@ -67,6 +70,156 @@ func ConvertDB(dst, src DBer, fn ConvertFn) error {
 	return nil
 }
 
+// ConvertDBConsistent is like ConvertDB but reads src in a single read transaction,
+// so the copy is a point-in-time snapshot even if src is written to during the conversion.
+// It only takes a *DB, a SegDB spans multiple files so there's no way to get a consistent view across its segments.
+// dst must not be src, writing to it while the read transaction is open could block forever if the db has to grow.
+// The insertion order / expiry companion buckets aren't copied, dst keeps its own as the values are written.
+func ConvertDBConsistent(dst DBer, src *DB, fn ConvertFn) error {
+	if dst, ok := dst.(batcher); ok {
+		defer dst.UseBatch(dst.UseBatch(false))
+	}
+	if fn == nil {
+		fn = func(bucket string, k, v []byte) ([]byte, bool) {
+			return v, true
+		}
+	}
+	return src.View(func(tx *Tx) error {
+		return tx.ForEach(func(name []byte, b *Bucket) error {
+			bkt := string(name)
+			if isInternalBucket(bkt) {
+				return nil
+			}
+			if err := dst.SetNextIndex(bkt, b.Sequence()); err != nil {
+				return err
+			}
+			return tx.ForEachBytes(bkt, func(k, v []byte) error {
+				v, ok := fn(bkt, k, v)
+				if !ok {
+					return nil
+				}
+				return dst.Put(bkt, string(k), v)
+			})
+		})
+	})
+}
+
+// Codec is a marshal/unmarshal pair, used by ReencodeDB.
+type Codec struct {
+	M MarshalFn
+	U UnmarshalFn
+}
+
+// reencodeBucket holds ReencodeDB's progress, it maps a bucket's name to the last key re-encoded in it,
+// prefixed with reencodeDone once the bucket is finished.
+const reencodeBucket = "__reencode"
+
+const (
+	reencodeInProgress byte = iota
+	reencodeDone
+)
+
+// ReencodeDB decodes every value in db with from.U and stores it again encoded with to.M,
+// each bucket is walked in chunks of DefaultBulkLoadChunkSize keys, one write transaction per chunk.
+// newValue returns what a value of bucket is decoded into (e.g. new(T)), if it's nil values are decoded into an any,
+// which loses information for some codecs (json decodes all numbers to float64, so int64s above 2^53 get rounded).
+// The progress is saved along with every chunk, so an interrupted run continues where it stopped when restarted
+// with the same codecs, and it's removed once every bucket is done.
+// Unlike ConvertDB, the values are actually re-encoded rather than copied as is.
+// It doesn't change db's marshaler, call SetMarshaler(to.M, to.U) once it returns.
+func ReencodeDB(db *DB, from, to Codec, newValue func(bucket string) any) error {
+	if from.M == nil || from.U == nil || to.M == nil || to.U == nil {
+		log.Panic("ReencodeDB: nil codec func")
+	}
+	if newValue == nil {
+		newValue = func(string) any { return new(any) }
+	}
+	for _, bkt := range db.Buckets() {
+		if isInternalBucket(bkt) {
+			continue
+		}
+		var last []byte
+		done := false
+		if err := db.View(func(tx *Tx) error {
+			p, err := tx.GetBytesErr(reencodeBucket, bkt, true)
+			if len(p) > 0 {
+				done, last = p[0] == reencodeDone, p[1:]
+			}
+			return err
+		}); err != nil {
+			return err
+		}
+		for !done {
+			if err := db.Update(func(tx *Tx) (err error) {
+				if last, done, err = tx.reencodeChunk(bkt, last, DefaultBulkLoadChunkSize, from, to, newValue); err != nil {
+					return oerrs.Errorf("%s: %w", bkt, err)
+				}
+				state := reencodeInProgress
+				if done {
+					state = reencodeDone
+				}
+				return tx.PutBytes(reencodeBucket, bkt, append([]byte{state}, last...))
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return db.Update(func(tx *Tx) error {
+		if tx.Bucket(reencodeBucket) == nil {
+			return nil
+		}
+		return tx.DeleteBucket(reencodeBucket)
+	})
+}
+
+// reencodeChunk re-encodes up to n values after the key last (from the start if it's empty),
+// it returns the last key it processed and whether the bucket is done.
+func (tx *Tx) reencodeChunk(bucket string, last []byte, n int, from, to Codec, newValue func(string) any) (_ []byte, done bool, err error) {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return last, true, nil
+	}
+
+	type kv struct{ k, v []byte }
+	var chunk []kv
+	c := b.Cursor()
+	k, v := c.First()
+	if len(last) > 0 {
+		if k, v = c.Seek(last); bytes.Equal(k, last) {
+			k, v = c.Next()
+		}
+	}
+	for ; k != nil && len(chunk) < n; k, v = c.Next() {
+		if v == nil { // nested bucket
+			continue
+		}
+		if v, err = tx.db.decodeValue(bucket, k, v); err != nil {
+			return nil, false, err
+		}
+		val := newValue(bucket)
+		if err = from.U(v, val); err != nil {
+			return nil, false, oerrs.Errorf("%s: %w", k, err)
+		}
+		if v, err = to.M(val); err != nil {
+			return nil, false, oerrs.Errorf("%s: %w", k, err)
+		}
+		chunk = append(chunk, kv{append([]byte(nil), k...), v})
+	}
+	done = k == nil
+
+	// bbolt doesn't allow modifying a bucket while iterating it
+	for _, e := range chunk {
+		if err = tx.db.checkSize(bucket, e.k, e.v); err != nil {
+			return nil, false, err
+		}
+		if err = tx.put(b, bucket, e.k, e.v); err != nil {
+			return nil, false, err
+		}
+		last = e.k
+	}
+	return last, done, nil
+}
+
 func FramesToString(frs *runtime.Frames) string {
 	var buf strings.Builder
 	for {
@@ -1,11 +1,16 @@
 package mbbolt
 
 import (
+	"errors"
 	"fmt"
 	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/alpineiq/genh"
+	"github.com/alpineiq/oerrs"
+	"go.etcd.io/bbolt"
 )
 
 func TestConvert(t *testing.T) {
@@ -45,3 +50,223 @@ func TestConvert(t *testing.T) {
 		}
 	}
 }
+
+func TestConvertConsistent(t *testing.T) {
+	tmp := t.TempDir()
+	src, err := Open(filepath.Join(tmp, "src.db"), nil)
+	dieIf(t, err)
+	defer src.Close()
+	dst, err := Open(filepath.Join(tmp, "dst.db"), nil)
+	dieIf(t, err)
+	defer dst.Close()
+
+	for _, bkt := range []string{"a", "b"} {
+		for i := 0; i < 10; i++ {
+			dieIf(t, src.PutBytes(bkt, fmt.Sprintf("%02d", i), []byte(bkt)))
+		}
+	}
+	dieIf(t, src.SetExpiry("a", "00", time.Now().Add(time.Hour)))
+
+	var written bool
+	dieIf(t, ConvertDBConsistent(dst, src, func(bucket string, k, v []byte) ([]byte, bool) {
+		if !written {
+			written = true
+			dieIf(t, src.Update(func(tx *Tx) error {
+				if err := tx.PutBytes("a", "new", []byte("x")); err != nil {
+					return err
+				}
+				return tx.PutBytes("b", "new", []byte("x"))
+			}))
+		}
+		return v, true
+	}))
+
+	for _, bkt := range []string{"a", "b"} {
+		if n, _ := dst.CountPrefix(bkt, nil); n != 10 {
+			t.Fatalf("%s: expected 10 keys, got %d", bkt, n)
+		}
+		if v, _ := dst.GetBytes(bkt, "new"); v != nil {
+			t.Fatalf("%s: the concurrent write leaked into the snapshot", bkt)
+		}
+	}
+	for _, bkt := range dst.Buckets() {
+		if isInternalBucket(bkt) {
+			t.Fatalf("internal bucket %s was copied", bkt)
+		}
+	}
+}
+
+func TestReencodeDB(t *testing.T) {
+	const N = DefaultBulkLoadChunkSize*2 + 5
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	for i := 0; i < N; i++ {
+		dieIf(t, db.Put("json", fmt.Sprintf("%06d", i), &S{X: i, Y: "y", Blah: &S{X: -i}}))
+	}
+
+	from := Codec{DefaultMarshalFn, DefaultUnmarshalFn}
+	to := Codec{genh.MarshalMsgpack, genh.UnmarshalMsgpack}
+
+	// interrupt the run in the middle of the second chunk
+	const errStop = oerrs.String("stop")
+	calls := 0
+	failing := Codec{func(v any) ([]byte, error) {
+		if calls++; calls > DefaultBulkLoadChunkSize+10 {
+			return nil, errStop
+		}
+		return to.M(v)
+	}, to.U}
+	if err := ReencodeDB(db, from, failing, nil); !errors.Is(err, errStop) {
+		t.Fatalf("expected errStop, got %v", err)
+	}
+	// the first chunk is converted and not redone, the rest isn't
+	dieIf(t, ReencodeDB(db, from, to, nil))
+	if v, _ := db.GetBytes(reencodeBucket, "json"); v != nil {
+		t.Fatal("the progress wasn't cleared")
+	}
+
+	db.SetMarshaler(to.M, to.U)
+	for i := 0; i < N; i++ {
+		var s S
+		dieIf(t, db.GetAny("json", fmt.Sprintf("%06d", i), &s, genh.UnmarshalMsgpack))
+		if s.X != i || s.Y != "y" || s.Blah == nil || s.Blah.X != -i {
+			t.Fatalf("%d: unexpected value %+v", i, s)
+		}
+	}
+}
+
+func TestReencodeDBSizeLimit(t *testing.T) {
+	opts := DefaultOptions.Clone()
+	opts.MaxValueSize = 32
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), opts)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.PutBytes("b", "k", []byte(`"v"`)))
+
+	from := Codec{DefaultMarshalFn, DefaultUnmarshalFn}
+	padded := Codec{func(v any) ([]byte, error) {
+		b, err := from.M(v)
+		return append(b, make([]byte, 32)...), err
+	}, from.U}
+	var verr *ValueTooLargeError
+	if err := ReencodeDB(db, from, padded, nil); !errors.As(err, &verr) || verr.Key != "k" {
+		t.Fatalf("expected a ValueTooLargeError, got %v", err)
+	}
+	if v, _ := db.GetBytes("b", "k"); string(v) != `"v"` {
+		t.Fatalf("the value was rewritten: %q", v)
+	}
+}
+
+func TestReencodeDBInt64(t *testing.T) {
+	type V struct {
+		TS int64
+	}
+	const ts = 1<<53 + 1
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+	dieIf(t, db.Put("b", "k", V{ts}))
+
+	from := Codec{DefaultMarshalFn, DefaultUnmarshalFn}
+	to := Codec{genh.MarshalMsgpack, genh.UnmarshalMsgpack}
+	dieIf(t, ReencodeDB(db, from, to, func(string) any { return new(V) }))
+
+	var v V
+	dieIf(t, db.GetAny("b", "k", &v, genh.UnmarshalMsgpack))
+	if v.TS != ts {
+		t.Fatalf("expected %d, got %d", int64(ts), v.TS)
+	}
+}
+
+func TestMeteredDB(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	type call struct {
+		op  string
+		err error
+	}
+	var calls []call
+	var mdb DBer = NewMeteredDB(db, func(op string, d time.Duration, err error) {
+		if d < 0 {
+			t.Errorf("%s: unexpected duration %v", op, d)
+		}
+		calls = append(calls, call{op, err})
+	})
+
+	var v string
+	dieIf(t, mdb.Put("b", "k", "v"))
+	dieIf(t, mdb.Get("b", "k", &v))
+	dieIf(t, mdb.Delete("b", "k"))
+	gerr := mdb.Get("b", "k", &v)
+	if gerr == nil {
+		t.Fatal("expected an error getting a deleted key")
+	}
+	exp := []call{{"Put", nil}, {"Get", nil}, {"Delete", nil}, {"Get", gerr}}
+	if !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("expected %v, got %v", exp, calls)
+	}
+
+	// it forwards UseBatch to the wrapped db
+	old := db.UseBatch(true)
+	if !mdb.(batcher).UseBatch(old) || db.useBatch.Load() != old {
+		t.Fatal("UseBatch wasn't forwarded")
+	}
+
+	seg := NewSegDB(t.TempDir(), ".db", nil, 2)
+	defer seg.Close()
+	dieIf(t, NewMeteredDB(seg, func(string, time.Duration, error) {}).Put("b", "k", "v"))
+}
+
+// flakyDB fails Put with err until fails reaches 0.
+type flakyDB struct {
+	DBer
+	fails int
+	calls int
+	err   error
+}
+
+func (f *flakyDB) Put(bucket, key string, v any) error {
+	if f.calls++; f.fails > 0 {
+		f.fails--
+		return f.err
+	}
+	return f.DBer.Put(bucket, key, v)
+}
+
+func TestRetryingDB(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "x.db"), nil)
+	dieIf(t, err)
+	defer db.Close()
+
+	var waits []time.Duration
+	backoff := func(retry int) time.Duration {
+		d := time.Duration(retry) * time.Microsecond
+		waits = append(waits, d)
+		return d
+	}
+
+	f := &flakyDB{DBer: db, fails: 2, err: bbolt.ErrTimeout}
+	dieIf(t, NewRetryingDB(f, 3, backoff).Put("b", "k", "v"))
+	if f.calls != 3 || !reflect.DeepEqual(waits, []time.Duration{time.Microsecond, 2 * time.Microsecond}) {
+		t.Fatalf("unexpected calls %d / waits %v", f.calls, waits)
+	}
+	var v string
+	dieIf(t, db.Get("b", "k", &v))
+
+	// still failing once the attempts are exhausted
+	f = &flakyDB{DBer: db, fails: 5, err: fmt.Errorf("wrapped: %w", bbolt.ErrTimeout)}
+	if err := NewRetryingDB(f, 3, nil).Put("b", "k", "v"); !errors.Is(err, bbolt.ErrTimeout) || f.calls != 3 {
+		t.Fatalf("expected a timeout after 3 calls, got %v after %d", err, f.calls)
+	}
+
+	// permanent errors aren't retried
+	perm := errors.New("permanent")
+	f = &flakyDB{DBer: db, fails: 5, err: perm}
+	if err := NewRetryingDB(f, 3, nil).Put("b", "k", "v"); err != perm || f.calls != 1 {
+		t.Fatalf("expected the permanent error after 1 call, got %v after %d", err, f.calls)
+	}
+}
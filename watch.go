@@ -0,0 +1,111 @@
+package mbbolt
+
+import (
+	"sync"
+
+	"github.com/alpineiq/genh"
+)
+
+// TenantChange is a single change sent by MultiDB.WatchBucket.
+type TenantChange struct {
+	DB      string
+	Key     string
+	Deleted bool
+}
+
+// Watch calls fn with the mutations of every committed write transaction, see ReplicationSource for what's recorded.
+// fn is called right after the commit, in commit order, so it should be fast, the returned func removes it.
+// When several transactions commit concurrently, it may be called from another committing goroutine.
+func (db *DB) Watch(fn func(muts []Mutation)) (cancel func()) {
+	id := db.watchID.Add(1)
+	db.watchers.Set(id, fn)
+	return func() { db.watchers.Delete(id) }
+}
+
+type bucketWatch struct {
+	bucket string
+	ch     chan TenantChange
+}
+
+type mdbWatches struct {
+	mux     sync.RWMutex
+	watches map[*bucketWatch]struct{}
+	hooks   map[*DB]func()
+	dropped genh.AtomicInt64
+}
+
+// WatchBucket returns a channel that receives the changes made to bucket in every db opened by mdb,
+// including ones opened after the call. Changes are dropped while the channel is full so a slow reader never
+// blocks commits, see WatchDropped. Call cancel to stop watching.
+func (mdb *MultiDB) WatchBucket(bucket string) (_ <-chan TenantChange, cancel func()) {
+	w := &bucketWatch{bucket: bucket, ch: make(chan TenantChange, 128)}
+	mw := &mdb.watches
+	mw.mux.Lock()
+	if mw.watches == nil {
+		mw.watches, mw.hooks = map[*bucketWatch]struct{}{}, map[*DB]func(){}
+	}
+	mw.watches[w] = struct{}{}
+	mw.mux.Unlock()
+
+	mdb.ForEachDB(func(name string, db *DB) error {
+		mdb.hookDB(name, db)
+		return nil
+	})
+
+	var once sync.Once
+	return w.ch, func() {
+		once.Do(func() {
+			mw.mux.Lock()
+			defer mw.mux.Unlock()
+			delete(mw.watches, w)
+			close(w.ch)
+			if len(mw.watches) == 0 {
+				for db, unhook := range mw.hooks {
+					unhook()
+					delete(mw.hooks, db)
+				}
+			}
+		})
+	}
+}
+
+// hookDB starts forwarding db's changes to the bucket watchers if there are any.
+func (mdb *MultiDB) hookDB(name string, db *DB) {
+	mw := &mdb.watches
+	mw.mux.Lock()
+	defer mw.mux.Unlock()
+	if len(mw.watches) == 0 || mw.hooks[db] != nil {
+		return
+	}
+	mw.hooks[db] = db.Watch(func(muts []Mutation) {
+		mw.mux.RLock()
+		defer mw.mux.RUnlock()
+		for w := range mw.watches {
+			for _, m := range muts {
+				if m.Bucket != w.bucket {
+					continue
+				}
+				select {
+				case w.ch <- TenantChange{DB: name, Key: string(m.Key), Deleted: m.Delete}:
+				default:
+					mw.dropped.Add(1)
+				}
+			}
+		}
+	})
+}
+
+// WatchDropped returns the number of changes WatchBucket dropped because a watcher's channel was full.
+func (mdb *MultiDB) WatchDropped() int64 {
+	return mdb.watches.dropped.Load()
+}
+
+func (mdb *MultiDB) unhookDB(db *DB) {
+	mw := &mdb.watches
+	mw.mux.Lock()
+	defer mw.mux.Unlock()
+	if unhook := mw.hooks[db]; unhook != nil {
+		unhook()
+		delete(mw.hooks, db)
+	}
+}